@@ -6,4 +6,5 @@ require (
 	github.com/aws/aws-sdk-go v1.38.13
 	github.com/logrusorgru/aurora v0.0.0-20200102142835-e9ef32dff381
 	github.com/mergermarket/cdflow2-config-common v0.46.0
+	gopkg.in/yaml.v3 v3.0.1
 )
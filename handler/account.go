@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+var validAccountID = regexp.MustCompile(`^[0-9]{12}$`)
+
+// getConfiguredAccountID returns config.params.account_id, the account all AWS credentials used with the component must be for.
+func getConfiguredAccountID(config map[string]interface{}) (string, error) {
+	raw, ok := config["account_id"]
+	if !ok || raw == nil {
+		return "", nil
+	}
+	accountID, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("config.params.account_id must be a string - quote it in cdflow.yaml so it is not read as a number")
+	}
+	if !validAccountID.MatchString(accountID) {
+		return "", fmt.Errorf("config.params.account_id must be a 12 digit AWS account ID, got %q", accountID)
+	}
+	return accountID, nil
+}
+
+// getAccountAlias returns the alias of the account the AWS credentials are for, or an empty string if it has none or it can't be
+// listed (e.g. without iam:ListAccountAliases permission).
+func (h *Handler) getAccountAlias() string {
+	if h.accountAlias != nil {
+		return *h.accountAlias
+	}
+	alias := ""
+	output, err := h.getIAMClient().ListAccountAliases(&iam.ListAccountAliasesInput{})
+	if err == nil && len(output.AccountAliases) > 0 {
+		alias = aws.StringValue(output.AccountAliases[0])
+	}
+	h.accountAlias = &alias
+	return alias
+}
+
+// describeCallerAccount returns the account the AWS credentials are for, with its alias if it has one.
+func (h *Handler) describeCallerAccount() string {
+	accountID := h.getAccountID()
+	if alias := h.getAccountAlias(); alias != "" {
+		return fmt.Sprintf("%s (%s)", accountID, alias)
+	}
+	return accountID
+}
+
+// checkAccount returns an error if the AWS credentials are not for the expected account.
+func (h *Handler) checkAccount(expectedAccountID, source string) error {
+	accountID := h.getAccountID()
+	if accountID == "" {
+		return fmt.Errorf("unable to check that the AWS credentials are for account %s from %s", expectedAccountID, source)
+	}
+	if accountID != expectedAccountID {
+		return fmt.Errorf(
+			"AWS credentials are for account %s, but %s is %s - check the credentials are for the right account",
+			h.describeCallerAccount(), source, expectedAccountID,
+		)
+	}
+	return nil
+}
+
+// handleAccountID checks the AWS credentials are for config.params.account_id, or for an environment's deploy_account_id when
+// deploying an environment that sets one.
+func (h *Handler) handleAccountID(config map[string]interface{}, env string) bool {
+	expectedAccountID, err := getConfiguredAccountID(config)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s %v\n", h.styles.cross, err)
+		return false
+	}
+	source := "config.params.account_id"
+	if env != "" {
+		envConfig, err := getEnvironmentConfig(config, env)
+		if err != nil {
+			fmt.Fprintf(h.ErrorStream, "  %s %v\n", h.styles.cross, err)
+			return false
+		}
+		if envConfig.deployAccountID != "" {
+			expectedAccountID = envConfig.deployAccountID
+			source = fmt.Sprintf("config.params.environments.%s.deploy_account_id", env)
+		}
+	}
+	if expectedAccountID == "" {
+		return true
+	}
+	if err := h.checkAccount(expectedAccountID, source); err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s %v\n", h.styles.cross, err)
+		if env != "" {
+			fmt.Fprintf(h.ErrorStream, "\nRefusing to deploy %s to the wrong AWS account.\n", env)
+		}
+		return false
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s AWS account %s matches %s\n", h.styles.tick, h.describeCallerAccount(), source)
+	return true
+}
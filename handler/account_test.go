@@ -0,0 +1,173 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type mockedIAM struct {
+	iamiface.IAMAPI
+	alias string
+	// denied are the actions denied when simulating policies, all others are allowed.
+	denied []string
+}
+
+func (m mockedIAM) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	return &iam.GetRoleOutput{Role: &iam.Role{
+		RoleName: input.RoleName,
+		Arn:      aws.String("arn:aws:iam::123456789012:role/ci/" + aws.StringValue(input.RoleName)),
+	}}, nil
+}
+
+func (m mockedIAM) SimulatePrincipalPolicyPages(
+	input *iam.SimulatePrincipalPolicyInput, fn func(*iam.SimulatePolicyResponse, bool) bool,
+) error {
+	output := &iam.SimulatePolicyResponse{}
+	for _, action := range input.ActionNames {
+		decision := iam.PolicyEvaluationDecisionTypeAllowed
+		for _, denied := range m.denied {
+			if *action == denied {
+				decision = iam.PolicyEvaluationDecisionTypeImplicitDeny
+			}
+		}
+		result := &iam.EvaluationResult{EvalActionName: action, EvalDecision: aws.String(decision), EvalResourceName: aws.String("*")}
+		for _, resource := range input.ResourceArns {
+			result.ResourceSpecificResults = append(result.ResourceSpecificResults, &iam.ResourceSpecificResult{
+				EvalResourceName:     resource,
+				EvalResourceDecision: aws.String(decision),
+			})
+		}
+		output.EvaluationResults = append(output.EvaluationResults, result)
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m mockedIAM) ListAccountAliases(*iam.ListAccountAliasesInput) (*iam.ListAccountAliasesOutput, error) {
+	output := &iam.ListAccountAliasesOutput{}
+	if m.alias != "" {
+		output.AccountAliases = []*string{aws.String(m.alias)}
+	}
+	return output, nil
+}
+
+func TestCheckInputConfigurationAccountID(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		accountID interface{}
+		ok        bool
+		expected  string
+	}{
+		{"matching", "123456789012", true, "AWS account 123456789012 (my-team-dev) matches config.params.account_id"},
+		{"different", "999999999999", false, "AWS credentials are for account 123456789012 (my-team-dev), but config.params.account_id is 999999999999"},
+		{"number", 123456789012.0, false, "config.params.account_id must be a string"},
+		{"invalid", "12345", false, "config.params.account_id must be a 12 digit AWS account ID"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			myHandler := testHandler(handler.Opts{S3Client: newMemoryS3(), IAMClient: mockedIAM{alias: "my-team-dev"}, ErrorStream: &errorBuffer})
+			request := setupRequest()
+			request.Config["account_id"] = test.accountID
+
+			// When
+			ok := myHandler.CheckInputConfiguration(request.Config, request.Env)
+
+			// Then
+			if ok != test.ok || !strings.Contains(errorBuffer.String(), test.expected) {
+				t.Fatalf("expected %v with %q, got %v with output: %q", test.ok, test.expected, ok, errorBuffer.String())
+			}
+		})
+	}
+}
+
+func TestSetupInWrongAccount(t *testing.T) {
+	// Given
+	var errorBuffer bytes.Buffer
+	s3Client := newMemoryS3()
+	myHandler := testHandler(handler.Opts{S3Client: s3Client, IAMClient: mockedIAM{alias: "my-team-dev"}, ErrorStream: &errorBuffer})
+	request := setupRequest()
+	request.Config["account_id"] = "999999999999"
+	response := common.CreateSetupResponse()
+
+	// When
+	err := myHandler.Setup(request, response)
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if response.Success {
+		t.Fatal("expected setup to fail")
+	}
+	if len(s3Client.buckets) != 0 {
+		t.Fatalf("expected no buckets to be created, got %v", s3Client.buckets)
+	}
+}
+
+func TestPrepareTerraformEnvironmentAccount(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		accountID interface{}
+		live      map[string]interface{}
+		success   bool
+		expected  string
+	}{
+		{
+			"deploy account matching", nil, map[string]interface{}{"deploy_account_id": "123456789012"},
+			true, "AWS account 123456789012 (my-team-dev) matches config.params.environments.live.deploy_account_id",
+		},
+		{
+			"deploy account different", nil, map[string]interface{}{"deploy_account_id": "999999999999"},
+			false, "Refusing to deploy live to the wrong AWS account.",
+		},
+		{
+			// the environment's deploy account replaces the top-level account, and account_id is the account holding its state
+			"state and deploy accounts", "555555555555",
+			map[string]interface{}{"account_id": "999999999999", "deploy_account_id": "123456789012"},
+			true, "AWS account 123456789012 (my-team-dev) matches config.params.environments.live.deploy_account_id",
+		},
+		{
+			"state in another account", nil, map[string]interface{}{"account_id": "999999999999"},
+			true, "live/terraform.tfstate (eu-west-1, locked with dynamodb table cdflow2-tflocks, account 999999999999)",
+		},
+		{
+			"invalid deploy account", nil, map[string]interface{}{"deploy_account_id": "12345"},
+			false, "config.params.environments.live.deploy_account_id must be a 12 digit AWS account ID",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			myHandler := testHandler(handler.Opts{IAMClient: mockedIAM{alias: "my-team-dev"}, ErrorStream: &errorBuffer})
+			request := prepareTerraformRequest("live", "")
+			if test.accountID != nil {
+				request.Config["account_id"] = test.accountID
+			}
+			request.Config["environments"] = map[string]interface{}{"live": test.live}
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Success != test.success || !strings.Contains(errorBuffer.String(), test.expected) {
+				t.Fatalf("expected success %v with %q, got %v with output: %q", test.success, test.expected, response.Success, errorBuffer.String())
+			}
+			if strings.Contains(errorBuffer.String(), "config.params.account_id") {
+				t.Fatalf("expected the top-level account not to be checked when deploying an environment with its own, got: %q", errorBuffer.String())
+			}
+		})
+	}
+}
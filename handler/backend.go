@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const (
+	// lockingDynamoDB locks state with an item in the cdflow2-tflocks DynamoDB table (the default).
+	lockingDynamoDB = "dynamodb"
+	// lockingS3 locks state with a lock file alongside the state in S3 (use_lockfile, requires terraform 1.10 or later).
+	lockingS3 = "s3"
+	// lockingBoth uses both, for migrating from DynamoDB to S3 locking.
+	lockingBoth = "both"
+)
+
+// defaultStateKeyTemplate is the layout of state keys in the bucket - terraform stores the state for the environment's workspace at
+// <workspace_key_prefix>/<workspace>/<key>, so the template must contain {env} as a whole path segment.
+const defaultStateKeyTemplate = "{team}/{component}/{env}/terraform.tfstate"
+
+var stateKeyPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+var validStackName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// backendConfig is the config.params.backend section of cdflow.yaml.
+type backendConfig struct {
+	locking          string
+	stateKeyTemplate string
+	stack            string
+	// roleARN is a role assumed for access to state, separate from the role used for the deploy itself.
+	roleARN         string
+	roleSessionName string
+	roleExternalID  string
+	// assumeRoleBlock passes the role in an assume_role block (terraform 1.6 and later) rather than the role_arn attribute.
+	assumeRoleBlock bool
+}
+
+func defaultBackendConfig() *backendConfig {
+	return &backendConfig{locking: lockingDynamoDB, stateKeyTemplate: defaultStateKeyTemplate}
+}
+
+// validateStateKeyTemplate checks that a template only uses known placeholders and can be split into the workspace_key_prefix
+// and key of the s3 backend around {env}.
+func validateStateKeyTemplate(template string) error {
+	for _, placeholder := range stateKeyPlaceholder.FindAllString(template, -1) {
+		switch placeholder {
+		case "{team}", "{component}", "{env}", "{stack}":
+		default:
+			return fmt.Errorf("config.params.backend.state_key contains unknown placeholder %s, expected {team}, {component}, {env} or {stack}", placeholder)
+		}
+	}
+	if strings.Count(template, "{env}") != 1 {
+		return fmt.Errorf("config.params.backend.state_key must contain {env} exactly once")
+	}
+	parts := strings.Split(template, "/{env}/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.HasPrefix(parts[0], "/") {
+		return fmt.Errorf("config.params.backend.state_key must be of the form <prefix>/{env}/<key>, got %q", template)
+	}
+	if strings.Contains(template, "//") || strings.HasSuffix(template, "/") {
+		return fmt.Errorf("config.params.backend.state_key must not contain empty path segments, got %q", template)
+	}
+	return nil
+}
+
+func (b *backendConfig) usesStack() bool {
+	return strings.Contains(b.stateKeyTemplate, "{stack}")
+}
+
+// renderStateKey returns the workspace_key_prefix and key for the state of a component.
+func (b *backendConfig) renderStateKey(team, component string) (string, string) {
+	return b.renderStackStateKey(team, component, b.stack)
+}
+
+// renderStackStateKey returns the workspace_key_prefix and key for the state of a stack of a component.
+func (b *backendConfig) renderStackStateKey(team, component, stack string) (string, string) {
+	replacer := strings.NewReplacer("{team}", team, "{component}", component, "{stack}", stack)
+	parts := strings.SplitN(b.stateKeyTemplate, "/{env}/", 2)
+	return replacer.Replace(parts[0]), replacer.Replace(parts[1])
+}
+
+// stateKeyPattern returns the prefix shared by the state keys of a component, and a pattern matching them that captures the
+// environment and stack - for finding the state of every environment and stack.
+func (b *backendConfig) stateKeyPattern(team, component string) (string, *regexp.Regexp) {
+	template := strings.NewReplacer("{team}", team, "{component}", component).Replace(b.stateKeyTemplate)
+	prefix := template
+	if i := strings.IndexByte(template, '{'); i >= 0 {
+		prefix = template[:i]
+	}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	stack := false
+	for {
+		i := strings.IndexByte(template, '{')
+		if i < 0 {
+			pattern.WriteString(regexp.QuoteMeta(template))
+			break
+		}
+		pattern.WriteString(regexp.QuoteMeta(template[:i]))
+		placeholder := stateKeyPlaceholder.FindString(template[i:])
+		switch {
+		case placeholder == "{env}":
+			pattern.WriteString("(?P<env>[^/]+)")
+		case placeholder == "{stack}" && !stack:
+			pattern.WriteString("(?P<stack>[a-zA-Z0-9_.-]+)")
+			stack = true
+		default:
+			// a later {stack} is the same stack, which is checked when the key is matched
+			pattern.WriteString("[a-zA-Z0-9_.-]+")
+		}
+		template = template[i+len(placeholder):]
+	}
+	pattern.WriteString("$")
+	return prefix, regexp.MustCompile(pattern.String())
+}
+
+func getBackendConfig(config map[string]interface{}) (*backendConfig, error) {
+	result := defaultBackendConfig()
+	raw, ok := config["backend"]
+	if !ok || raw == nil {
+		return result, nil
+	}
+	params, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.backend must be a map")
+	}
+	for key, value := range params {
+		if key == "assume_role_block" {
+			assumeRoleBlock, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("config.params.backend.assume_role_block must be true or false")
+			}
+			result.assumeRoleBlock = assumeRoleBlock
+			continue
+		}
+		stringValue, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("config.params.backend.%s must be a string", key)
+		}
+		switch key {
+		case "role_arn":
+			result.roleARN = stringValue
+		case "role_session_name":
+			result.roleSessionName = stringValue
+		case "external_id":
+			result.roleExternalID = stringValue
+		case "state_key":
+			if err := validateStateKeyTemplate(stringValue); err != nil {
+				return nil, err
+			}
+			result.stateKeyTemplate = stringValue
+		case "stack":
+			result.stack = stringValue
+		case "locking":
+			switch stringValue {
+			case lockingDynamoDB, lockingS3, lockingBoth:
+				result.locking = stringValue
+			default:
+				return nil, fmt.Errorf("config.params.backend.locking must be one of dynamodb, s3 or both, got %q", stringValue)
+			}
+		default:
+			return nil, fmt.Errorf("config.params.backend.%s is not a recognised option", key)
+		}
+	}
+	return result, nil
+}
+
+func (b *backendConfig) usesDynamoDBLocking() bool {
+	return b.locking == lockingDynamoDB || b.locking == lockingBoth
+}
+
+func (b *backendConfig) usesS3Locking() bool {
+	return b.locking == lockingS3 || b.locking == lockingBoth
+}
+
+// handleBackendConfig reads config.params.backend - the stack can also be set with CDFLOW2_STACK in the environment, e.g. to deploy
+// each stack of a component from the same cdflow.yaml.
+func (h *Handler) handleBackendConfig(config map[string]interface{}, inputEnv map[string]string) bool {
+	backend, err := getBackendConfig(config)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s %v\n", h.styles.cross, err)
+		return false
+	}
+	if inputEnv["CDFLOW2_STACK"] != "" {
+		backend.stack = inputEnv["CDFLOW2_STACK"]
+	}
+	if backend.usesStack() && backend.stack == "" {
+		fmt.Fprintf(h.ErrorStream, "  %s config.params.backend.state_key contains {stack}, but no stack set (config.params.backend.stack or CDFLOW2_STACK)\n", h.styles.cross)
+		return false
+	}
+	if backend.stack != "" && !validStackName.MatchString(backend.stack) {
+		fmt.Fprintf(h.ErrorStream, "  %s invalid stack %q, must contain only letters, numbers, '_', '.' and '-'\n", h.styles.cross, backend.stack)
+		return false
+	}
+	if backend.stack != "" && !backend.usesStack() {
+		fmt.Fprintf(h.ErrorStream, "  %s stack %q set, but config.params.backend.state_key does not contain {stack}\n", h.styles.cross, backend.stack)
+		return false
+	}
+	h.backendConfig = backend
+	if backend.locking != lockingDynamoDB {
+		fmt.Fprintf(h.ErrorStream, "  %s config.params.backend.locking in cdflow.yaml: %s\n", h.styles.tick, backend.locking)
+	}
+	if backend.stateKeyTemplate != defaultStateKeyTemplate {
+		fmt.Fprintf(h.ErrorStream, "  %s config.params.backend.state_key in cdflow.yaml: %s\n", h.styles.tick, backend.stateKeyTemplate)
+	}
+	if backend.stack != "" {
+		fmt.Fprintf(h.ErrorStream, "  %s stack: %s\n", h.styles.tick, backend.stack)
+	}
+	if backend.roleARN != "" {
+		fmt.Fprintf(h.ErrorStream, "  %s config.params.backend.role_arn in cdflow.yaml: %s\n", h.styles.tick, backend.roleARN)
+	}
+	return true
+}
+
+// addBackendCredentials adds the config for how terraform authenticates to the state backend. When a role is configured the backend
+// assumes it using the credentials in the environment, otherwise the static credentials from the environment are passed as a
+// fallback, with display values so they are not logged.
+func (h *Handler) addBackendCredentials(response *common.PrepareTerraformResponse, backend *stateBackend, inputEnv map[string]string) {
+	if backend.roleARN != "" {
+		if h.backendConfig.assumeRoleBlock {
+			attributes := []string{fmt.Sprintf("role_arn = %q", backend.roleARN)}
+			if h.backendConfig.roleSessionName != "" {
+				attributes = append(attributes, fmt.Sprintf("session_name = %q", h.backendConfig.roleSessionName))
+			}
+			if h.backendConfig.roleExternalID != "" {
+				attributes = append(attributes, fmt.Sprintf("external_id = %q", h.backendConfig.roleExternalID))
+			}
+			response.TerraformBackendConfig["assume_role"] = "{" + strings.Join(attributes, ", ") + "}"
+			return
+		}
+		response.TerraformBackendConfig["role_arn"] = backend.roleARN
+		if h.backendConfig.roleSessionName != "" {
+			response.TerraformBackendConfig["session_name"] = h.backendConfig.roleSessionName
+		}
+		if h.backendConfig.roleExternalID != "" {
+			response.TerraformBackendConfig["external_id"] = h.backendConfig.roleExternalID
+		}
+		return
+	}
+	for _, credential := range []struct {
+		name   string
+		envVar string
+		secret bool
+	}{
+		{"access_key", "AWS_ACCESS_KEY_ID", false},
+		{"secret_key", "AWS_SECRET_ACCESS_KEY", true},
+		{"token", "AWS_SESSION_TOKEN", true},
+	} {
+		value := inputEnv[credential.envVar]
+		if value == "" {
+			continue
+		}
+		displayValue := value
+		if credential.secret {
+			displayValue = "********"
+		}
+		response.TerraformBackendConfigParameters[credential.name] = &common.TerraformBackendConfigParameter{
+			Value:        value,
+			DisplayValue: displayValue,
+		}
+	}
+}
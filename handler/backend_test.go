@@ -0,0 +1,322 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestPrepareTerraformLocking(t *testing.T) {
+	for _, test := range []struct {
+		locking       string
+		dynamoDBTable string
+		useLockfile   string
+	}{
+		{"dynamodb", "cdflow2-tflocks", ""},
+		{"s3", "", "true"},
+		{"both", "cdflow2-tflocks", "true"},
+	} {
+		t.Run(test.locking, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			dynamoDBClient := &tablesDynamoDB{tables: map[string]bool{}}
+			if test.dynamoDBTable != "" {
+				dynamoDBClient.tables[test.dynamoDBTable] = true
+			}
+			myHandler := handler.New(&handler.Opts{
+				S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+				DynamoDBClient:       dynamoDBClient,
+				SecretsManagerClient: mockedSecretsManager{},
+				STSClient:            mockedSTS{account: "123456789012"},
+				IAMClient:            mockedIAM{},
+				OutputStream:         &bytes.Buffer{},
+				ErrorStream:          &errorBuffer,
+			})
+			request := prepareTerraformRequest("live", "")
+			request.Config["backend"] = map[string]interface{}{"locking": test.locking}
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil || !response.Success {
+				t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+			}
+			if response.TerraformBackendConfig["dynamodb_table"] != test.dynamoDBTable {
+				t.Fatalf("expected dynamodb_table %q, got %q", test.dynamoDBTable, response.TerraformBackendConfig["dynamodb_table"])
+			}
+			if response.TerraformBackendConfig["use_lockfile"] != test.useLockfile {
+				t.Fatalf("expected use_lockfile %q, got %q", test.useLockfile, response.TerraformBackendConfig["use_lockfile"])
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		// Given
+		var errorBuffer bytes.Buffer
+		myHandler := handler.New(&handler.Opts{
+			S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+			DynamoDBClient:       &mockedDynamoDB{},
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			OutputStream:         &bytes.Buffer{},
+			ErrorStream:          &errorBuffer,
+		})
+		request := prepareTerraformRequest("live", "")
+		request.Config["backend"] = map[string]interface{}{"locking": "etcd"}
+		response := common.CreatePrepareTerraformResponse()
+
+		// When
+		myHandler.PrepareTerraform(request, response, tempDir(t))
+
+		// Then
+		if response.Success {
+			t.Fatal("unexpected success")
+		}
+		if !strings.Contains(errorBuffer.String(), "config.params.backend.locking must be one of dynamodb, s3 or both") {
+			t.Fatal("expected explanation, got:", errorBuffer.String())
+		}
+	})
+}
+
+func TestSetupWithS3Locking(t *testing.T) {
+	// Given
+	dynamoDBClient := &tablesDynamoDB{tables: map[string]bool{}}
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+		DynamoDBClient:       dynamoDBClient,
+		ECRClient:            mockedECR{},
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		IAMClient:            mockedIAM{},
+		OutputStream:         &bytes.Buffer{},
+		ErrorStream:          &errorBuffer,
+	})
+	request := setupRequest()
+	request.Config["backend"] = map[string]interface{}{"locking": "s3"}
+	response := common.CreateSetupResponse()
+
+	// When
+	err := myHandler.Setup(request, response)
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("setup failed:", err, errorBuffer.String())
+	}
+	if len(dynamoDBClient.tables) != 0 {
+		t.Fatalf("expected no dynamodb tables to be created, got: %v", dynamoDBClient.tables)
+	}
+}
+
+func TestPrepareTerraformStateKey(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		backend            map[string]interface{}
+		env                map[string]string
+		workspaceKeyPrefix string
+		key                string
+		message            string
+	}{
+		{
+			name:               "default",
+			workspaceKeyPrefix: "my-team/my-component",
+			key:                "terraform.tfstate",
+			message:            "live terraform state: s3://cdflow2-tfstate-bucket-1/my-team/my-component/live/terraform.tfstate",
+		},
+		{
+			name:               "custom layout",
+			backend:            map[string]interface{}{"state_key": "legacy/{component}/{env}/state.tfstate"},
+			workspaceKeyPrefix: "legacy/my-component",
+			key:                "state.tfstate",
+			message:            "live terraform state: s3://cdflow2-tfstate-bucket-1/legacy/my-component/live/state.tfstate",
+		},
+		{
+			name:               "stack from config",
+			backend:            map[string]interface{}{"state_key": "{team}/{component}/{env}/{stack}.tfstate", "stack": "network"},
+			workspaceKeyPrefix: "my-team/my-component",
+			key:                "network.tfstate",
+		},
+		{
+			name:               "stack from environment",
+			backend:            map[string]interface{}{"state_key": "{team}/{component}-{stack}/{env}/terraform.tfstate", "stack": "network"},
+			env:                map[string]string{"CDFLOW2_STACK": "database"},
+			workspaceKeyPrefix: "my-team/my-component-database",
+			key:                "terraform.tfstate",
+		},
+		{
+			name:    "missing stack",
+			backend: map[string]interface{}{"state_key": "{team}/{component}/{env}/{stack}.tfstate"},
+			message: "contains {stack}, but no stack set",
+		},
+		{
+			name:    "stack not in layout",
+			backend: map[string]interface{}{"stack": "network"},
+			message: `stack "network" set, but config.params.backend.state_key does not contain {stack}`,
+		},
+		{
+			name:    "unknown placeholder",
+			backend: map[string]interface{}{"state_key": "{team}/{project}/{env}/terraform.tfstate"},
+			message: "unknown placeholder {project}",
+		},
+		{
+			name:    "env not a path segment",
+			backend: map[string]interface{}{"state_key": "{team}/{component}-{env}.tfstate"},
+			message: "must be of the form <prefix>/{env}/<key>",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			myHandler := handler.New(&handler.Opts{
+				S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+				DynamoDBClient:       &mockedDynamoDB{},
+				SecretsManagerClient: mockedSecretsManager{},
+				STSClient:            mockedSTS{account: "123456789012"},
+				IAMClient:            mockedIAM{},
+				OutputStream:         &bytes.Buffer{},
+				ErrorStream:          &errorBuffer,
+			})
+			request := prepareTerraformRequest("live", "")
+			if test.backend != nil {
+				request.Config["backend"] = test.backend
+			}
+			for key, value := range test.env {
+				request.Env[key] = value
+			}
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Success != (test.workspaceKeyPrefix != "") {
+				t.Fatalf("unexpected success %v, output: %s", response.Success, errorBuffer.String())
+			}
+			if response.TerraformBackendConfig["workspace_key_prefix"] != test.workspaceKeyPrefix || response.TerraformBackendConfig["key"] != test.key {
+				t.Fatalf("unexpected backend config: %v", response.TerraformBackendConfig)
+			}
+			if !strings.Contains(errorBuffer.String(), test.message) {
+				t.Fatalf("expected %q in output, got: %s", test.message, errorBuffer.String())
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformBackendCredentials(t *testing.T) {
+	prepare := func(t *testing.T, backend map[string]interface{}, environments map[string]interface{}, env map[string]string) *common.PrepareTerraformResponse {
+		var errorBuffer bytes.Buffer
+		myHandler := handler.New(&handler.Opts{
+			S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+			DynamoDBClient:       &mockedDynamoDB{},
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			S3ClientFactory: s3ClientFactory(t, map[string]s3iface.S3API{
+				"arn:aws:iam::123456789012:role/tfstate eu-west-1": newMemoryS3("cdflow2-tfstate-bucket-1"),
+				"arn:aws:iam::999999999999:role/tfstate eu-west-1": newMemoryS3("cdflow2-tfstate-bucket-1"),
+			}),
+			DynamoDBClientFactory: dynamoDBClientFactory(t, map[string]dynamodbiface.DynamoDBAPI{
+				"arn:aws:iam::123456789012:role/tfstate eu-west-1": newMemoryDynamoDB(),
+				"arn:aws:iam::999999999999:role/tfstate eu-west-1": newMemoryDynamoDB(),
+			}),
+			OutputStream: &bytes.Buffer{},
+			ErrorStream:  &errorBuffer,
+		})
+		request := prepareTerraformRequest("live", "")
+		if backend != nil {
+			request.Config["backend"] = backend
+		}
+		if environments != nil {
+			request.Config["environments"] = environments
+		}
+		for key, value := range env {
+			request.Env[key] = value
+		}
+		response := common.CreatePrepareTerraformResponse()
+		if err := myHandler.PrepareTerraform(request, response, tempDir(t)); err != nil || !response.Success {
+			t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+		}
+		return response
+	}
+	assertNoStaticCredentials := func(t *testing.T, response *common.PrepareTerraformResponse) {
+		for _, name := range []string{"access_key", "secret_key", "token"} {
+			if _, ok := response.TerraformBackendConfig[name]; ok {
+				t.Fatalf("unexpected %s in backend config", name)
+			}
+			if _, ok := response.TerraformBackendConfigParameters[name]; ok {
+				t.Fatalf("unexpected %s in backend config parameters", name)
+			}
+		}
+	}
+
+	t.Run("static credentials fallback", func(t *testing.T) {
+		// When
+		response := prepare(t, nil, nil, map[string]string{"AWS_SESSION_TOKEN": "test-session-token"})
+
+		// Then
+		if parameter := response.TerraformBackendConfigParameters["access_key"]; parameter == nil || parameter.Value != "test-access-key" {
+			t.Fatalf("expected access_key parameter, got: %+v", parameter)
+		}
+		for name, value := range map[string]string{"secret_key": "test-secret-access-key", "token": "test-session-token"} {
+			parameter := response.TerraformBackendConfigParameters[name]
+			if parameter == nil || parameter.Value != value || parameter.DisplayValue == value {
+				t.Fatalf("expected %s parameter with masked display value, got: %+v", name, parameter)
+			}
+		}
+	})
+
+	t.Run("empty credentials omitted", func(t *testing.T) {
+		// When
+		response := prepare(t, nil, nil, nil)
+
+		// Then
+		if _, ok := response.TerraformBackendConfigParameters["token"]; ok {
+			t.Fatal("unexpected empty token")
+		}
+	})
+
+	t.Run("role_arn", func(t *testing.T) {
+		// When
+		response := prepare(t, map[string]interface{}{
+			"role_arn":          "arn:aws:iam::123456789012:role/tfstate",
+			"role_session_name": "cdflow2",
+		}, nil, nil)
+
+		// Then
+		assertNoStaticCredentials(t, response)
+		if response.TerraformBackendConfig["role_arn"] != "arn:aws:iam::123456789012:role/tfstate" || response.TerraformBackendConfig["session_name"] != "cdflow2" {
+			t.Fatalf("unexpected backend config: %v", response.TerraformBackendConfig)
+		}
+	})
+
+	t.Run("assume_role block with environment role", func(t *testing.T) {
+		// When
+		response := prepare(t, map[string]interface{}{
+			"role_arn":          "arn:aws:iam::123456789012:role/tfstate",
+			"assume_role_block": true,
+		}, map[string]interface{}{
+			"live": map[string]interface{}{"backend_role_arn": "arn:aws:iam::999999999999:role/tfstate"},
+		}, nil)
+
+		// Then
+		assertNoStaticCredentials(t, response)
+		if response.TerraformBackendConfig["assume_role"] != `{role_arn = "arn:aws:iam::999999999999:role/tfstate"}` {
+			t.Fatalf("unexpected backend config: %v", response.TerraformBackendConfig)
+		}
+		if _, ok := response.TerraformBackendConfig["role_arn"]; ok {
+			t.Fatal("unexpected role_arn attribute with assume_role block")
+		}
+	})
+}
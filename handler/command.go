@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// CommandRequest contains the fields common to all commands run directly against the plugin (i.e. outside of a cdflow2 release or deploy).
+type CommandRequest struct {
+	Component string
+	Config    map[string]interface{}
+	Env       map[string]string
+}
+
+// prepareCommand performs the checks common to all commands, returning the team on success. Problems are output to the user
+// and reported as an Exit error.
+func (h *Handler) prepareCommand(request *CommandRequest) (string, error) {
+	if request.Component == "" {
+		fmt.Fprintln(h.ErrorStream, "component must be specified")
+		return "", Exit(false)
+	}
+	return h.prepareTeamCommand(request)
+}
+
+// prepareTeamCommand is prepareCommand for commands that can apply to all of a team's components.
+func (h *Handler) prepareTeamCommand(request *CommandRequest) (string, error) {
+	team, err := h.getTeam(request.Config["team"])
+	if err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		return "", Exit(false)
+	}
+	if !h.CheckInputConfiguration(request.Config, request.Env) {
+		return "", Exit(false)
+	}
+	if !h.CheckAWSResources() {
+		return "", Exit(false)
+	}
+	return team, nil
+}
@@ -2,7 +2,6 @@ package handler
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -64,6 +63,11 @@ func (h *Handler) printDefaultRegionStatusMessage(region string) {
 
 // CheckInputConfiguration checks config from cdflow.yaml and the input environment
 func (h *Handler) CheckInputConfiguration(config map[string]interface{}, inputEnv map[string]string) bool {
+	return h.checkInputConfigurationForEnv(config, inputEnv, "")
+}
+
+// checkInputConfigurationForEnv checks the input configuration for deploying an environment, which may be in another account.
+func (h *Handler) checkInputConfigurationForEnv(config map[string]interface{}, inputEnv map[string]string, env string) bool {
 	problems := 0
 
 	fmt.Fprintf(h.ErrorStream, "\n%s\n\n", h.styles.au.Underline("Checking AWS configuration..."))
@@ -72,6 +76,14 @@ func (h *Handler) CheckInputConfiguration(config map[string]interface{}, inputEn
 	}
 	if !h.handleAWSCredentials(inputEnv) {
 		problems++
+	} else if !h.handleAccountID(config, env) {
+		problems++
+	}
+	if !h.handleReleaseStore(config, inputEnv) {
+		problems++
+	}
+	if !h.handleBackendConfig(config, inputEnv) {
+		problems++
 	}
 	fmt.Fprintln(h.ErrorStream, "")
 	if problems > 0 {
@@ -140,20 +152,21 @@ func (h *Handler) handleTfstateBucket(buckets []string) (bool, bool) {
 	return true, false
 }
 
-func (h *Handler) handleTflocksTable() bool {
+func (h *Handler) handleTflocksTable() (bool, bool) {
 	_, err := h.getDynamoDBClient().DescribeTable(&dynamodb.DescribeTableInput{
 		TableName: aws.String(tflocksTableName),
 	})
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException {
 			fmt.Fprintf(h.ErrorStream, "  %s dynamodb table not found: %s\n", h.styles.cross, tflocksTableName)
-			return false
+			return false, true
 		}
-		log.Panic(err)
+		fmt.Fprintf(h.ErrorStream, "  %s unable to describe dynamodb table %s: %v\n", h.styles.cross, tflocksTableName, err)
+		return false, false
 	}
 	fmt.Fprintf(h.ErrorStream, "  %s dynamodb table found: %s\n", h.styles.tick, tflocksTableName)
 	h.tflocksTable = tflocksTableName
-	return true
+	return true, false
 }
 
 func (h *Handler) handleLambdaBucket(outputEnv map[string]string, buckets []string) (bool, bool) {
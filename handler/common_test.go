@@ -5,9 +5,88 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
 )
 
+type mockedSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (m mockedSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(m.secrets[*input.SecretId])}, nil
+}
+
+type mockedSTS struct {
+	stsiface.STSAPI
+	account string
+}
+
+func (m mockedSTS) GetCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String(m.account),
+		Arn:     aws.String("arn:aws:sts::" + m.account + ":assumed-role/deploy/session"),
+		UserId:  aws.String("AROAEXAMPLE:session"),
+	}, nil
+}
+
+// testHandler returns a handler with in-memory and mocked AWS clients, using any options set in opts instead of the defaults.
+func testHandler(opts handler.Opts) *handler.Handler {
+	if opts.S3Client == nil {
+		opts.S3Client = newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	}
+	if opts.DynamoDBClient == nil {
+		opts.DynamoDBClient = &tablesDynamoDB{tables: map[string]bool{"cdflow2-tflocks": true}}
+	}
+	if opts.ECRClient == nil {
+		opts.ECRClient = mockedECR{}
+	}
+	if opts.SecretsManagerClient == nil {
+		opts.SecretsManagerClient = mockedSecretsManager{}
+	}
+	if opts.STSClient == nil {
+		opts.STSClient = mockedSTS{account: "123456789012"}
+	}
+	if opts.IAMClient == nil {
+		opts.IAMClient = mockedIAM{}
+	}
+	if opts.OutputStream == nil {
+		opts.OutputStream = &bytes.Buffer{}
+	}
+	if opts.ErrorStream == nil {
+		opts.ErrorStream = &bytes.Buffer{}
+	}
+	return handler.New(&opts)
+}
+
+// prepareTerraform runs prepare terraform for live with a handler from testHandler, adding config and env to the request, and returns
+// the response and the error output.
+func prepareTerraform(
+	t *testing.T, opts handler.Opts, version string, config map[string]interface{}, env map[string]string,
+) (*common.PrepareTerraformResponse, string) {
+	var errorBuffer bytes.Buffer
+	opts.ErrorStream = &errorBuffer
+	request := prepareTerraformRequest("live", version)
+	for key, value := range config {
+		request.Config[key] = value
+	}
+	for key, value := range env {
+		request.Env[key] = value
+	}
+	response := common.CreatePrepareTerraformResponse()
+	if err := testHandler(opts).PrepareTerraform(request, response, tempDir(t)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return response, errorBuffer.String()
+}
+
 func TestCheckInputConfiguration(t *testing.T) {
 	t.Run("errors in input configuration", func(t *testing.T) {
 		// Given
@@ -56,4 +135,25 @@ func TestCheckInputConfiguration(t *testing.T) {
 		}
 	})
 
+	t.Run("release store bucket without credentials", func(t *testing.T) {
+		// Given
+		var errorBuffer bytes.Buffer
+		myHandler := handler.New(&handler.Opts{OutputStream: &bytes.Buffer{}, ErrorStream: &errorBuffer})
+
+		config := map[string]interface{}{
+			"default_region": "eu-west-1",
+			"release_store":  map[string]interface{}{"type": "s3", "bucket": "my-releases"},
+		}
+
+		// When
+		success := myHandler.CheckInputConfiguration(config, map[string]string{})
+
+		// Then
+		if success {
+			t.Fatal("unexpected success")
+		}
+		if !strings.Contains(errorBuffer.String(), "missing AWS credentials") {
+			t.Fatal("didn't output message about missing AWS credentials, output was:", errorBuffer.String())
+		}
+	})
 }
@@ -24,6 +24,11 @@ func (h *Handler) ConfigureRelease(request *common.ConfigureReleaseRequest, resp
 		return nil
 	}
 
+	if !h.checkPermissions(request.Config, team, request.Component, "release") {
+		response.Success = false
+		return nil
+	}
+
 	response.Monitoring.APIKey = h.getDatadogAPIKey()
 
 	for buildID, reqs := range request.ReleaseRequirements {
@@ -84,10 +89,16 @@ func (h *Handler) ConfigureRelease(request *common.ConfigureReleaseRequest, resp
 		return nil
 	}
 
+	if err := h.checkMigrated(team, request.Component); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
 	return nil
 }
 
-// CheckAWSResources checks that the Release Bucket, Tf State Bucket & Tf Locks Table are present
+// CheckAWSResources checks that the Release Bucket (unless another release store is configured), Tf State Bucket & Tf Locks Table (unless state is locked in S3) are present
 func (h *Handler) CheckAWSResources() bool {
 	problems := 0
 	fmt.Fprintf(h.ErrorStream, "%s\n\n", h.styles.au.Underline("Checking AWS resources..."))
@@ -98,17 +109,22 @@ func (h *Handler) CheckAWSResources() bool {
 		return false
 	}
 
-	if ok, _ := h.handleReleaseBucket(buckets); !ok {
-		problems++
+	if h.releaseStore == nil {
+		if ok, _ := h.handleReleaseBucket(buckets); ok {
+			h.releaseStore = NewS3ReleaseStore(h.getS3Client(), h.releaseBucket)
+		} else {
+			problems++
+		}
 	}
 
 	if ok, _ := h.handleTfstateBucket(buckets); !ok {
 		problems++
 	}
 
-	ok := h.handleTflocksTable()
-	if !ok {
-		problems++
+	if h.backendConfig.usesDynamoDBLocking() {
+		if ok, _ := h.handleTflocksTable(); !ok {
+			problems++
+		}
 	}
 
 	fmt.Fprintln(h.ErrorStream, "")
@@ -30,6 +30,10 @@ func (m mockedDynamoDB) DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.D
 	return &dynamodb.DescribeTableOutput{}, nil
 }
 
+func (m mockedDynamoDB) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{}, nil
+}
+
 type failingDynamoDB struct {
 	dynamodbiface.DynamoDBAPI
 }
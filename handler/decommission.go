@@ -0,0 +1,386 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/internal/ui"
+)
+
+// DecommissionRequest is the input to the decommission command.
+type DecommissionRequest struct {
+	CommandRequest
+}
+
+// terraformState is the part of a terraform state file needed to tell whether it still has resources.
+type terraformState struct {
+	Resources []struct {
+		Mode      string            `json:"mode"`
+		Type      string            `json:"type"`
+		Name      string            `json:"name"`
+		Instances []json.RawMessage `json:"instances"`
+	} `json:"resources"`
+}
+
+// objectVersions are the versions (and delete markers) of the objects in a bucket under a prefix, or of a single key.
+type objectVersions struct {
+	client   s3iface.S3API
+	bucket   string
+	prefix   string
+	versions []*s3.ObjectIdentifier
+}
+
+func listObjectVersions(client s3iface.S3API, bucket, prefix string, exact bool) (*objectVersions, error) {
+	result := objectVersions{client: client, bucket: bucket, prefix: prefix}
+	add := func(key, versionID *string) {
+		if !exact || aws.StringValue(key) == prefix {
+			result.versions = append(result.versions, &s3.ObjectIdentifier{Key: key, VersionId: versionID})
+		}
+	}
+	if err := client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(output *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range output.Versions {
+			add(version.Key, version.VersionId)
+		}
+		for _, marker := range output.DeleteMarkers {
+			add(marker.Key, marker.VersionId)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (v *objectVersions) delete() error {
+	for _, version := range v.versions {
+		if _, err := v.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket:    aws.String(v.bucket),
+			Key:       version.Key,
+			VersionId: version.VersionId,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decommissionEnv is the terraform state of an environment (or a stack of one) of a component being decommissioned.
+type decommissionEnv struct {
+	*componentState
+	state *objectVersions
+	// lockFile is the S3 lock file, which terraform leaves behind when it uses S3 locking.
+	lockFile *objectVersions
+	// lockTableItems are the LockIDs of the items terraform keeps in the lock table for the state.
+	lockTableItems []string
+}
+
+// countStateResources returns the number of managed resources in the current version of the environment's state.
+func (h *Handler) countStateResources(backend *stateBackend, env string) (int, error) {
+	output, err := h.getStateS3Client(backend).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(backend.bucket),
+		Key:    aws.String(backend.stateKey(env)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return 0, err
+	}
+	var state terraformState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("invalid terraform state: %v", err)
+	}
+	count := 0
+	for _, resource := range state.Resources {
+		if resource.Mode == "managed" {
+			count += len(resource.Instances)
+		}
+	}
+	return count, nil
+}
+
+// listComponentTargets returns the terraform state of a component for every environment and stack - the state found in the state
+// buckets, and for the environments and stacks with deployment records or in config.params.environments, which may only have previous
+// versions of their state or lock items left.
+func (h *Handler) listComponentTargets(config map[string]interface{}, team, component string) ([]*componentState, error) {
+	result, err := h.listComponentStates(config, team, component)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, state := range result {
+		found[state.backend.bucket+"/"+state.backend.stateKey(state.env)] = true
+	}
+	add := func(env, stack string) error {
+		if h.backendConfig.usesStack() != (stack != "") {
+			// records from before the state key was changed
+			return nil
+		}
+		backend, err := h.getStateBackend(config, team, component, env)
+		if err != nil {
+			return err
+		}
+		backend.workspaceKeyPrefix, backend.key = h.backendConfig.renderStackStateKey(team, component, stack)
+		if !found[backend.bucket+"/"+backend.stateKey(env)] {
+			found[backend.bucket+"/"+backend.stateKey(env)] = true
+			result = append(result, &componentState{env: env, stack: stack, backend: backend})
+		}
+		return nil
+	}
+	recorded, err := h.listDeploymentEnvs(team, component)
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range recorded {
+		stacks, err := h.listDeploymentStacks(team, component, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, stack := range stacks {
+			if err := add(env, stack); err != nil {
+				return nil, err
+			}
+		}
+	}
+	envConfigs, err := getEnvironmentConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range sortedEnvNames(envConfigs) {
+		if err := add(env, h.backendConfig.stack); err != nil {
+			return nil, err
+		}
+	}
+	sortComponentStates(result)
+	return result, nil
+}
+
+// getDecommissionEnv returns the state of an environment (or a stack of one) to be deleted, or an error if it can't be deleted because
+// it still has resources or is locked.
+func (h *Handler) getDecommissionEnv(target *componentState) (*decommissionEnv, error) {
+	backend, env, name := target.backend, target.env, target.name()
+	resources, err := h.countStateResources(backend, env)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check the terraform state for %s has no resources: %v", name, err)
+	}
+	if resources > 0 {
+		fmt.Fprintf(h.ErrorStream, "  %s terraform state for %s has %d resources\n", h.styles.cross, name, resources)
+		return nil, fmt.Errorf("the terraform state for %s still has %d resources - destroy the environment first (cdflow2 destroy %s)", name, resources, env)
+	}
+	locks, err := h.getStateLocks(backend, env)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check for a lock on the terraform state for %s: %v", name, err)
+	}
+	for _, lock := range locks {
+		fmt.Fprintf(h.ErrorStream, "  %s terraform state for %s is ", h.styles.cross, name)
+		h.printStateLock(lock, "")
+		return nil, fmt.Errorf("the terraform state for %s is locked", name)
+	}
+	client := h.getStateS3Client(backend)
+	key := backend.stateKey(env)
+	result := decommissionEnv{componentState: target}
+	if result.state, err = listObjectVersions(client, backend.bucket, key, true); err != nil {
+		return nil, err
+	}
+	if result.lockFile, err = listObjectVersions(client, backend.bucket, stateLockFileKey(backend, env), true); err != nil {
+		return nil, err
+	}
+	if backend.lockTable != "" {
+		for _, lockID := range []string{backend.bucket + "/" + key, backend.bucket + "/" + key + "-md5"} {
+			output, err := h.getStateDynamoDBClient(backend).GetItem(&dynamodb.GetItemInput{
+				TableName:      aws.String(backend.lockTable),
+				Key:            map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(lockID)}},
+				ConsistentRead: aws.Bool(true),
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(output.Item) > 0 {
+				result.lockTableItems = append(result.lockTableItems, lockID)
+			}
+		}
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s terraform state for %s has no resources\n", h.styles.tick, name)
+	return &result, nil
+}
+
+// Decommission deletes everything the plugin keeps for a component - its ECR repository, releases, terraform state, lock table
+// items, deployment records and freezes - once the state of every environment is empty.
+func (h *Handler) Decommission(request *DecommissionRequest) error {
+	team, err := h.prepareCommand(&request.CommandRequest)
+	if err != nil {
+		return err
+	}
+	component := request.Component
+
+	fmt.Fprintf(h.ErrorStream, "\n%s\n\n", h.styles.au.Underline("Checking terraform state..."))
+	targets, err := h.listComponentTargets(request.Config, team, component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to list environments: %v\n", err)
+		return Exit(false)
+	}
+	var envs []*decommissionEnv
+	var problems []string
+	for _, target := range targets {
+		env, err := h.getDecommissionEnv(target)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		envs = append(envs, env)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(h.ErrorStream, "\nRefusing to decommission %s:\n", component)
+		for _, problem := range problems {
+			fmt.Fprintf(h.ErrorStream, "  - %s\n", problem)
+		}
+		return Exit(false)
+	}
+
+	fmt.Fprintf(h.ErrorStream, "\n%s\n\n", h.styles.au.Underline("Finding resources..."))
+	repoURI, err := h.getECRRepository(component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to get ECR repository: %v\n", err)
+		return Exit(false)
+	}
+	releasePrefix := fmt.Sprintf("%s/%s/", team, component)
+	releases, err := h.releaseStore.List(releasePrefix)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to list releases: %v\n", err)
+		return Exit(false)
+	}
+	records, err := listObjectVersions(h.getS3Client(), h.tfstateBucket, deploymentsComponentPrefix(team, component), false)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to list deployment records: %v\n", err)
+		return Exit(false)
+	}
+	teamFreezes, err := h.getAdhocFreezes(team)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to get freezes: %v\n", err)
+		return Exit(false)
+	}
+	var freezes []*adhocFreeze
+	for _, freeze := range teamFreezes {
+		if freeze.Component == component {
+			freezes = append(freezes, freeze)
+		}
+	}
+
+	writer := tabwriter.NewWriter(h.OutputStream, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "RESOURCE\tLOCATION")
+	count := 0
+	add := func(resource, location string) {
+		count++
+		fmt.Fprintf(writer, "%s\t%s\n", resource, location)
+	}
+	if repoURI != "" {
+		add("ECR repository", repoURI)
+	}
+	for _, release := range releases {
+		add("release", h.releaseStore.URL(release.Key))
+	}
+	for _, env := range envs {
+		if len(env.state.versions) > 0 {
+			add("terraform state", fmt.Sprintf("s3://%s/%s (%s, %d versions)", env.backend.bucket, env.state.prefix, env.name(), len(env.state.versions)))
+		}
+		if len(env.lockFile.versions) > 0 {
+			add("terraform lock file", fmt.Sprintf("s3://%s/%s (%s, %d versions)", env.backend.bucket, env.lockFile.prefix, env.name(), len(env.lockFile.versions)))
+		}
+		for _, lockID := range env.lockTableItems {
+			add("lock table item", fmt.Sprintf("%s: %s (%s)", env.backend.lockTable, lockID, env.name()))
+		}
+	}
+	if len(records.versions) > 0 {
+		add("deployment records", fmt.Sprintf("s3://%s/%s (%d versions)", h.tfstateBucket, records.prefix, len(records.versions)))
+	}
+	for _, freeze := range freezes {
+		add("freeze", fmt.Sprintf("s3://%s/%s", h.tfstateBucket, freezeKey(team, freeze.ID)))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if count == 0 {
+		fmt.Fprintf(h.ErrorStream, "Nothing found for %s.\n", component)
+		return nil
+	}
+
+	if !ui.Confirm(fmt.Sprintf(
+		"\nPermanently delete everything listed above for %s, including all versions of its terraform state? Only 'yes' will be accepted to confirm: ",
+		component,
+	), h.InputStream, h.ErrorStream) {
+		fmt.Fprintln(h.ErrorStream, "Decommission cancelled.")
+		return Exit(false)
+	}
+
+	fail := func(what string, err error) error {
+		fmt.Fprintf(h.ErrorStream, "  %s unable to delete %s: %v\n", h.styles.cross, what, err)
+		fmt.Fprintln(h.ErrorStream, "\nDecommission incomplete - run it again to delete what remains.")
+		return Exit(false)
+	}
+	if repoURI != "" {
+		if _, err := h.getECRClient().DeleteRepository(&ecr.DeleteRepositoryInput{
+			RepositoryName: aws.String(component),
+			Force:          aws.Bool(true),
+		}); err != nil {
+			return fail("ECR repository", err)
+		}
+		fmt.Fprintf(h.ErrorStream, "  %s deleted ECR repository %s\n", h.styles.tick, component)
+	}
+	for _, release := range releases {
+		if err := h.releaseStore.Delete(release.Key); err != nil {
+			return fail("release "+release.Key, err)
+		}
+	}
+	if len(releases) > 0 {
+		fmt.Fprintf(h.ErrorStream, "  %s deleted %d releases\n", h.styles.tick, len(releases))
+	}
+	// deployment records are deleted last, so that a rerun after a failure still finds every environment
+	for _, env := range envs {
+		for _, lockID := range env.lockTableItems {
+			if _, err := h.getStateDynamoDBClient(env.backend).DeleteItem(&dynamodb.DeleteItemInput{
+				TableName: aws.String(env.backend.lockTable),
+				Key:       map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(lockID)}},
+			}); err != nil {
+				return fail("lock table item "+lockID, err)
+			}
+		}
+		if err := env.lockFile.delete(); err != nil {
+			return fail("terraform lock file for "+env.name(), err)
+		}
+		if err := env.state.delete(); err != nil {
+			return fail("terraform state for "+env.name(), err)
+		}
+		fmt.Fprintf(h.ErrorStream, "  %s deleted terraform state for %s\n", h.styles.tick, env.name())
+	}
+	for _, freeze := range freezes {
+		if err := h.deleteAdhocFreeze(freeze); err != nil {
+			return fail("freeze "+freeze.ID, err)
+		}
+	}
+	if len(freezes) > 0 {
+		fmt.Fprintf(h.ErrorStream, "  %s deleted %d freezes\n", h.styles.tick, len(freezes))
+	}
+	if err := records.delete(); err != nil {
+		return fail("deployment records", err)
+	}
+	if len(records.versions) > 0 {
+		fmt.Fprintf(h.ErrorStream, "  %s deleted deployment records\n", h.styles.tick)
+	}
+	fmt.Fprintf(h.ErrorStream, "\n%s Decommissioned %s.\n", h.styles.tick, component)
+	return nil
+}
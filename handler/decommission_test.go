@@ -0,0 +1,192 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+)
+
+const emptyState = `{"version": 4, "serial": 12, "resources": [{"mode": "data", "type": "aws_caller_identity", "name": "current", "instances": [{}]}]}`
+
+func TestDecommission(t *testing.T) {
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	setup := func(t *testing.T, input string) (*handler.Handler, *memoryS3, *memoryDynamoDB, *memoryECR, *bytes.Buffer, *bytes.Buffer) {
+		s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+		for _, key := range []string{"my-team/my-component/my-component-1.zip", "my-team/my-component/my-component-2.zip", "my-team/other/other-1.zip"} {
+			s3Client.put("cdflow2-release-bucket-1", key, []byte("release"))
+		}
+		s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte(`{"version": 4, "resources": [{"mode": "managed", "instances": [{}]}]}`), start)
+		s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte(emptyState), start.Add(time.Hour))
+		s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/ci/terraform.tfstate", []byte(emptyState))
+		s3Client.put("cdflow2-tfstate-bucket-1", "my-team/other/live/terraform.tfstate", []byte(emptyState))
+		putDeploymentRecord(s3Client, "live", "1", start)
+		putDeploymentRecord(s3Client, "live", "2", start.Add(time.Hour))
+		s3Client.put("cdflow2-tfstate-bucket-1", "cdflow2-deployments/my-team/other/live/2026-10-01T09-00-00.000000000Z.json", []byte("{}"))
+		s3Client.put("cdflow2-tfstate-bucket-1", "cdflow2-freezes/my-team/1.json", []byte(
+			`{"id": "1", "team": "my-team", "component": "my-component", "envs": ["live"], "reason": "incident"}`,
+		))
+		s3Client.put("cdflow2-tfstate-bucket-1", "cdflow2-freezes/my-team/2.json", []byte(`{"id": "2", "team": "my-team", "envs": ["live"], "reason": "year-end"}`))
+		dynamoDBClient := newMemoryDynamoDB()
+		dynamoDBClient.put("cdflow2-tflocks", "cdflow2-tfstate-bucket-1/"+liveStateKey+"-md5", map[string]*dynamodb.AttributeValue{
+			"Digest": {S: aws.String("0123456789abcdef0123456789abcdef")},
+		})
+		ecrClient := &memoryECR{}
+		var outputBuffer, errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             s3Client,
+			DynamoDBClient:       dynamoDBClient,
+			ECRClient:            ecrClient,
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			InputStream:          strings.NewReader(input),
+			OutputStream:         &outputBuffer,
+			ErrorStream:          &errorBuffer,
+		}), s3Client, dynamoDBClient, ecrClient, &outputBuffer, &errorBuffer
+	}
+	request := func() *handler.DecommissionRequest {
+		return &handler.DecommissionRequest{CommandRequest: commandRequest()}
+	}
+
+	t.Run("confirmed", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, dynamoDBClient, ecrClient, outputBuffer, errorBuffer := setup(t, "yes\n")
+
+		// When
+		err := myHandler.Decommission(request())
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		for _, expected := range []string{
+			"ECR repository      123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component",
+			"release             s3://cdflow2-release-bucket-1/my-team/my-component/my-component-1.zip",
+			"terraform state     s3://cdflow2-tfstate-bucket-1/" + liveStateKey + " (live, 2 versions)",
+			"terraform state     s3://cdflow2-tfstate-bucket-1/my-team/my-component/ci/terraform.tfstate (ci, 1 versions)",
+			"lock table item     cdflow2-tflocks: cdflow2-tfstate-bucket-1/" + liveStateKey + "-md5 (live)",
+			"deployment records  s3://cdflow2-tfstate-bucket-1/cdflow2-deployments/my-team/my-component/ (2 versions)",
+			"freeze              s3://cdflow2-tfstate-bucket-1/cdflow2-freezes/my-team/1.json",
+		} {
+			if !strings.Contains(outputBuffer.String(), expected) {
+				t.Fatalf("expected %q in output: %s", expected, outputBuffer.String())
+			}
+		}
+		if !ecrClient.repositoryDeleted {
+			t.Fatal("expected ECR repository to be deleted")
+		}
+		if keys := s3Client.keys("cdflow2-release-bucket-1", ""); len(keys) != 1 || keys[0] != "my-team/other/other-1.zip" {
+			t.Fatalf("expected only the other component's release to remain, got %v", keys)
+		}
+		if keys := s3Client.keys("cdflow2-tfstate-bucket-1", ""); strings.Join(keys, ",") != "cdflow2-deployments/my-team/other/live/2026-10-01T09-00-00.000000000Z.json,cdflow2-freezes/my-team/2.json,my-team/other/live/terraform.tfstate" {
+			t.Fatalf("unexpected objects remaining in the tfstate bucket: %v", keys)
+		}
+		versions, _ := s3Client.ListObjectVersions(&s3.ListObjectVersionsInput{
+			Bucket: aws.String("cdflow2-tfstate-bucket-1"),
+			Prefix: aws.String("my-team/my-component/"),
+		})
+		if len(versions.Versions) != 0 || len(versions.DeleteMarkers) != 0 {
+			t.Fatalf("expected all versions of the state to be deleted, got %v", versions)
+		}
+		if len(dynamoDBClient.items) != 0 {
+			t.Fatalf("expected lock table items to be deleted, got %v", dynamoDBClient.items)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, _, ecrClient, _, errorBuffer := setup(t, "no\n")
+
+		// When
+		err := myHandler.Decommission(request())
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		if ecrClient.repositoryDeleted || len(s3Client.keys("cdflow2-release-bucket-1", "")) != 3 {
+			t.Fatal("expected nothing to be deleted")
+		}
+		if !strings.Contains(errorBuffer.String(), "Decommission cancelled.") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+	})
+
+	t.Run("state has resources", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, _, ecrClient, _, errorBuffer := setup(t, "yes\n")
+		s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/ci/terraform.tfstate", []byte(
+			`{"version": 4, "resources": [{"mode": "managed", "type": "aws_s3_bucket", "name": "a", "instances": [{}, {}]}]}`,
+		))
+
+		// When
+		err := myHandler.Decommission(request())
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		if !strings.Contains(errorBuffer.String(), "Refusing to decommission my-component:\n  - the terraform state for ci still has 2 resources - destroy the environment first (cdflow2 destroy ci)") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+		if ecrClient.repositoryDeleted || len(s3Client.keys("cdflow2-release-bucket-1", "")) != 3 {
+			t.Fatal("expected nothing to be deleted")
+		}
+	})
+
+	t.Run("other stack has resources", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, _, ecrClient, _, errorBuffer := setup(t, "yes\n")
+		s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/live/app.tfstate", []byte(emptyState))
+		s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/live/network.tfstate", []byte(
+			`{"version": 4, "resources": [{"mode": "managed", "type": "aws_vpc", "name": "a", "instances": [{}]}]}`,
+		))
+		decommissionRequest := request()
+		decommissionRequest.Config["backend"] = map[string]interface{}{"state_key": "{team}/{component}/{env}/{stack}.tfstate"}
+		decommissionRequest.Env["CDFLOW2_STACK"] = "app"
+
+		// When
+		err := myHandler.Decommission(decommissionRequest)
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		for _, expected := range []string{
+			"terraform state for live (stack app) has no resources",
+			"the terraform state for live (stack network) still has 1 resources - destroy the environment first (cdflow2 destroy live)",
+		} {
+			if !strings.Contains(errorBuffer.String(), expected) {
+				t.Fatalf("expected %q in output: %q", expected, errorBuffer.String())
+			}
+		}
+		if ecrClient.repositoryDeleted || len(s3Client.keys("cdflow2-release-bucket-1", "")) != 3 {
+			t.Fatal("expected nothing to be deleted")
+		}
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		// Given
+		myHandler, _, dynamoDBClient, ecrClient, _, errorBuffer := setup(t, "yes\n")
+		dynamoDBClient.put("cdflow2-tflocks", "cdflow2-tfstate-bucket-1/"+liveStateKey, map[string]*dynamodb.AttributeValue{
+			"Info": {S: aws.String(liveLockInfo)},
+		})
+
+		// When
+		err := myHandler.Decommission(request())
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		if !strings.Contains(errorBuffer.String(), "the terraform state for live is locked") || ecrClient.repositoryDeleted {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+	})
+}
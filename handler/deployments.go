@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// deploymentsPrefix is the prefix in the tfstate bucket under which a record of each deployment is kept.
+const deploymentsPrefix = "cdflow2-deployments"
+
+// deploymentKeyTimeFormat is fixed width so that deployment keys sort in the order they were made.
+const deploymentKeyTimeFormat = "2006-01-02T15-04-05.000000000Z"
+
+// deploymentRecord is written to the tfstate bucket each time a release is prepared for deployment.
+type deploymentRecord struct {
+	Team            string    `json:"team"`
+	Component       string    `json:"component"`
+	Env             string    `json:"env"`
+	Stack           string    `json:"stack,omitempty"`
+	Version         string    `json:"version"`
+	Account         string    `json:"account,omitempty"`
+	Caller          string    `json:"caller,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+	ReleaseChecksum string    `json:"release_checksum,omitempty"`
+	// StateVersionID is the version of the environment's terraform state object before the deployment, for restoring it.
+	StateVersionID string `json:"state_version_id,omitempty"`
+	// BreakGlass is the reason given for deploying during a freeze.
+	BreakGlass string `json:"break_glass,omitempty"`
+}
+
+func deploymentsComponentPrefix(team, component string) string {
+	return fmt.Sprintf("%s/%s/%s/", deploymentsPrefix, team, component)
+}
+
+func deploymentsEnvPrefix(team, component, env string) string {
+	return deploymentsComponentPrefix(team, component) + env + "/"
+}
+
+// deploymentsStackPrefix returns the prefix of the records for a stack of an environment - the records of components without
+// stacks are kept directly under the environment's prefix.
+func deploymentsStackPrefix(team, component, env, stack string) string {
+	if stack == "" {
+		return deploymentsEnvPrefix(team, component, env)
+	}
+	return deploymentsEnvPrefix(team, component, env) + stack + "/"
+}
+
+func deploymentKey(record *deploymentRecord) string {
+	return deploymentsStackPrefix(record.Team, record.Component, record.Env, record.Stack) + record.Timestamp.UTC().Format(deploymentKeyTimeFormat) + ".json"
+}
+
+func (h *Handler) recordDeployment(record *deploymentRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = h.getS3Client().PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(h.tfstateBucket),
+		Key:         aws.String(deploymentKey(record)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// listDeploymentKeys returns the keys of all deployment records for an environment and the stack being deployed, oldest first.
+func (h *Handler) listDeploymentKeys(team, component, env string) ([]string, error) {
+	return h.listStackDeploymentKeys(team, component, env, h.backendConfig.stack)
+}
+
+// listStackDeploymentKeys returns the keys of all deployment records for a stack of an environment, oldest first.
+func (h *Handler) listStackDeploymentKeys(team, component, env, stack string) ([]string, error) {
+	return listStackDeploymentKeysFrom(h.getS3Client(), h.tfstateBucket, team, component, env, stack)
+}
+
+// listStackDeploymentKeysFrom returns the keys of the deployment records for a stack of an environment in a bucket, oldest first.
+func listStackDeploymentKeysFrom(client s3iface.S3API, bucket, team, component, env, stack string) ([]string, error) {
+	var keys []string
+	if err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(deploymentsStackPrefix(team, component, env, stack)),
+		// the records of stacks are under prefixes of their own
+		Delimiter: aws.String("/"),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (h *Handler) getDeploymentRecord(key string) (*deploymentRecord, error) {
+	return getDeploymentRecordFrom(h.getS3Client(), h.tfstateBucket, key)
+}
+
+func getDeploymentRecordFrom(client s3iface.S3API, bucket, key string) (*deploymentRecord, error) {
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	var record deploymentRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid deployment record s3://%s/%s: %v", bucket, key, err)
+	}
+	return &record, nil
+}
+
+// listDeploymentHistory returns the deployments of distinct versions to an environment, most recent first - redeploys of the
+// version that was already deployed are skipped. At most limit versions are returned, or all of them if limit is zero.
+func (h *Handler) listDeploymentHistory(team, component, env string, limit int) ([]*deploymentRecord, error) {
+	records, err := h.listDeploymentRecords(team, component, env)
+	if err != nil {
+		return nil, err
+	}
+	return distinctVersions(records, limit), nil
+}
+
+// listDeploymentRecords returns all deployment records for an environment and the stack being deployed, oldest first.
+func (h *Handler) listDeploymentRecords(team, component, env string) ([]*deploymentRecord, error) {
+	return h.listDeploymentRecordsFrom(h.getS3Client(), h.tfstateBucket, team, component, env)
+}
+
+// listDeploymentRecordsFrom returns the deployment records for an environment and the stack being deployed in a bucket, oldest first.
+func (h *Handler) listDeploymentRecordsFrom(client s3iface.S3API, bucket, team, component, env string) ([]*deploymentRecord, error) {
+	keys, err := listStackDeploymentKeysFrom(client, bucket, team, component, env, h.backendConfig.stack)
+	if err != nil {
+		return nil, err
+	}
+	var result []*deploymentRecord
+	for _, key := range keys {
+		record, err := getDeploymentRecordFrom(client, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+// distinctVersions returns the records (oldest first) of distinct versions, most recent first, with redeploys of the same version
+// reported as when it was first deployed. At most limit versions are returned, or all of them if limit is zero.
+func distinctVersions(records []*deploymentRecord, limit int) []*deploymentRecord {
+	var result []*deploymentRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if len(result) > 0 && result[len(result)-1].Version == record.Version {
+			// an earlier deploy of the same version - report when it was first deployed
+			result[len(result)-1] = record
+			continue
+		}
+		if limit > 0 && len(result) == limit {
+			break
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+// listDeploymentEnvs returns the environments a component has been deployed to.
+func (h *Handler) listDeploymentEnvs(team, component string) ([]string, error) {
+	return h.listDeploymentPrefixes(deploymentsComponentPrefix(team, component))
+}
+
+// listDeploymentStacks returns the stacks of an environment with deployment records, with "" first if there are records without
+// a stack.
+func (h *Handler) listDeploymentStacks(team, component, env string) ([]string, error) {
+	stacks, err := h.listDeploymentPrefixes(deploymentsEnvPrefix(team, component, env))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := h.listStackDeploymentKeys(team, component, env, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		stacks = append([]string{""}, stacks...)
+	}
+	return stacks, nil
+}
+
+// listDeploymentPrefixes returns the names of the prefixes directly under a prefix of the deployment records.
+func (h *Handler) listDeploymentPrefixes(prefix string) ([]string, error) {
+	var result []string
+	if err := h.getS3Client().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(h.tfstateBucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range output.CommonPrefixes {
+			result = append(result, strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), prefix), "/"))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(result)
+	return result, nil
+}
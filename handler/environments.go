@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// environmentConfig is the config.params.environments.<env> section of cdflow.yaml, which overrides where the terraform state
+// for an environment is kept.
+type environmentConfig struct {
+	region        string
+	tfstateBucket string
+	tflocksTable  string
+	accountID     string
+	// deployAccountID is the account the AWS credentials for deploying the environment must be for, which replaces
+	// config.params.account_id for the environment.
+	deployAccountID string
+	// backendRoleARN overrides config.params.backend.role_arn for the environment, e.g. a role in the account holding its state.
+	backendRoleARN string
+	// secrets maps environment variables for terraform to the Secrets Manager secret they are fetched from when deploying.
+	secrets map[string]*secretReference
+}
+
+// hasBackendOverrides returns true if the environment's state is not kept in the default bucket and table.
+func (e *environmentConfig) hasBackendOverrides() bool {
+	return e.region != "" || e.tfstateBucket != "" || e.tflocksTable != ""
+}
+
+func getEnvironmentConfigs(config map[string]interface{}) (map[string]*environmentConfig, error) {
+	result := make(map[string]*environmentConfig)
+	raw, ok := config["environments"]
+	if !ok || raw == nil {
+		return result, nil
+	}
+	environments, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.environments must be a map of environment name to config")
+	}
+	for env, rawEnvConfig := range environments {
+		envConfig, err := parseEnvironmentConfig(env, rawEnvConfig)
+		if err != nil {
+			return nil, err
+		}
+		result[env] = envConfig
+	}
+	return result, nil
+}
+
+func parseEnvironmentConfig(env string, raw interface{}) (*environmentConfig, error) {
+	var result environmentConfig
+	if raw == nil {
+		return &result, nil
+	}
+	params, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.environments.%s must be a map", env)
+	}
+	for key, value := range params {
+		if key == "secrets" {
+			secrets, err := parseSecretReferences(env, value)
+			if err != nil {
+				return nil, err
+			}
+			result.secrets = secrets
+			continue
+		}
+		stringValue, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("config.params.environments.%s.%s must be a string", env, key)
+		}
+		switch key {
+		case "region":
+			result.region = stringValue
+		case "tfstate_bucket":
+			result.tfstateBucket = stringValue
+		case "tflocks_table":
+			result.tflocksTable = stringValue
+		case "account_id":
+			result.accountID = stringValue
+		case "deploy_account_id":
+			if !validAccountID.MatchString(stringValue) {
+				return nil, fmt.Errorf("config.params.environments.%s.deploy_account_id must be a 12 digit AWS account ID, got %q", env, stringValue)
+			}
+			result.deployAccountID = stringValue
+		case "backend_role_arn":
+			result.backendRoleARN = stringValue
+		default:
+			return nil, fmt.Errorf("config.params.environments.%s.%s is not a recognised option", env, key)
+		}
+	}
+	return &result, nil
+}
+
+// getEnvironmentConfig returns the config for a single environment, which is empty if there is none.
+func getEnvironmentConfig(config map[string]interface{}, env string) (*environmentConfig, error) {
+	envConfigs, err := getEnvironmentConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	if envConfig, ok := envConfigs[env]; ok {
+		return envConfig, nil
+	}
+	return &environmentConfig{}, nil
+}
+
+func sortedEnvNames(envConfigs map[string]*environmentConfig) []string {
+	var result []string
+	for env := range envConfigs {
+		result = append(result, env)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// stateBackend is where terraform state for an environment is kept.
+type stateBackend struct {
+	region             string
+	bucket             string
+	lockTable          string
+	accountID          string
+	roleARN            string
+	workspaceKeyPrefix string
+	key                string
+}
+
+// stateKey returns the key of the environment's state within the bucket.
+func (b *stateBackend) stateKey(env string) string {
+	return stateS3Key(b.workspaceKeyPrefix, env, b.key)
+}
+
+// getStateBackend returns the backend for an environment, applying any overrides from config.params.environments.<env> to the
+// default bucket and table found by CheckAWSResources.
+func (h *Handler) getStateBackend(config map[string]interface{}, team, component, env string) (*stateBackend, error) {
+	envConfig, err := getEnvironmentConfig(config, env)
+	if err != nil {
+		return nil, err
+	}
+	if envConfig.region != "" && envConfig.region != h.defaultRegion && envConfig.tfstateBucket == "" {
+		return nil, fmt.Errorf("config.params.environments.%s.tfstate_bucket must be set when the region differs from config.params.default_region", env)
+	}
+	workspaceKeyPrefix, key := h.backendConfig.renderStateKey(team, component)
+	result := stateBackend{
+		region:             h.defaultRegion,
+		bucket:             h.tfstateBucket,
+		lockTable:          h.tflocksTable,
+		accountID:          envConfig.accountID,
+		roleARN:            h.backendConfig.roleARN,
+		workspaceKeyPrefix: workspaceKeyPrefix,
+		key:                key,
+	}
+	if envConfig.region != "" {
+		result.region = envConfig.region
+	}
+	if envConfig.backendRoleARN != "" {
+		result.roleARN = envConfig.backendRoleARN
+	}
+	if envConfig.tfstateBucket != "" {
+		result.bucket = envConfig.tfstateBucket
+	}
+	if envConfig.tflocksTable != "" {
+		result.lockTable = envConfig.tflocksTable
+	} else if result.region != h.defaultRegion {
+		result.lockTable = tflocksTableName
+	}
+	if !h.backendConfig.usesDynamoDBLocking() {
+		result.lockTable = ""
+	}
+	return &result, nil
+}
+
+func (h *Handler) printStateBackend(env string, backend *stateBackend) {
+	details := []string{backend.region}
+	if backend.lockTable != "" {
+		details = append(details, "locked with dynamodb table "+backend.lockTable)
+	}
+	if h.backendConfig.usesS3Locking() {
+		details = append(details, "locked with a lock file in S3")
+	}
+	if backend.accountID != "" {
+		details = append(details, "account "+backend.accountID)
+	}
+	if backend.roleARN != "" {
+		details = append(details, "accessed with role "+backend.roleARN)
+	}
+	fmt.Fprintf(h.ErrorStream, "- %s terraform state: s3://%s/%s (%s)\n", env, backend.bucket, backend.stateKey(env), strings.Join(details, ", "))
+}
+
+// regionalAWSConfig returns the config for clients in a region, which assume the role if roleARN is set (e.g. the backend role for
+// the environment's state).
+func (h *Handler) regionalAWSConfig(region, roleARN string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if roleARN == "" {
+		return config
+	}
+	creds := stscreds.NewCredentials(h.awsSession, roleARN, func(provider *stscreds.AssumeRoleProvider) {
+		if h.backendConfig.roleSessionName != "" {
+			provider.RoleSessionName = h.backendConfig.roleSessionName
+		}
+		if h.backendConfig.roleExternalID != "" {
+			provider.ExternalID = aws.String(h.backendConfig.roleExternalID)
+		}
+	})
+	return config.WithCredentials(creds)
+}
+
+// getStateS3Client returns an S3 client for accessing the environment's state, assuming the backend role if there is one.
+func (h *Handler) getStateS3Client(backend *stateBackend) s3iface.S3API {
+	return h.getS3ClientFor(backend.region, backend.roleARN)
+}
+
+// getStateDynamoDBClient returns a DynamoDB client for accessing the environment's lock table, assuming the backend role if there
+// is one.
+func (h *Handler) getStateDynamoDBClient(backend *stateBackend) dynamodbiface.DynamoDBAPI {
+	return h.getDynamoDBClientFor(backend.region, backend.roleARN)
+}
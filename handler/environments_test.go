@@ -0,0 +1,92 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestPrepareTerraformEnvironmentBackend(t *testing.T) {
+	environments := map[string]interface{}{
+		"live": map[string]interface{}{
+			"region":         "eu-west-2",
+			"tfstate_bucket": "my-live-tfstate",
+			"tflocks_table":  "my-live-tflocks",
+		},
+		"prod": map[string]interface{}{
+			"region": "us-east-1",
+		},
+	}
+	newHandler := func(errorBuffer *bytes.Buffer) *handler.Handler {
+		return handler.New(&handler.Opts{
+			S3Client:              newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+			DynamoDBClient:        &mockedDynamoDB{},
+			SecretsManagerClient:  mockedSecretsManager{},
+			STSClient:             mockedSTS{account: "123456789012"},
+			IAMClient:             mockedIAM{},
+			S3ClientFactory:       s3ClientFactory(t, map[string]s3iface.S3API{" eu-west-2": newMemoryS3("my-live-tfstate")}),
+			DynamoDBClientFactory: dynamoDBClientFactory(t, map[string]dynamodbiface.DynamoDBAPI{" eu-west-2": newMemoryDynamoDB()}),
+			OutputStream:          &bytes.Buffer{},
+			ErrorStream:           errorBuffer,
+		})
+	}
+
+	for _, test := range []struct {
+		env    string
+		region string
+		bucket string
+		table  string
+	}{
+		{"ci", "eu-west-1", "cdflow2-tfstate-bucket-1", "cdflow2-tflocks"},
+		{"live", "eu-west-2", "my-live-tfstate", "my-live-tflocks"},
+	} {
+		t.Run(test.env, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			request := prepareTerraformRequest(test.env, "")
+			request.Config["environments"] = environments
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := newHandler(&errorBuffer).PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil || !response.Success {
+				t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+			}
+			if response.TerraformBackendConfig["region"] != test.region ||
+				response.TerraformBackendConfig["bucket"] != test.bucket ||
+				response.TerraformBackendConfig["dynamodb_table"] != test.table {
+				t.Fatalf("unexpected backend config: %v", response.TerraformBackendConfig)
+			}
+		})
+	}
+
+	t.Run("region without bucket", func(t *testing.T) {
+		// Given
+		var errorBuffer bytes.Buffer
+		request := prepareTerraformRequest("prod", "")
+		request.Config["environments"] = environments
+		response := common.CreatePrepareTerraformResponse()
+
+		// When
+		err := newHandler(&errorBuffer).PrepareTerraform(request, response, tempDir(t))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if response.Success {
+			t.Fatal("unexpected success")
+		}
+		if !strings.Contains(errorBuffer.String(), "config.params.environments.prod.tfstate_bucket must be set") {
+			t.Fatal("expected explanation, got:", errorBuffer.String())
+		}
+	})
+}
@@ -0,0 +1,481 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// freezesPrefix is where ad-hoc freezes are kept in the tfstate bucket - one object per freeze, so that freezes added and lifted at
+// the same time don't overwrite each other.
+const freezesPrefix = "cdflow2-freezes/"
+
+const freezeTimeFormat = "2006-01-02 15:04 MST"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// freezeWindow is an entry in config.params.freeze - either a date range, or a window that recurs weekly on the given days.
+type freezeWindow struct {
+	name string
+	// envs are the environments frozen, or all environments if empty.
+	envs     []string
+	location *time.Location
+	// from and to are the start and end of a date range.
+	from, to time.Time
+	// days, dailyFrom and dailyTo are the days and time of day a weekly window starts and ends - a window that ends at or before
+	// it starts ends on the following day.
+	days               map[time.Weekday]bool
+	dailyFrom, dailyTo time.Duration
+}
+
+func appliesToEnv(envs []string, env string) bool {
+	if len(envs) == 0 {
+		return true
+	}
+	for _, item := range envs {
+		if item == env {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAt returns whether the window is active at t, and if so when it ends.
+func (w *freezeWindow) activeAt(t time.Time) (bool, time.Time) {
+	if w.days == nil {
+		return !t.Before(w.from) && t.Before(w.to), w.to
+	}
+	length := w.dailyTo - w.dailyFrom
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	local := t.In(w.location)
+	for _, daysAgo := range []int{0, 1} {
+		day := local.AddDate(0, 0, -daysAgo)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, w.location).Add(w.dailyFrom)
+		end := start.Add(length)
+		if !t.Before(start) && t.Before(end) {
+			return true, end
+		}
+	}
+	return false, time.Time{}
+}
+
+func parseFreezeTime(value interface{}, location *time.Location, endOfDay bool) (time.Time, error) {
+	if t, ok := value.(time.Time); ok {
+		return t, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("expected a date or time, got %v", value)
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date (2006-01-02) or time (2006-01-02 15:04), got %q", s)
+	}
+	if endOfDay {
+		// the end date of a range is included
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseTimeOfDay(value interface{}) (time.Duration, error) {
+	s, _ := value.(string)
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected a time of day (15:04), got %v", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseStringList(value interface{}) ([]string, bool) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	var result []string
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, s)
+	}
+	return result, true
+}
+
+func parseFreezeWindow(index int, raw interface{}) (*freezeWindow, error) {
+	params, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.freeze[%d] must be a map", index)
+	}
+	result := freezeWindow{name: fmt.Sprintf("freeze %d", index+1), location: time.UTC}
+	if name, ok := params["name"].(string); ok && name != "" {
+		result.name = name
+	}
+	if timezone, ok := params["timezone"]; ok {
+		name, _ := timezone.(string)
+		location, err := time.LoadLocation(name)
+		if err != nil || name == "" {
+			return nil, fmt.Errorf("config.params.freeze[%d].timezone: unknown time zone %v", index, timezone)
+		}
+		result.location = location
+	}
+	for key, value := range params {
+		switch key {
+		case "name", "timezone", "from", "to":
+		case "envs":
+			envs, ok := parseStringList(value)
+			if !ok {
+				return nil, fmt.Errorf("config.params.freeze[%d].envs must be a list of environment names", index)
+			}
+			result.envs = envs
+		case "days":
+			days, ok := parseStringList(value)
+			if !ok || len(days) == 0 {
+				return nil, fmt.Errorf("config.params.freeze[%d].days must be a list of days (mon, tue, ...)", index)
+			}
+			result.days = make(map[time.Weekday]bool)
+			for _, day := range days {
+				weekday, ok := weekdays[strings.ToLower(day)]
+				if !ok {
+					return nil, fmt.Errorf("config.params.freeze[%d].days: unknown day %q, expected mon, tue, wed, thu, fri, sat or sun", index, day)
+				}
+				result.days[weekday] = true
+			}
+		default:
+			return nil, fmt.Errorf("config.params.freeze[%d].%s is not a recognised option", index, key)
+		}
+	}
+	if params["from"] == nil || params["to"] == nil {
+		return nil, fmt.Errorf("config.params.freeze[%d] must have from and to", index)
+	}
+	var err error
+	if result.days != nil {
+		if result.dailyFrom, err = parseTimeOfDay(params["from"]); err != nil {
+			return nil, fmt.Errorf("config.params.freeze[%d].from: %v", index, err)
+		}
+		if result.dailyTo, err = parseTimeOfDay(params["to"]); err != nil {
+			return nil, fmt.Errorf("config.params.freeze[%d].to: %v", index, err)
+		}
+		return &result, nil
+	}
+	if result.from, err = parseFreezeTime(params["from"], result.location, false); err != nil {
+		return nil, fmt.Errorf("config.params.freeze[%d].from: %v", index, err)
+	}
+	if result.to, err = parseFreezeTime(params["to"], result.location, true); err != nil {
+		return nil, fmt.Errorf("config.params.freeze[%d].to: %v", index, err)
+	}
+	if !result.to.After(result.from) {
+		return nil, fmt.Errorf("config.params.freeze[%d] must end after it starts", index)
+	}
+	return &result, nil
+}
+
+func getFreezeWindows(config map[string]interface{}) ([]*freezeWindow, error) {
+	raw, ok := config["freeze"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.freeze must be a list of freeze windows")
+	}
+	var result []*freezeWindow
+	for i, item := range items {
+		window, err := parseFreezeWindow(i, item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, window)
+	}
+	return result, nil
+}
+
+// adhocFreeze is a freeze added with the freeze command, e.g. during an incident.
+type adhocFreeze struct {
+	ID        string    `json:"id"`
+	Team      string    `json:"team"`
+	Component string    `json:"component,omitempty"`
+	Envs      []string  `json:"envs"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Created   time.Time `json:"created"`
+	// Until is when the freeze ends, or nil if it lasts until it is lifted.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func (f *adhocFreeze) appliesTo(team, component, env string) bool {
+	return f.Team == team && (f.Component == "" || f.Component == component) && appliesToEnv(f.Envs, env)
+}
+
+func (f *adhocFreeze) expired(t time.Time) bool {
+	return f.Until != nil && !t.Before(*f.Until)
+}
+
+func freezesTeamPrefix(team string) string {
+	return freezesPrefix + team + "/"
+}
+
+func freezeKey(team, id string) string {
+	return freezesTeamPrefix(team) + id + ".json"
+}
+
+// getAdhocFreezes returns the team's ad-hoc freezes, including any that have expired.
+func (h *Handler) getAdhocFreezes(team string) ([]*adhocFreeze, error) {
+	keys, err := listKeys(h.getS3Client(), h.tfstateBucket, freezesTeamPrefix(team))
+	if err != nil {
+		return nil, err
+	}
+	var result []*adhocFreeze
+	for _, key := range keys {
+		output, err := h.getS3Client().GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(h.tfstateBucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if isNotFound(err) {
+				// lifted since it was listed
+				continue
+			}
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var freeze adhocFreeze
+		if err := json.Unmarshal(data, &freeze); err != nil {
+			return nil, fmt.Errorf("invalid freeze in s3://%s/%s: %v", h.tfstateBucket, key, err)
+		}
+		result = append(result, &freeze)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result, nil
+}
+
+func (h *Handler) putAdhocFreeze(freeze *adhocFreeze) error {
+	data, err := json.MarshalIndent(freeze, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = h.getS3Client().PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(h.tfstateBucket),
+		Key:         aws.String(freezeKey(freeze.Team, freeze.ID)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (h *Handler) deleteAdhocFreeze(freeze *adhocFreeze) error {
+	_, err := h.getS3Client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(h.tfstateBucket),
+		Key:    aws.String(freezeKey(freeze.Team, freeze.ID)),
+	})
+	return err
+}
+
+// activeFreeze is a freeze that currently applies to an environment.
+type activeFreeze struct {
+	reason string
+	// until is when the freeze ends, or zero if it lasts until it is lifted.
+	until time.Time
+}
+
+func (f *activeFreeze) String() string {
+	if f.until.IsZero() {
+		return f.reason + " (until lifted)"
+	}
+	return fmt.Sprintf("%s (until %s)", f.reason, f.until.UTC().Format(freezeTimeFormat))
+}
+
+// getActiveFreezes returns the freezes from config and the freeze command that apply to an environment now.
+func (h *Handler) getActiveFreezes(config map[string]interface{}, team, component, env string) ([]*activeFreeze, error) {
+	windows, err := getFreezeWindows(config)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var result []*activeFreeze
+	for _, window := range windows {
+		if !appliesToEnv(window.envs, env) {
+			continue
+		}
+		if active, until := window.activeAt(now); active {
+			result = append(result, &activeFreeze{reason: window.name, until: until})
+		}
+	}
+	freezes, err := h.getAdhocFreezes(team)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get freezes from s3://%s/%s: %v", h.tfstateBucket, freezesTeamPrefix(team), err)
+	}
+	for _, freeze := range freezes {
+		if !freeze.appliesTo(team, component, env) || freeze.expired(now) {
+			continue
+		}
+		active := activeFreeze{reason: fmt.Sprintf("%s, frozen by %s", freeze.Reason, freeze.CreatedBy)}
+		if freeze.Until != nil {
+			active.until = *freeze.Until
+		}
+		result = append(result, &active)
+	}
+	return result, nil
+}
+
+// checkFreezes returns an error if deployments to the environment are frozen, unless CDFLOW2_BREAK_GLASS is set to the reason for
+// deploying anyway, which is returned so it can be recorded.
+func (h *Handler) checkFreezes(config map[string]interface{}, team, component, env string, inputEnv map[string]string) (string, error) {
+	freezes, err := h.getActiveFreezes(config, team, component, env)
+	if err != nil {
+		return "", err
+	}
+	if len(freezes) == 0 {
+		return "", nil
+	}
+	for _, freeze := range freezes {
+		fmt.Fprintf(h.ErrorStream, "  %s deployments to %s are frozen: %s\n", h.styles.cross, env, freeze)
+	}
+	if breakGlass := inputEnv["CDFLOW2_BREAK_GLASS"]; breakGlass != "" {
+		fmt.Fprintf(h.ErrorStream, "  %s CDFLOW2_BREAK_GLASS set, deploying anyway: %s\n", h.styles.warningCross, breakGlass)
+		return breakGlass, nil
+	}
+	return "", fmt.Errorf(
+		"\nDeployments to %s are frozen. To deploy anyway in an emergency, set CDFLOW2_BREAK_GLASS to the reason, which is recorded with the deployment.", env,
+	)
+}
+
+// FreezeRequest is the input to the freeze command.
+type FreezeRequest struct {
+	CommandRequest
+	// Envs are the environments to freeze.
+	Envs   []string
+	Reason string
+	// Duration is how long the freeze lasts, or until it is lifted if zero.
+	Duration time.Duration
+	// AllComponents freezes all of the team's components rather than just the one in the request.
+	AllComponents bool
+	// List lists the freezes rather than adding one.
+	List bool
+	// Lift is the ID of a freeze to remove.
+	Lift string
+}
+
+// Freeze adds, lists or lifts ad-hoc deployment freezes.
+func (h *Handler) Freeze(request *FreezeRequest) error {
+	var team string
+	var err error
+	if request.AllComponents {
+		team, err = h.prepareTeamCommand(&request.CommandRequest)
+	} else {
+		team, err = h.prepareCommand(&request.CommandRequest)
+	}
+	if err != nil {
+		return err
+	}
+	freezes, err := h.getAdhocFreezes(team)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to get freezes: %v\n", err)
+		return Exit(false)
+	}
+	now := time.Now()
+	var current []*adhocFreeze
+	for _, freeze := range freezes {
+		if !freeze.expired(now) {
+			current = append(current, freeze)
+		} else if !request.List {
+			// expired freezes are tidied up when freezes are changed
+			if err := h.deleteAdhocFreeze(freeze); err != nil {
+				fmt.Fprintf(h.ErrorStream, "Unable to delete expired freeze %s: %v\n", freeze.ID, err)
+				return Exit(false)
+			}
+		}
+	}
+
+	if request.List {
+		writer := tabwriter.NewWriter(h.OutputStream, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tCOMPONENT\tENVIRONMENTS\tUNTIL\tBY\tREASON")
+		for _, freeze := range current {
+			component, until := freeze.Component, "lifted"
+			if component == "" {
+				component = "(all)"
+			}
+			if freeze.Until != nil {
+				until = freeze.Until.UTC().Format(freezeTimeFormat)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", freeze.ID, component, strings.Join(freeze.Envs, ","), until, freeze.CreatedBy, freeze.Reason)
+		}
+		return writer.Flush()
+	}
+
+	if request.Lift != "" {
+		for _, freeze := range current {
+			if freeze.ID != request.Lift {
+				continue
+			}
+			if err := h.deleteAdhocFreeze(freeze); err != nil {
+				fmt.Fprintf(h.ErrorStream, "Unable to lift freeze: %v\n", err)
+				return Exit(false)
+			}
+			fmt.Fprintf(h.ErrorStream, "%s Lifted freeze %s.\n", h.styles.tick, request.Lift)
+			return nil
+		}
+		fmt.Fprintf(h.ErrorStream, "No freeze %s found for %s.\n", request.Lift, team)
+		return Exit(false)
+	}
+
+	if len(request.Envs) == 0 || request.Reason == "" {
+		fmt.Fprintln(h.ErrorStream, "env and reason must be specified to add a freeze")
+		return Exit(false)
+	}
+	freeze := adhocFreeze{
+		ID:        randHexPostfix()[:8],
+		Team:      team,
+		Component: request.Component,
+		Envs:      request.Envs,
+		Reason:    request.Reason,
+		CreatedBy: aws.StringValue(h.getCallerIdentity().Arn),
+		Created:   now.UTC(),
+	}
+	if request.AllComponents {
+		freeze.Component = ""
+	}
+	if request.Duration > 0 {
+		until := now.Add(request.Duration).UTC()
+		freeze.Until = &until
+	}
+	if err := h.putAdhocFreeze(&freeze); err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to save freezes: %v\n", err)
+		return Exit(false)
+	}
+	liftFlags := "-component " + request.Component
+	if request.AllComponents {
+		liftFlags = "-all-components"
+	}
+	fmt.Fprintf(h.ErrorStream, "%s Froze %s (freeze %s) - lift it with: freeze %s -lift %s\n", h.styles.tick, strings.Join(request.Envs, ", "), freeze.ID, liftFlags, freeze.ID)
+	return nil
+}
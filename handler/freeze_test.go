@@ -0,0 +1,271 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func allDays() []interface{} {
+	return []interface{}{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+}
+
+func TestPrepareTerraformFreezeWindows(t *testing.T) {
+	now := time.Now().UTC()
+	var otherDays []interface{}
+	for _, day := range allDays() {
+		if !strings.EqualFold(day.(string), now.Weekday().String()[:3]) {
+			otherDays = append(otherDays, day)
+		}
+	}
+	for _, test := range []struct {
+		name     string
+		window   map[string]interface{}
+		success  bool
+		expected string
+	}{
+		{
+			"date range",
+			map[string]interface{}{
+				"name": "year-end",
+				"from": now.AddDate(0, 0, -1).Format("2006-01-02"),
+				"to":   now.AddDate(0, 0, 1).Format("2006-01-02"),
+			},
+			false,
+			"deployments to live are frozen: year-end (until " + now.AddDate(0, 0, 2).Format("2006-01-02") + " 00:00 UTC)",
+		},
+		{
+			"date range ending today",
+			map[string]interface{}{"name": "year-end", "from": now.AddDate(0, 0, -3).Format("2006-01-02"), "to": now.Format("2006-01-02")},
+			false,
+			"deployments to live are frozen: year-end",
+		},
+		{
+			"past date range",
+			map[string]interface{}{"name": "year-end", "from": "2020-12-20", "to": "2021-01-04"},
+			true,
+			"",
+		},
+		{
+			"weekly",
+			map[string]interface{}{"name": "always", "days": allDays(), "from": "00:00", "to": "00:00", "timezone": "Europe/London"},
+			false,
+			"deployments to live are frozen: always (until ",
+		},
+		{
+			"weekly around now",
+			map[string]interface{}{
+				"name": "now",
+				"days": allDays(),
+				"from": now.Add(-time.Hour).Format("15:04"),
+				"to":   now.Add(time.Hour).Format("15:04"),
+			},
+			false,
+			"deployments to live are frozen: now (until " + now.Add(time.Hour).Format("2006-01-02 15:04") + " UTC)",
+		},
+		{
+			"weekly on other days",
+			map[string]interface{}{"name": "other days", "days": otherDays, "from": "00:00", "to": "12:00"},
+			true,
+			"",
+		},
+		{
+			"other environment",
+			map[string]interface{}{"name": "always", "envs": []interface{}{"prod"}, "days": allDays(), "from": "00:00", "to": "00:00"},
+			true,
+			"",
+		},
+		{
+			"invalid day",
+			map[string]interface{}{"days": []interface{}{"someday"}, "from": "00:00", "to": "00:00"},
+			false,
+			`config.params.freeze[0].days: unknown day "someday"`,
+		},
+		{
+			"invalid time zone",
+			map[string]interface{}{"days": allDays(), "from": "00:00", "to": "00:00", "timezone": "Europe/Nowhere"},
+			false,
+			"config.params.freeze[0].timezone: unknown time zone Europe/Nowhere",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			myHandler := testHandler(handler.Opts{ErrorStream: &errorBuffer})
+			request := prepareTerraformRequest("live", "")
+			request.Config["freeze"] = []interface{}{test.window}
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Success != test.success || !strings.Contains(errorBuffer.String(), test.expected) {
+				t.Fatalf("expected success %v with %q, got %v with output: %q", test.success, test.expected, response.Success, errorBuffer.String())
+			}
+			if !test.success && strings.Contains(test.expected, "frozen") && !strings.Contains(errorBuffer.String(), "set CDFLOW2_BREAK_GLASS") {
+				t.Fatalf("expected break glass instructions, got: %q", errorBuffer.String())
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformBreakGlass(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	putRelease(t, store, "2")
+	var errorBuffer bytes.Buffer
+	myHandler := testHandler(handler.Opts{S3Client: s3Client, ReleaseStore: store, ErrorStream: &errorBuffer})
+	request := prepareTerraformRequest("live", "2")
+	request.Config["freeze"] = []interface{}{
+		map[string]interface{}{"name": "always", "days": allDays(), "from": "00:00", "to": "00:00"},
+	}
+	request.Env["CDFLOW2_BREAK_GLASS"] = "INC-1234 hotfix"
+	response := common.CreatePrepareTerraformResponse()
+
+	// When
+	err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+	}
+	if !strings.Contains(errorBuffer.String(), "CDFLOW2_BREAK_GLASS set, deploying anyway: INC-1234 hotfix") {
+		t.Fatalf("expected break glass warning, got: %q", errorBuffer.String())
+	}
+	keys := s3Client.keys("cdflow2-tfstate-bucket-1", "cdflow2-deployments/my-team/my-component/live/")
+	if len(keys) != 1 {
+		t.Fatalf("expected one deployment record, got %v", keys)
+	}
+	record, _ := s3Client.get("cdflow2-tfstate-bucket-1", keys[0])
+	if !strings.Contains(string(record), `"break_glass": "INC-1234 hotfix"`) {
+		t.Fatalf("expected break glass in deployment record, got: %s", record)
+	}
+}
+
+func TestFreezeCommand(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	prepare := func(env, component string) (bool, string) {
+		var errorBuffer bytes.Buffer
+		request := prepareTerraformRequest(env, "")
+		request.Component = component
+		response := common.CreatePrepareTerraformResponse()
+		if err := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer}).PrepareTerraform(request, response, tempDir(t)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return response.Success, errorBuffer.String()
+	}
+	freeze := func(request *handler.FreezeRequest) (string, string) {
+		var outputBuffer, errorBuffer bytes.Buffer
+		request.CommandRequest = commandRequest()
+		if err := testHandler(handler.Opts{S3Client: s3Client, OutputStream: &outputBuffer, ErrorStream: &errorBuffer}).Freeze(request); err != nil {
+			t.Fatal("freeze failed:", err, errorBuffer.String())
+		}
+		return outputBuffer.String(), errorBuffer.String()
+	}
+
+	// When
+	_, output := freeze(&handler.FreezeRequest{Envs: []string{"live"}, Reason: "INC-1234 database failover", Duration: 4 * time.Hour})
+
+	// Then
+	if !strings.Contains(output, "Froze live (freeze ") {
+		t.Fatalf("unexpected output: %q", output)
+	}
+	success, output := prepare("live", "my-component")
+	if success || !strings.Contains(output, "deployments to live are frozen: INC-1234 database failover, frozen by arn:aws:sts::123456789012:assumed-role/deploy/session (until ") {
+		t.Fatalf("expected live to be frozen, got %v with output: %q", success, output)
+	}
+	if success, output := prepare("ci", "my-component"); !success {
+		t.Fatal("expected ci not to be frozen:", output)
+	}
+	if success, output := prepare("live", "other-component"); !success {
+		t.Fatal("expected other component not to be frozen:", output)
+	}
+
+	list, _ := freeze(&handler.FreezeRequest{List: true})
+	lines := strings.Split(strings.TrimSpace(list), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one freeze to be listed, got: %q", list)
+	}
+	fields := strings.Fields(lines[1])
+	if fields[1] != "my-component" || fields[2] != "live" || !strings.Contains(lines[1], "INC-1234 database failover") {
+		t.Fatalf("unexpected freeze listed: %q", lines[1])
+	}
+
+	_, output = freeze(&handler.FreezeRequest{Lift: fields[0]})
+	if !strings.Contains(output, "Lifted freeze "+fields[0]) {
+		t.Fatalf("unexpected output: %q", output)
+	}
+	if success, output := prepare("live", "my-component"); !success {
+		t.Fatal("expected live not to be frozen after lifting:", output)
+	}
+}
+
+func TestFreezeAllComponents(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	var errorBuffer bytes.Buffer
+	request := &handler.FreezeRequest{CommandRequest: commandRequest(), Envs: []string{"live", "prod"}, Reason: "year-end", AllComponents: true}
+	if err := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer}).Freeze(request); err != nil {
+		t.Fatal("freeze failed:", err, errorBuffer.String())
+	}
+	prepareRequest := prepareTerraformRequest("prod", "")
+	prepareRequest.Component = "other-component"
+	response := common.CreatePrepareTerraformResponse()
+	errorBuffer.Reset()
+
+	// When
+	err := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer}).PrepareTerraform(prepareRequest, response, tempDir(t))
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if response.Success || !strings.Contains(errorBuffer.String(), "deployments to prod are frozen: year-end, frozen by arn:aws:sts::123456789012:assumed-role/deploy/session (until lifted)") {
+		t.Fatalf("expected prod to be frozen, got %v with output: %q", response.Success, errorBuffer.String())
+	}
+}
+
+func TestFreezeKeepsOtherFreezes(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	var errorBuffer bytes.Buffer
+	for _, reason := range []string{"incident", "year-end"} {
+		request := &handler.FreezeRequest{CommandRequest: commandRequest(), Envs: []string{"live"}, Reason: reason}
+		if err := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer}).Freeze(request); err != nil {
+			t.Fatal("freeze failed:", err, errorBuffer.String())
+		}
+	}
+	keys := s3Client.keys("cdflow2-tfstate-bucket-1", "cdflow2-freezes/my-team/")
+	if len(keys) != 2 {
+		t.Fatalf("expected an object per freeze, got %v", keys)
+	}
+	data, _ := s3Client.get("cdflow2-tfstate-bucket-1", keys[0])
+	var lifted struct{ ID string }
+	if err := json.Unmarshal(data, &lifted); err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	myHandler := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer})
+	err := myHandler.Freeze(&handler.FreezeRequest{CommandRequest: commandRequest(), Lift: lifted.ID})
+
+	// Then
+	if err != nil {
+		t.Fatal("lift failed:", err, errorBuffer.String())
+	}
+	if remaining := s3Client.keys("cdflow2-tfstate-bucket-1", "cdflow2-freezes/"); len(remaining) != 1 || remaining[0] != keys[1] {
+		t.Fatalf("expected only the other freeze to remain, got %v", remaining)
+	}
+}
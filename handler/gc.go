@@ -0,0 +1,394 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/mergermarket/cdflow2-config-simple-aws/internal/ui"
+)
+
+// ecrBatchDeleteLimit is the maximum number of images that can be deleted in one BatchDeleteImage call.
+const ecrBatchDeleteLimit = 100
+
+// GCRequest is the input to the gc command.
+type GCRequest struct {
+	CommandRequest
+	// Keep is the number of most recent releases that are always kept.
+	Keep int
+	// Days keeps releases deployed to any environment within this many days.
+	Days int
+	// DryRun reports what would be deleted without deleting anything.
+	DryRun bool
+	// Report is a path to write a JSON report of each release and what was done with it.
+	Report string
+	// Yes deletes without asking for confirmation.
+	Yes bool
+}
+
+// gcRelease is a release considered for deletion, as written to the report.
+type gcRelease struct {
+	Version  string    `json:"version"`
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Uploaded time.Time `json:"uploaded"`
+	Delete   bool      `json:"delete"`
+	// Reason is why the release is kept.
+	Reason string `json:"reason,omitempty"`
+	// Images are the tags of the release's ECR images.
+	Images  []string `json:"images,omitempty"`
+	Deleted bool     `json:"deleted"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type gcReport struct {
+	Team      string       `json:"team"`
+	Component string       `json:"component"`
+	Time      time.Time    `json:"time"`
+	DryRun    bool         `json:"dry_run"`
+	Keep      int          `json:"keep"`
+	Days      int          `json:"days"`
+	Releases  []*gcRelease `json:"releases"`
+}
+
+// listReleases returns the releases of a component, most recent first.
+func (h *Handler) listReleases(team, component string) ([]*gcRelease, error) {
+	prefix := strings.TrimSuffix(releaseS3Key(team, component, ""), ".zip")
+	objects, err := h.releaseStore.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []*gcRelease
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".zip") {
+			continue
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(object.Key, prefix), ".zip")
+		if releaseS3Key(team, component, version) != object.Key || strings.Contains(version, "/") {
+			continue
+		}
+		result = append(result, &gcRelease{Version: version, Key: object.Key, Size: object.Size, Uploaded: object.LastModified})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Uploaded.After(result[j].Uploaded)
+	})
+	return result, nil
+}
+
+// getRetainedVersions returns the versions that are currently deployed to an environment (or a stack of one) or were deployed since
+// cutoff, with the reason they are kept. The version currently deployed is the last one applied, as for config.params.promotion - a
+// later deployment that was only planned, or failed before writing state, may never have run.
+func (h *Handler) getRetainedVersions(config map[string]interface{}, team, component string, cutoff time.Time) (map[string]string, error) {
+	envs, err := h.listDeploymentEnvs(team, component)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for _, env := range envs {
+		stacks, err := h.listDeploymentStacks(team, component, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, stack := range stacks {
+			name := (&componentState{env: env, stack: stack}).name()
+			keys, err := h.listStackDeploymentKeys(team, component, env, stack)
+			if err != nil {
+				return nil, err
+			}
+			var records []*deploymentRecord
+			for _, key := range keys {
+				record, err := h.getDeploymentRecord(key)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, record)
+			}
+			backend, err := h.getStateBackend(config, team, component, env)
+			if err != nil {
+				return nil, err
+			}
+			backend.workspaceKeyPrefix, backend.key = h.backendConfig.renderStackStateKey(team, component, stack)
+			stateVersions, err := h.listStateVersions(backend, env)
+			if err != nil {
+				return nil, err
+			}
+			if applied := appliedDeployments(records, stateVersions); len(applied) > 0 {
+				result[applied[len(applied)-1].Version] = "currently deployed to " + name
+			}
+			for i := len(records) - 1; i >= 0; i-- {
+				record := records[i]
+				if record.Timestamp.Before(cutoff) {
+					break
+				}
+				if _, ok := result[record.Version]; !ok {
+					result[record.Version] = fmt.Sprintf("deployed to %s at %s", name, record.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"))
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// findUnrecordedStates returns the terraform state of environments (and stacks) without deployment records - e.g. deployed before
+// deployments were recorded - for which the version deployed is unknown.
+func (h *Handler) findUnrecordedStates(config map[string]interface{}, team, component string) ([]*componentState, error) {
+	states, err := h.listComponentStates(config, team, component)
+	if err != nil {
+		return nil, err
+	}
+	var result []*componentState
+	for _, state := range states {
+		keys, err := h.listStackDeploymentKeys(team, component, state.env, state.stack)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			result = append(result, state)
+		}
+	}
+	return result, nil
+}
+
+// listImageTags returns the tags of the images in a component's ECR repository, or nil if it has no repository.
+func (h *Handler) listImageTags(component string) ([]string, error) {
+	repoURI, err := h.getECRRepository(component)
+	if err != nil || repoURI == "" {
+		return nil, err
+	}
+	var result []string
+	if err := h.getECRClient().ListImagesPages(&ecr.ListImagesInput{
+		RepositoryName: aws.String(component),
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+	}, func(output *ecr.ListImagesOutput, lastPage bool) bool {
+		for _, image := range output.ImageIds {
+			if image.ImageTag != nil {
+				result = append(result, *image.ImageTag)
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// releaseImageTags returns the tags of the ECR images built for a release, which are tagged <build id>-<version>. The build IDs
+// are taken from the release metadata, or for releases without metadata any tag ending -<version> is matched, unless it also
+// ends with the version of a release that is kept (e.g. version 3 and a kept version 1-3).
+func (h *Handler) releaseImageTags(release *gcRelease, tags []string, kept []string) []string {
+	var buildIDs []string
+	if object, err := h.releaseStore.Head(release.Key); err == nil {
+		buildIDs = releaseMetadataFromMap(object.Metadata).buildIDs()
+	}
+	var result []string
+	for _, tag := range tags {
+		if len(buildIDs) == 0 {
+			if strings.HasSuffix(tag, "-"+release.Version) && !hasVersionSuffix(tag, kept) {
+				result = append(result, tag)
+			}
+			continue
+		}
+		for _, buildID := range buildIDs {
+			if tag == buildID+"-"+release.Version {
+				result = append(result, tag)
+			}
+		}
+	}
+	return result
+}
+
+func hasVersionSuffix(tag string, versions []string) bool {
+	for _, version := range versions {
+		if strings.HasSuffix(tag, "-"+version) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) deleteImages(component string, tags []string) error {
+	for start := 0; start < len(tags); start += ecrBatchDeleteLimit {
+		end := start + ecrBatchDeleteLimit
+		if end > len(tags) {
+			end = len(tags)
+		}
+		var imageIDs []*ecr.ImageIdentifier
+		for _, tag := range tags[start:end] {
+			imageIDs = append(imageIDs, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+		}
+		output, err := h.getECRClient().BatchDeleteImage(&ecr.BatchDeleteImageInput{
+			RepositoryName: aws.String(component),
+			ImageIds:       imageIDs,
+		})
+		if err != nil {
+			return err
+		}
+		for _, failure := range output.Failures {
+			if aws.StringValue(failure.FailureCode) != ecr.ImageFailureCodeImageNotFound {
+				return fmt.Errorf("unable to delete image %s: %s", aws.StringValue(failure.ImageId.ImageTag), aws.StringValue(failure.FailureReason))
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) printGCReleases(releases []*gcRelease) error {
+	writer := tabwriter.NewWriter(h.OutputStream, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tUPLOADED\tSIZE\tIMAGES\tACTION\tREASON")
+	for _, release := range releases {
+		action := "keep"
+		if release.Delete {
+			action = "delete"
+		}
+		fmt.Fprintf(
+			writer, "%s\t%s\t%d\t%d\t%s\t%s\n", release.Version, release.Uploaded.UTC().Format("2006-01-02 15:04:05 MST"),
+			release.Size, len(release.Images), action, release.Reason,
+		)
+	}
+	return writer.Flush()
+}
+
+func (h *Handler) writeGCReport(path string, report *gcReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(h.ErrorStream, "- Report written to %s\n", path)
+	return nil
+}
+
+// GC deletes a component's old releases and their ECR images, keeping the most recent releases and any deployed recently.
+func (h *Handler) GC(request *GCRequest) error {
+	if request.Keep < 1 || request.Days < 0 {
+		fmt.Fprintln(h.ErrorStream, "keep must be at least 1 and days must not be negative")
+		return Exit(false)
+	}
+	team, err := h.prepareCommand(&request.CommandRequest)
+	if err != nil {
+		return err
+	}
+
+	releases, err := h.listReleases(team, request.Component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to list releases: %v\n", err)
+		return Exit(false)
+	}
+	unrecorded, err := h.findUnrecordedStates(request.Config, team, request.Component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to check terraform state: %v\n", err)
+		return Exit(false)
+	}
+	if len(unrecorded) > 0 {
+		for _, state := range unrecorded {
+			fmt.Fprintf(
+				h.ErrorStream, "  %s %s has terraform state (s3://%s/%s) but no deployment records\n", h.styles.cross, state.name(),
+				state.backend.bucket, state.backend.stateKey(state.env),
+			)
+		}
+		fmt.Fprintln(h.ErrorStream, "\nRefusing to garbage collect while the version deployed to an environment is unknown - deploy it again to record it.")
+		return Exit(false)
+	}
+	now := time.Now()
+	retained, err := h.getRetainedVersions(request.Config, team, request.Component, now.AddDate(0, 0, -request.Days))
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to get deployments: %v\n", err)
+		return Exit(false)
+	}
+	var toDelete []*gcRelease
+	var kept []string
+	for i, release := range releases {
+		if reason, ok := retained[release.Version]; ok {
+			release.Reason = reason
+		} else if i < request.Keep {
+			release.Reason = fmt.Sprintf("one of the %d most recent releases", request.Keep)
+		}
+		if release.Reason != "" {
+			kept = append(kept, release.Version)
+		} else {
+			release.Delete = true
+			toDelete = append(toDelete, release)
+		}
+	}
+	if len(toDelete) > 0 {
+		tags, err := h.listImageTags(request.Component)
+		if err != nil {
+			fmt.Fprintf(h.ErrorStream, "Unable to list ECR images: %v\n", err)
+			return Exit(false)
+		}
+		for _, release := range toDelete {
+			release.Images = h.releaseImageTags(release, tags, kept)
+		}
+	}
+	if err := h.printGCReleases(releases); err != nil {
+		return err
+	}
+
+	report := &gcReport{
+		Team: team, Component: request.Component, Time: now.UTC(), DryRun: request.DryRun, Keep: request.Keep, Days: request.Days,
+		Releases: releases,
+	}
+	var size int64
+	var images int
+	for _, release := range toDelete {
+		size += release.Size
+		images += len(release.Images)
+	}
+	summary := fmt.Sprintf("%d of %d releases (%d bytes) and %d ECR images", len(toDelete), len(releases), size, images)
+	if request.DryRun || len(toDelete) == 0 {
+		if request.Report != "" {
+			if err := h.writeGCReport(request.Report, report); err != nil {
+				fmt.Fprintf(h.ErrorStream, "Unable to write report: %v\n", err)
+				return Exit(false)
+			}
+		}
+		if len(toDelete) == 0 {
+			fmt.Fprintln(h.ErrorStream, "No releases to delete.")
+		} else {
+			fmt.Fprintf(h.ErrorStream, "Dry run, %s would be deleted.\n", summary)
+		}
+		return nil
+	}
+
+	if !request.Yes && !ui.Confirm(fmt.Sprintf(
+		"Delete %s? Only 'yes' will be accepted to confirm: ", summary,
+	), h.InputStream, h.ErrorStream) {
+		fmt.Fprintln(h.ErrorStream, "Garbage collection cancelled.")
+		return Exit(false)
+	}
+	failed := false
+	for _, release := range toDelete {
+		// images are deleted first so that a release is only gone once its images are, and a failure is retried by the next run
+		err := h.deleteImages(request.Component, release.Images)
+		if err == nil {
+			err = h.releaseStore.Delete(release.Key)
+		}
+		if err != nil {
+			failed = true
+			release.Error = err.Error()
+			fmt.Fprintf(h.ErrorStream, "  %s unable to delete version %s: %v\n", h.styles.cross, release.Version, err)
+			continue
+		}
+		release.Deleted = true
+		fmt.Fprintf(h.ErrorStream, "  %s deleted version %s (%d ECR images)\n", h.styles.tick, release.Version, len(release.Images))
+	}
+	if request.Report != "" {
+		if err := h.writeGCReport(request.Report, report); err != nil {
+			fmt.Fprintf(h.ErrorStream, "Unable to write report: %v\n", err)
+			return Exit(false)
+		}
+	}
+	if failed {
+		return Exit(false)
+	}
+	fmt.Fprintf(h.ErrorStream, "%s Deleted %s.\n", h.styles.tick, summary)
+	return nil
+}
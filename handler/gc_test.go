@@ -0,0 +1,354 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+)
+
+// memoryECR is a repository of tagged images.
+type memoryECR struct {
+	mockedECR
+	tags              []string
+	deleted           []string
+	repositoryDeleted bool
+}
+
+func (m *memoryECR) ListImagesPages(input *ecr.ListImagesInput, fn func(*ecr.ListImagesOutput, bool) bool) error {
+	output := &ecr.ListImagesOutput{}
+	for _, tag := range m.tags {
+		output.ImageIds = append(output.ImageIds, &ecr.ImageIdentifier{ImageTag: aws.String(tag), ImageDigest: aws.String("sha256:" + tag)})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m *memoryECR) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+	for _, image := range input.ImageIds {
+		m.deleted = append(m.deleted, aws.StringValue(image.ImageTag))
+	}
+	return &ecr.BatchDeleteImageOutput{}, nil
+}
+
+func (m *memoryECR) DeleteRepository(input *ecr.DeleteRepositoryInput) (*ecr.DeleteRepositoryOutput, error) {
+	m.repositoryDeleted = true
+	return &ecr.DeleteRepositoryOutput{}, nil
+}
+
+func TestGC(t *testing.T) {
+	now := time.Now()
+	days := func(n int) time.Time {
+		return now.AddDate(0, 0, -n)
+	}
+	setup := func(t *testing.T, input string) (*handler.Handler, handler.ReleaseStore, *memoryECR, *bytes.Buffer, *bytes.Buffer) {
+		s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+		putAppliedDeployment(s3Client, "live", "1", days(90))
+		putAppliedDeployment(s3Client, "live", "2", days(60))
+		putAppliedDeployment(s3Client, "ci", "3", days(40))
+		putAppliedDeployment(s3Client, "ci", "4", days(5))
+		putAppliedDeployment(s3Client, "ci", "5", days(1))
+		dir := tempDir(t)
+		store := handler.NewFilesystemReleaseStore(dir)
+		for i, version := range []string{"1", "2", "3", "4", "5", "6"} {
+			metadata := map[string]string{"version": version, "build-ids": "docker"}
+			if version == "1" {
+				// released before build metadata was recorded
+				metadata = nil
+			}
+			key := "my-team/my-component/my-component-" + version + ".zip"
+			if err := store.Put(key, strings.NewReader("release "+version), metadata); err != nil {
+				t.Fatal(err)
+			}
+			uploaded := days(100 - i)
+			if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), uploaded, uploaded); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ecrClient := &memoryECR{tags: []string{"docker-1", "other-1", "docker-2", "docker-3", "other-3", "docker-4", "docker-5", "docker-6"}}
+		var outputBuffer, errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             s3Client,
+			DynamoDBClient:       &mockedDynamoDB{},
+			ECRClient:            ecrClient,
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			ReleaseStore:         store,
+			InputStream:          strings.NewReader(input),
+			OutputStream:         &outputBuffer,
+			ErrorStream:          &errorBuffer,
+		}), store, ecrClient, &outputBuffer, &errorBuffer
+	}
+	remaining := func(store handler.ReleaseStore) []string {
+		objects, err := store.List("my-team/my-component/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, object := range objects {
+			result = append(result, strings.TrimSuffix(strings.TrimPrefix(object.Key, "my-team/my-component/my-component-"), ".zip"))
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		// Given
+		myHandler, store, ecrClient, outputBuffer, errorBuffer := setup(t, "")
+		reportPath := filepath.Join(tempDir(t), "report.json")
+
+		// When
+		err := myHandler.GC(&handler.GCRequest{CommandRequest: commandRequest(), Keep: 1, Days: 30, DryRun: true, Report: reportPath})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if versions := remaining(store); len(versions) != 6 || len(ecrClient.deleted) != 0 {
+			t.Fatalf("expected nothing to be deleted, got releases %v and deleted images %v", versions, ecrClient.deleted)
+		}
+		if !strings.Contains(errorBuffer.String(), "Dry run, 2 of 6 releases (18 bytes) and 3 ECR images would be deleted.") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+		actions := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(outputBuffer.String()), "\n")[1:] {
+			fields := strings.Fields(line)
+			actions[fields[0]] = strings.Join(fields[6:], " ")
+		}
+		for version, expected := range map[string]string{
+			"6": "keep one of the 1 most recent releases",
+			"5": "keep currently deployed to ci",
+			"4": "keep deployed to ci at ",
+			"3": "delete",
+			"2": "keep currently deployed to live",
+			"1": "delete",
+		} {
+			if !strings.HasPrefix(actions[version], expected) {
+				t.Fatalf("expected version %s to be %q, got %q in output: %s", version, expected, actions[version], outputBuffer.String())
+			}
+		}
+		data, err := ioutil.ReadFile(reportPath)
+		if err != nil {
+			t.Fatal("expected report to be written:", err)
+		}
+		var report struct {
+			DryRun   bool `json:"dry_run"`
+			Releases []struct {
+				Version string   `json:"version"`
+				Delete  bool     `json:"delete"`
+				Images  []string `json:"images"`
+				Deleted bool     `json:"deleted"`
+			} `json:"releases"`
+		}
+		if err := json.Unmarshal(data, &report); err != nil {
+			t.Fatal("invalid report:", err)
+		}
+		if !report.DryRun || len(report.Releases) != 6 || report.Releases[5].Version != "1" || !report.Releases[5].Delete || report.Releases[5].Deleted {
+			t.Fatalf("unexpected report: %s", data)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		// Given
+		myHandler, store, ecrClient, _, errorBuffer := setup(t, "")
+
+		// When
+		err := myHandler.GC(&handler.GCRequest{CommandRequest: commandRequest(), Keep: 1, Days: 30, Yes: true})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if versions := remaining(store); !reflect.DeepEqual(versions, []string{"2", "4", "5", "6"}) {
+			t.Fatalf("unexpected releases remaining: %v", versions)
+		}
+		sort.Strings(ecrClient.deleted)
+		if !reflect.DeepEqual(ecrClient.deleted, []string{"docker-1", "docker-3", "other-1"}) {
+			t.Fatalf("unexpected images deleted: %v", ecrClient.deleted)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		// Given
+		myHandler, store, ecrClient, _, errorBuffer := setup(t, "no\n")
+
+		// When
+		err := myHandler.GC(&handler.GCRequest{CommandRequest: commandRequest(), Keep: 1, Days: 30})
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		if versions := remaining(store); len(versions) != 6 || len(ecrClient.deleted) != 0 {
+			t.Fatalf("expected nothing to be deleted, got releases %v and deleted images %v", versions, ecrClient.deleted)
+		}
+		if !strings.Contains(errorBuffer.String(), "Garbage collection cancelled.") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+	})
+
+	t.Run("longer retention", func(t *testing.T) {
+		// Given
+		myHandler, store, _, _, errorBuffer := setup(t, "")
+
+		// When
+		err := myHandler.GC(&handler.GCRequest{CommandRequest: commandRequest(), Keep: 1, Days: 45, Yes: true})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if versions := remaining(store); !reflect.DeepEqual(versions, []string{"2", "3", "4", "5", "6"}) {
+			t.Fatalf("unexpected releases remaining: %v", versions)
+		}
+	})
+}
+
+func TestGCUnrecordedState(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	putDeploymentRecord(s3Client, "ci", "2", time.Now())
+	// live was deployed before deployments were recorded
+	s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/live/terraform.tfstate", []byte(`{"resources": []}`))
+	s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/ci/terraform.tfstate", []byte(`{"resources": []}`))
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	for _, version := range []string{"1", "2", "3"} {
+		if err := store.Put("my-team/my-component/my-component-"+version+".zip", strings.NewReader("release "+version), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             s3Client,
+		DynamoDBClient:       &mockedDynamoDB{},
+		ECRClient:            &memoryECR{},
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		IAMClient:            mockedIAM{},
+		ReleaseStore:         store,
+		OutputStream:         &bytes.Buffer{},
+		ErrorStream:          &errorBuffer,
+	})
+
+	// When
+	err := myHandler.GC(&handler.GCRequest{CommandRequest: commandRequest(), Keep: 1, Days: 0, Yes: true})
+
+	// Then
+	if err != handler.Exit(false) {
+		t.Fatal("expected failure, got:", err)
+	}
+	if !strings.Contains(errorBuffer.String(), "live has terraform state (s3://cdflow2-tfstate-bucket-1/my-team/my-component/live/terraform.tfstate) but no deployment records") {
+		t.Fatalf("unexpected output: %s", errorBuffer.String())
+	}
+	if strings.Contains(errorBuffer.String(), "ci has terraform state") {
+		t.Fatalf("unexpected ci in output: %s", errorBuffer.String())
+	}
+	if objects, _ := store.List("my-team/my-component/"); len(objects) != 3 {
+		t.Fatalf("expected nothing to be deleted, got %d releases", len(objects))
+	}
+}
+
+func TestGCUnappliedDeployment(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	now := time.Now()
+	putAppliedDeployment(s3Client, "live", "1", now.AddDate(0, 0, -60))
+	// planned but never applied, so version 1 is still running
+	putDeploymentRecord(s3Client, "live", "2", now.AddDate(0, 0, -40))
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	for _, version := range []string{"1", "2", "3"} {
+		if err := store.Put("my-team/my-component/my-component-"+version+".zip", strings.NewReader("release "+version), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var outputBuffer, errorBuffer bytes.Buffer
+	myHandler := testHandler(handler.Opts{
+		S3Client:     s3Client,
+		ECRClient:    &memoryECR{},
+		ReleaseStore: store,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &errorBuffer,
+	})
+
+	// When
+	err := myHandler.GC(&handler.GCRequest{CommandRequest: commandRequest(), Keep: 1, Days: 30, Yes: true})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err, errorBuffer.String())
+	}
+	if !strings.Contains(outputBuffer.String(), "currently deployed to live") {
+		t.Fatalf("expected version 1 to be kept as currently deployed, got: %s", outputBuffer.String())
+	}
+	var remaining []string
+	objects, err := store.List("my-team/my-component/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		remaining = append(remaining, object.Key)
+	}
+	sort.Strings(remaining)
+	if !reflect.DeepEqual(remaining, []string{"my-team/my-component/my-component-1.zip", "my-team/my-component/my-component-3.zip"}) {
+		t.Fatalf("unexpected releases remaining: %v", remaining)
+	}
+}
+
+func TestGCStacks(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	now := time.Now()
+	for stack, version := range map[string]string{"network": "1", "app": "2"} {
+		s3Client.put(
+			"cdflow2-tfstate-bucket-1",
+			"cdflow2-deployments/my-team/my-component/live/"+stack+"/"+now.UTC().Format("2006-01-02T15-04-05.000000000Z")+".json",
+			[]byte(`{"team": "my-team", "component": "my-component", "env": "live", "stack": "`+stack+`", "version": "`+version+`", "timestamp": "`+now.UTC().Format(time.RFC3339)+`"}`),
+		)
+		s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/live/"+stack+".tfstate", []byte(`{"resources": []}`))
+	}
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	for _, version := range []string{"1", "2", "3", "4"} {
+		if err := store.Put("my-team/my-component/my-component-"+version+".zip", strings.NewReader("release "+version), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var outputBuffer, errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             s3Client,
+		DynamoDBClient:       &mockedDynamoDB{},
+		ECRClient:            &memoryECR{},
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		IAMClient:            mockedIAM{},
+		ReleaseStore:         store,
+		OutputStream:         &outputBuffer,
+		ErrorStream:          &errorBuffer,
+	})
+	request := commandRequest()
+	request.Config["backend"] = map[string]interface{}{"state_key": "{team}/{component}/{env}/{stack}.tfstate"}
+	request.Env["CDFLOW2_STACK"] = "app"
+
+	// When
+	err := myHandler.GC(&handler.GCRequest{CommandRequest: request, Keep: 1, Days: 0, DryRun: true})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err, errorBuffer.String())
+	}
+	for _, expected := range []string{"currently deployed to live (stack network)", "currently deployed to live (stack app)"} {
+		if !strings.Contains(outputBuffer.String(), expected) {
+			t.Fatalf("expected %q in output: %s", expected, outputBuffer.String())
+		}
+	}
+}
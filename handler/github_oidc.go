@@ -0,0 +1,268 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+const githubOIDCHost = "token.actions.githubusercontent.com"
+
+// githubOIDCAudience is the audience of the tokens requested by aws-actions/configure-aws-credentials.
+const githubOIDCAudience = "sts.amazonaws.com"
+
+// githubOIDCThumbprints are the thumbprints of GitHub's OIDC certificates - IAM no longer uses them for GitHub, but they are
+// required to create the provider.
+var githubOIDCThumbprints = []string{"6938fd4d98bab03faadb97b34396831e3780aea1", "1c58a3a8518e8759bf075b76b750d4f2df264fcd"}
+
+// githubRolePolicyName is the name of the inline policy on the role for GitHub Actions.
+const githubRolePolicyName = "cdflow2-release-deploy"
+
+// githubOIDCConfig is config.params.github_oidc - the repositories and branches whose GitHub Actions workflows can assume a role
+// to release and deploy the component.
+type githubOIDCConfig struct {
+	org          string
+	repositories []string
+	branches     []string
+	roleName     string
+}
+
+func getStringList(config map[string]interface{}, key, name string) ([]string, error) {
+	raw, ok := config[key]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	if value, ok := raw.(string); ok && value != "" {
+		return []string{value}, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+	}
+	var result []string
+	for _, item := range list {
+		value, ok := item.(string)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// getGitHubOIDCConfig returns config.params.github_oidc, or nil if it is not set. The repositories default to the component's name,
+// the branches to main and the role name to cdflow2-github-<component>.
+func getGitHubOIDCConfig(config map[string]interface{}, component string) (*githubOIDCConfig, error) {
+	raw, ok := config["github_oidc"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	params, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.github_oidc must be a map")
+	}
+	result := githubOIDCConfig{
+		repositories: []string{component},
+		branches:     []string{"main"},
+		roleName:     "cdflow2-github-" + component,
+	}
+	for key := range params {
+		switch key {
+		case "org", "repositories", "branches", "role_name":
+		default:
+			return nil, fmt.Errorf("unknown key config.params.github_oidc.%s, expected org, repositories, branches or role_name", key)
+		}
+	}
+	result.org, _ = params["org"].(string)
+	if result.org == "" || strings.ContainsAny(result.org, "/:*") {
+		return nil, fmt.Errorf("config.params.github_oidc.org must be the name of a GitHub organisation")
+	}
+	repositories, err := getStringList(params, "repositories", "config.params.github_oidc.repositories")
+	if err != nil {
+		return nil, err
+	}
+	if repositories != nil {
+		result.repositories = repositories
+	}
+	for _, repository := range result.repositories {
+		if strings.ContainsAny(repository, "/:") {
+			return nil, fmt.Errorf("config.params.github_oidc.repositories must be repository names within the org, got %q", repository)
+		}
+	}
+	branches, err := getStringList(params, "branches", "config.params.github_oidc.branches")
+	if err != nil {
+		return nil, err
+	}
+	if branches != nil {
+		result.branches = branches
+	}
+	if roleName, ok := params["role_name"]; ok {
+		if result.roleName, ok = roleName.(string); !ok || result.roleName == "" {
+			return nil, fmt.Errorf("config.params.github_oidc.role_name must be a string")
+		}
+	}
+	return &result, nil
+}
+
+// subjects returns the subject claims of the tokens for workflows running on the branches of the repositories - branches can be
+// patterns, e.g. release/*.
+func (c *githubOIDCConfig) subjects() []string {
+	var result []string
+	for _, repository := range c.repositories {
+		for _, branch := range c.branches {
+			result = append(result, fmt.Sprintf("repo:%s/%s:ref:refs/heads/%s", c.org, repository, branch))
+		}
+	}
+	return result
+}
+
+func githubOIDCProviderARN(accountID string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", accountID, githubOIDCHost)
+}
+
+// trustPolicy returns the policy allowing GitHub Actions workflows with the config's subjects to assume the role.
+func (c *githubOIDCConfig) trustPolicy(accountID string) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []interface{}{
+			map[string]interface{}{
+				"Effect":    "Allow",
+				"Principal": map[string]interface{}{"Federated": githubOIDCProviderARN(accountID)},
+				"Action":    "sts:AssumeRoleWithWebIdentity",
+				"Condition": map[string]interface{}{
+					"StringEquals": map[string]interface{}{githubOIDCHost + ":aud": githubOIDCAudience},
+					"StringLike":   map[string]interface{}{githubOIDCHost + ":sub": c.subjects()},
+				},
+			},
+		},
+	})
+	return string(data), err
+}
+
+func isNoSuchEntity(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == iam.ErrCodeNoSuchEntityException
+}
+
+// checkOrCreateGitHubOIDCProvider creates the account's GitHub OIDC identity provider if it doesn't exist, or checks that it
+// accepts tokens for AWS.
+func (h *Handler) checkOrCreateGitHubOIDCProvider(accountID string) error {
+	providerARN := githubOIDCProviderARN(accountID)
+	output, err := h.getIAMClient().GetOpenIDConnectProvider(&iam.GetOpenIDConnectProviderInput{
+		OpenIDConnectProviderArn: aws.String(providerARN),
+	})
+	if err == nil {
+		for _, clientID := range output.ClientIDList {
+			if aws.StringValue(clientID) == githubOIDCAudience {
+				fmt.Fprintf(h.ErrorStream, "  %s GitHub OIDC provider found: %s\n", h.styles.tick, providerARN)
+				return nil
+			}
+		}
+		fmt.Fprintf(
+			h.ErrorStream, "  %s GitHub OIDC provider %s does not have %s as an audience (client ID)\n\nUnable to resolve automatically.\n\n",
+			h.styles.cross, providerARN, githubOIDCAudience,
+		)
+		return Exit(false)
+	}
+	if !isNoSuchEntity(err) {
+		return err
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s GitHub OIDC provider not found: %s\n", h.styles.cross, providerARN)
+	if _, err := h.getIAMClient().CreateOpenIDConnectProvider(&iam.CreateOpenIDConnectProviderInput{
+		Url:            aws.String("https://" + githubOIDCHost),
+		ClientIDList:   aws.StringSlice([]string{githubOIDCAudience}),
+		ThumbprintList: aws.StringSlice(githubOIDCThumbprints),
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(h.ErrorStream, "\n  %s created GitHub OIDC provider: %s\n", h.styles.tick, providerARN)
+	return nil
+}
+
+// githubRolePolicy returns the release and deploy policies (as output by the iam-policy command) combined into one.
+func (h *Handler) githubRolePolicy(config map[string]interface{}, team, component string) (string, error) {
+	scope, err := h.getIAMPolicyScope(config, team, component)
+	if err != nil {
+		return "", err
+	}
+	combined := iamPolicyDocument{Version: "2012-10-17"}
+	seen := make(map[string]bool)
+	for _, phase := range []string{"release", "deploy"} {
+		for _, statement := range scope.iamPolicyDocument(phase).Statement {
+			if !seen[statement.Sid] {
+				seen[statement.Sid] = true
+				combined.Statement = append(combined.Statement, statement)
+			}
+		}
+	}
+	data, err := json.Marshal(&combined)
+	return string(data), err
+}
+
+// checkOrCreateGitHubRole creates or updates the role for GitHub Actions workflows, with a trust policy for the configured
+// repositories and branches and the release and deploy policy.
+func (h *Handler) checkOrCreateGitHubRole(config map[string]interface{}, team, component string, oidcConfig *githubOIDCConfig) error {
+	accountID := h.getAccountID()
+	trustPolicy, err := oidcConfig.trustPolicy(accountID)
+	if err != nil {
+		return err
+	}
+	policy, err := h.githubRolePolicy(config, team, component)
+	if err != nil {
+		return err
+	}
+	iamClient := h.getIAMClient()
+	var roleARN string
+	output, err := iamClient.GetRole(&iam.GetRoleInput{RoleName: aws.String(oidcConfig.roleName)})
+	if err == nil {
+		roleARN = aws.StringValue(output.Role.Arn)
+		if _, err := iamClient.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+			RoleName:       aws.String(oidcConfig.roleName),
+			PolicyDocument: aws.String(trustPolicy),
+		}); err != nil {
+			return err
+		}
+		fmt.Fprintf(h.ErrorStream, "  %s GitHub Actions role found: %s\n", h.styles.tick, oidcConfig.roleName)
+	} else if isNoSuchEntity(err) {
+		created, err := iamClient.CreateRole(&iam.CreateRoleInput{
+			RoleName:                 aws.String(oidcConfig.roleName),
+			AssumeRolePolicyDocument: aws.String(trustPolicy),
+			Description:              aws.String(fmt.Sprintf("Release and deploy %s from GitHub Actions with cdflow2", component)),
+		})
+		if err != nil {
+			return err
+		}
+		roleARN = aws.StringValue(created.Role.Arn)
+		fmt.Fprintf(h.ErrorStream, "  %s created GitHub Actions role: %s\n", h.styles.tick, oidcConfig.roleName)
+	} else {
+		return err
+	}
+	if _, err := iamClient.PutRolePolicy(&iam.PutRolePolicyInput{
+		RoleName:       aws.String(oidcConfig.roleName),
+		PolicyName:     aws.String(githubRolePolicyName),
+		PolicyDocument: aws.String(policy),
+	}); err != nil {
+		return err
+	}
+	for _, subject := range oidcConfig.subjects() {
+		fmt.Fprintf(h.ErrorStream, "    - trusts %s\n", subject)
+	}
+	fmt.Fprintf(h.ErrorStream, "\nTo release and deploy from GitHub Actions, use this role with aws-actions/configure-aws-credentials:\n\n")
+	fmt.Fprintf(h.ErrorStream, "  permissions:\n    id-token: write\n  ...\n  - uses: aws-actions/configure-aws-credentials@v4\n")
+	fmt.Fprintf(h.ErrorStream, "    with:\n      role-to-assume: %s\n      aws-region: %s\n", roleARN, h.defaultRegion)
+	return nil
+}
+
+// checkOrCreateGitHubOIDC sets up GitHub Actions workflows to release and deploy the component, as configured in
+// config.params.github_oidc.
+func (h *Handler) checkOrCreateGitHubOIDC(config map[string]interface{}, team, component string, oidcConfig *githubOIDCConfig) error {
+	fmt.Fprintf(h.ErrorStream, "\n%s\n\n", h.styles.au.Underline("Checking GitHub Actions access..."))
+	if err := h.checkOrCreateGitHubOIDCProvider(h.getAccountID()); err != nil {
+		return err
+	}
+	return h.checkOrCreateGitHubRole(config, team, component, oidcConfig)
+}
@@ -0,0 +1,207 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// memoryIAM keeps OIDC providers and roles in memory.
+type memoryIAM struct {
+	mockedIAM
+	// providers are the client IDs of each provider by ARN.
+	providers map[string][]string
+	// trustPolicies and policies are the trust policies and inline policies of each role by name.
+	trustPolicies map[string]string
+	policies      map[string]map[string]string
+}
+
+func newMemoryIAM() *memoryIAM {
+	return &memoryIAM{providers: map[string][]string{}, trustPolicies: map[string]string{}, policies: map[string]map[string]string{}}
+}
+
+func (m *memoryIAM) GetOpenIDConnectProvider(input *iam.GetOpenIDConnectProviderInput) (*iam.GetOpenIDConnectProviderOutput, error) {
+	clientIDs, ok := m.providers[*input.OpenIDConnectProviderArn]
+	if !ok {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil)
+	}
+	return &iam.GetOpenIDConnectProviderOutput{ClientIDList: aws.StringSlice(clientIDs)}, nil
+}
+
+func (m *memoryIAM) CreateOpenIDConnectProvider(input *iam.CreateOpenIDConnectProviderInput) (*iam.CreateOpenIDConnectProviderOutput, error) {
+	arn := "arn:aws:iam::123456789012:oidc-provider/" + strings.TrimPrefix(*input.Url, "https://")
+	m.providers[arn] = aws.StringValueSlice(input.ClientIDList)
+	return &iam.CreateOpenIDConnectProviderOutput{OpenIDConnectProviderArn: aws.String(arn)}, nil
+}
+
+func (m *memoryIAM) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	if _, ok := m.trustPolicies[*input.RoleName]; !ok {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil)
+	}
+	return &iam.GetRoleOutput{Role: &iam.Role{
+		RoleName: input.RoleName,
+		Arn:      aws.String("arn:aws:iam::123456789012:role/" + *input.RoleName),
+	}}, nil
+}
+
+func (m *memoryIAM) CreateRole(input *iam.CreateRoleInput) (*iam.CreateRoleOutput, error) {
+	m.trustPolicies[*input.RoleName] = *input.AssumeRolePolicyDocument
+	return &iam.CreateRoleOutput{Role: &iam.Role{
+		RoleName: input.RoleName,
+		Arn:      aws.String("arn:aws:iam::123456789012:role/" + *input.RoleName),
+	}}, nil
+}
+
+func (m *memoryIAM) UpdateAssumeRolePolicy(input *iam.UpdateAssumeRolePolicyInput) (*iam.UpdateAssumeRolePolicyOutput, error) {
+	m.trustPolicies[*input.RoleName] = *input.PolicyDocument
+	return &iam.UpdateAssumeRolePolicyOutput{}, nil
+}
+
+func (m *memoryIAM) PutRolePolicy(input *iam.PutRolePolicyInput) (*iam.PutRolePolicyOutput, error) {
+	if m.policies[*input.RoleName] == nil {
+		m.policies[*input.RoleName] = map[string]string{}
+	}
+	m.policies[*input.RoleName][*input.PolicyName] = *input.PolicyDocument
+	return &iam.PutRolePolicyOutput{}, nil
+}
+
+func githubOIDCSetupRequest() *common.SetupRequest {
+	request := setupRequest()
+	request.Config["github_oidc"] = map[string]interface{}{
+		"org":          "my-org",
+		"repositories": []interface{}{"my-component", "my-component-infra"},
+		"branches":     []interface{}{"main", "release/*"},
+	}
+	return request
+}
+
+func TestSetupGitHubOIDC(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		// Given
+		iamClient := newMemoryIAM()
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{IAMClient: iamClient, ErrorStream: &errorBuffer})
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(githubOIDCSetupRequest(), response)
+
+		// Then
+		if err != nil || !response.Success {
+			t.Fatal("unexpected failure:", err, errorBuffer.String())
+		}
+		providerARN := "arn:aws:iam::123456789012:oidc-provider/token.actions.githubusercontent.com"
+		if clientIDs := iamClient.providers[providerARN]; len(clientIDs) != 1 || clientIDs[0] != "sts.amazonaws.com" {
+			t.Fatalf("expected provider to be created, got %v", iamClient.providers)
+		}
+		var trustPolicy struct {
+			Statement []struct {
+				Principal struct{ Federated string }
+				Condition map[string]map[string]interface{}
+			}
+		}
+		if err := json.Unmarshal([]byte(iamClient.trustPolicies["cdflow2-github-my-component"]), &trustPolicy); err != nil {
+			t.Fatal("invalid trust policy:", err, iamClient.trustPolicies)
+		}
+		if trustPolicy.Statement[0].Principal.Federated != providerARN {
+			t.Fatalf("unexpected principal: %+v", trustPolicy)
+		}
+		subjects, _ := json.Marshal(trustPolicy.Statement[0].Condition["StringLike"]["token.actions.githubusercontent.com:sub"])
+		if string(subjects) != `["repo:my-org/my-component:ref:refs/heads/main","repo:my-org/my-component:ref:refs/heads/release/*",`+
+			`"repo:my-org/my-component-infra:ref:refs/heads/main","repo:my-org/my-component-infra:ref:refs/heads/release/*"]` {
+			t.Fatalf("unexpected subjects: %s", subjects)
+		}
+		var policy testPolicyDocument
+		if err := json.Unmarshal([]byte(iamClient.policies["cdflow2-github-my-component"]["cdflow2-release-deploy"]), &policy); err != nil {
+			t.Fatal("invalid policy:", err, iamClient.policies)
+		}
+		for _, sid := range []string{"CallerIdentity", "UploadRelease", "PushImages", "DownloadRelease", "State", "StateLockTable"} {
+			policy.statement(t, sid)
+		}
+		if policy.hasStatement("CreateBuckets") {
+			t.Fatal("unexpected setup statement in role policy")
+		}
+		if !strings.Contains(errorBuffer.String(), "role-to-assume: arn:aws:iam::123456789012:role/cdflow2-github-my-component") {
+			t.Fatalf("expected workflow snippet, got: %s", errorBuffer.String())
+		}
+	})
+
+	t.Run("existing", func(t *testing.T) {
+		// Given
+		iamClient := newMemoryIAM()
+		iamClient.providers["arn:aws:iam::123456789012:oidc-provider/token.actions.githubusercontent.com"] = []string{"sts.amazonaws.com"}
+		iamClient.trustPolicies["cdflow2-github-my-component"] = "{}"
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{IAMClient: iamClient, ErrorStream: &errorBuffer})
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(githubOIDCSetupRequest(), response)
+
+		// Then
+		if err != nil || !response.Success {
+			t.Fatal("unexpected failure:", err, errorBuffer.String())
+		}
+		if !strings.Contains(errorBuffer.String(), "GitHub OIDC provider found") || !strings.Contains(errorBuffer.String(), "GitHub Actions role found") {
+			t.Fatalf("expected existing provider and role, got: %s", errorBuffer.String())
+		}
+		if !strings.Contains(iamClient.trustPolicies["cdflow2-github-my-component"], "repo:my-org/my-component:ref:refs/heads/main") {
+			t.Fatalf("expected trust policy to be updated, got %s", iamClient.trustPolicies["cdflow2-github-my-component"])
+		}
+	})
+
+	t.Run("provider without audience", func(t *testing.T) {
+		// Given
+		iamClient := newMemoryIAM()
+		iamClient.providers["arn:aws:iam::123456789012:oidc-provider/token.actions.githubusercontent.com"] = []string{"something-else"}
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{IAMClient: iamClient, ErrorStream: &errorBuffer})
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(githubOIDCSetupRequest(), response)
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if response.Success || !strings.Contains(errorBuffer.String(), "does not have sts.amazonaws.com as an audience") {
+			t.Fatalf("expected failure, got %v with output: %s", response.Success, errorBuffer.String())
+		}
+		if len(iamClient.trustPolicies) != 0 {
+			t.Fatalf("expected no role to be created, got %v", iamClient.trustPolicies)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		// Given
+		iamClient := newMemoryIAM()
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{IAMClient: iamClient, ErrorStream: &errorBuffer})
+		request := setupRequest()
+		request.Config["github_oidc"] = map[string]interface{}{"repositories": []interface{}{"my-component"}}
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(request, response)
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if response.Success || !strings.Contains(errorBuffer.String(), "config.params.github_oidc.org must be the name of a GitHub organisation") {
+			t.Fatalf("expected failure, got %v with output: %s", response.Success, errorBuffer.String())
+		}
+		if len(iamClient.providers) != 0 {
+			t.Fatalf("expected nothing to be created, got %v", iamClient.providers)
+		}
+	})
+}
@@ -16,10 +16,14 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/logrusorgru/aurora"
 	common "github.com/mergermarket/cdflow2-config-common"
 )
@@ -44,36 +48,60 @@ func initStyles() *styles {
 
 // Handler handles config requests.
 type Handler struct {
-	s3Client             s3iface.S3API
-	dynamoDBClient       dynamodbiface.DynamoDBAPI
-	ecrClient            ecriface.ECRAPI
-	secretsManagerClient secretsmanageriface.SecretsManagerAPI
-	awsSession           *session.Session
-	defaultRegion        string
-	ReleaseFolder        string
-	releaseBucket        string
-	tfstateBucket        string
-	tflocksTable         string
-	lambdaBucket         string
-	InputStream          io.Reader
-	OutputStream         io.Writer
-	ErrorStream          io.Writer
-	ReleaseLoader        common.ReleaseLoader
-	ReleaseSaver         common.ReleaseSaver
-	styles               *styles
+	s3Client              s3iface.S3API
+	dynamoDBClient        dynamodbiface.DynamoDBAPI
+	ecrClient             ecriface.ECRAPI
+	secretsManagerClient  secretsmanageriface.SecretsManagerAPI
+	stsClient             stsiface.STSAPI
+	iamClient             iamiface.IAMAPI
+	callerIdentity        *sts.GetCallerIdentityOutput
+	accountAlias          *string
+	releaseStore          ReleaseStore
+	regionalS3Clients     map[string]s3iface.S3API
+	regionalDynamoDB      map[string]dynamodbiface.DynamoDBAPI
+	s3ClientFactory       func(region, roleARN string) s3iface.S3API
+	dynamoDBClientFactory func(region, roleARN string) dynamodbiface.DynamoDBAPI
+	regionalSecrets       map[string]secretsmanageriface.SecretsManagerAPI
+	secretsClientFactory  func(region string) secretsmanageriface.SecretsManagerAPI
+	awsSession            *session.Session
+	defaultRegion         string
+	ReleaseFolder         string
+	releaseBucket         string
+	tfstateBucket         string
+	tflocksTable          string
+	backendConfig         *backendConfig
+	lambdaBucket          string
+	InputStream           io.Reader
+	OutputStream          io.Writer
+	ErrorStream           io.Writer
+	ReleaseLoader         common.ReleaseLoader
+	ReleaseSaver          common.ReleaseSaver
+	styles                *styles
 }
 
 // Opts are the options for creating a new handler.
 type Opts struct {
-	S3Client       s3iface.S3API
-	DynamoDBClient dynamodbiface.DynamoDBAPI
-	ECRClient      ecriface.ECRAPI
-	ReleaseDir     string
-	InputStream    io.Reader
-	OutputStream   io.Writer
-	ErrorStream    io.Writer
-	ReleaseSaver   common.ReleaseSaver
-	ReleaseLoader  common.ReleaseLoader
+	S3Client             s3iface.S3API
+	DynamoDBClient       dynamodbiface.DynamoDBAPI
+	ECRClient            ecriface.ECRAPI
+	SecretsManagerClient secretsmanageriface.SecretsManagerAPI
+	STSClient            stsiface.STSAPI
+	IAMClient            iamiface.IAMAPI
+	// S3ClientFactory and DynamoDBClientFactory create the clients for resources outside the default region or accessed by assuming
+	// a role (e.g. terraform state in config.params.environments) - roleARN is empty when no role is assumed. By default clients are
+	// created from the AWS session.
+	S3ClientFactory       func(region, roleARN string) s3iface.S3API
+	DynamoDBClientFactory func(region, roleARN string) dynamodbiface.DynamoDBAPI
+	// SecretsManagerClientFactory creates the clients for environments' secrets outside the default region.
+	SecretsManagerClientFactory func(region string) secretsmanageriface.SecretsManagerAPI
+	// ReleaseStore overrides where releases are stored - by default they are kept in the cdflow2-release-... S3 bucket.
+	ReleaseStore  ReleaseStore
+	ReleaseDir    string
+	InputStream   io.Reader
+	OutputStream  io.Writer
+	ErrorStream   io.Writer
+	ReleaseSaver  common.ReleaseSaver
+	ReleaseLoader common.ReleaseLoader
 }
 
 // New returns a new handler.
@@ -95,18 +123,36 @@ func New(opts *Opts) *Handler {
 		ErrorStream = os.Stderr
 	}
 
-	return &Handler{
-		s3Client:       opts.S3Client,
-		dynamoDBClient: opts.DynamoDBClient,
-		ecrClient:      opts.ECRClient,
-		ReleaseFolder:  releaseDir,
-		InputStream:    InputStream,
-		OutputStream:   OutputStream,
-		ErrorStream:    ErrorStream,
-		ReleaseSaver:   common.CreateReleaseSaver(),
-		ReleaseLoader:  common.CreateReleaseLoader(),
-		styles:         initStyles(),
+	h := &Handler{
+		s3Client:              opts.S3Client,
+		dynamoDBClient:        opts.DynamoDBClient,
+		ecrClient:             opts.ECRClient,
+		secretsManagerClient:  opts.SecretsManagerClient,
+		stsClient:             opts.STSClient,
+		iamClient:             opts.IAMClient,
+		s3ClientFactory:       opts.S3ClientFactory,
+		dynamoDBClientFactory: opts.DynamoDBClientFactory,
+		secretsClientFactory:  opts.SecretsManagerClientFactory,
+		releaseStore:          opts.ReleaseStore,
+		backendConfig:         defaultBackendConfig(),
+		ReleaseFolder:         releaseDir,
+		InputStream:           InputStream,
+		OutputStream:          OutputStream,
+		ErrorStream:           ErrorStream,
+		ReleaseSaver:          common.CreateReleaseSaver(),
+		ReleaseLoader:         common.CreateReleaseLoader(),
+		styles:                initStyles(),
 	}
+	if h.s3ClientFactory == nil {
+		h.s3ClientFactory = h.newS3Client
+	}
+	if h.dynamoDBClientFactory == nil {
+		h.dynamoDBClientFactory = h.newDynamoDBClient
+	}
+	if h.secretsClientFactory == nil {
+		h.secretsClientFactory = h.newSecretsManagerClient
+	}
+	return h
 }
 
 func (h *Handler) getS3Client() s3iface.S3API {
@@ -119,6 +165,34 @@ func (h *Handler) getS3Client() s3iface.S3API {
 	return h.s3Client
 }
 
+// getS3ClientForRegion returns an S3 client for a region other than the default region (e.g. for a per-environment state bucket).
+func (h *Handler) getS3ClientForRegion(region string) s3iface.S3API {
+	return h.getS3ClientFor(region, "")
+}
+
+// getS3ClientFor returns an S3 client for a region, assuming the role if roleARN is set. The default client is used for the default
+// region without a role, and others are created once with the S3 client factory.
+func (h *Handler) getS3ClientFor(region, roleARN string) s3iface.S3API {
+	if roleARN == "" && (region == "" || region == h.defaultRegion) {
+		return h.getS3Client()
+	}
+	cacheKey := roleARN + " " + region
+	if h.regionalS3Clients == nil {
+		h.regionalS3Clients = make(map[string]s3iface.S3API)
+	}
+	if _, ok := h.regionalS3Clients[cacheKey]; !ok {
+		h.regionalS3Clients[cacheKey] = h.s3ClientFactory(region, roleARN)
+	}
+	return h.regionalS3Clients[cacheKey]
+}
+
+func (h *Handler) newS3Client(region, roleARN string) s3iface.S3API {
+	if h.awsSession == nil {
+		log.Panic("No AWS session")
+	}
+	return s3.New(h.awsSession, h.regionalAWSConfig(region, roleARN))
+}
+
 func (h *Handler) getDynamoDBClient() dynamodbiface.DynamoDBAPI {
 	if h.dynamoDBClient == nil {
 		h.dynamoDBClient = dynamodb.New(h.awsSession)
@@ -126,6 +200,33 @@ func (h *Handler) getDynamoDBClient() dynamodbiface.DynamoDBAPI {
 	return h.dynamoDBClient
 }
 
+// getDynamoDBClientForRegion returns a DynamoDB client for a region other than the default region (e.g. for a per-environment lock table).
+func (h *Handler) getDynamoDBClientForRegion(region string) dynamodbiface.DynamoDBAPI {
+	return h.getDynamoDBClientFor(region, "")
+}
+
+// getDynamoDBClientFor returns a DynamoDB client for a region, assuming the role if roleARN is set, in the same way as getS3ClientFor.
+func (h *Handler) getDynamoDBClientFor(region, roleARN string) dynamodbiface.DynamoDBAPI {
+	if roleARN == "" && (region == "" || region == h.defaultRegion) {
+		return h.getDynamoDBClient()
+	}
+	cacheKey := roleARN + " " + region
+	if h.regionalDynamoDB == nil {
+		h.regionalDynamoDB = make(map[string]dynamodbiface.DynamoDBAPI)
+	}
+	if _, ok := h.regionalDynamoDB[cacheKey]; !ok {
+		h.regionalDynamoDB[cacheKey] = h.dynamoDBClientFactory(region, roleARN)
+	}
+	return h.regionalDynamoDB[cacheKey]
+}
+
+func (h *Handler) newDynamoDBClient(region, roleARN string) dynamodbiface.DynamoDBAPI {
+	if h.awsSession == nil {
+		log.Panic("No AWS session")
+	}
+	return dynamodb.New(h.awsSession, h.regionalAWSConfig(region, roleARN))
+}
+
 func (h *Handler) getECRClient() ecriface.ECRAPI {
 	if h.ecrClient == nil {
 		h.ecrClient = ecr.New(h.awsSession)
@@ -140,6 +241,42 @@ func (h *Handler) getSecretManagerClient() secretsmanageriface.SecretsManagerAPI
 	return h.secretsManagerClient
 }
 
+// getSecretsManagerClientForRegion returns a Secrets Manager client for a region (e.g. for an environment's secrets), in the same way
+// as getS3ClientForRegion.
+func (h *Handler) getSecretsManagerClientForRegion(region string) secretsmanageriface.SecretsManagerAPI {
+	if region == "" || region == h.defaultRegion {
+		return h.getSecretManagerClient()
+	}
+	if h.regionalSecrets == nil {
+		h.regionalSecrets = make(map[string]secretsmanageriface.SecretsManagerAPI)
+	}
+	if _, ok := h.regionalSecrets[region]; !ok {
+		h.regionalSecrets[region] = h.secretsClientFactory(region)
+	}
+	return h.regionalSecrets[region]
+}
+
+func (h *Handler) newSecretsManagerClient(region string) secretsmanageriface.SecretsManagerAPI {
+	if h.awsSession == nil {
+		log.Panic("No AWS session")
+	}
+	return secretsmanager.New(h.awsSession, h.regionalAWSConfig(region, ""))
+}
+
+func (h *Handler) getSTSClient() stsiface.STSAPI {
+	if h.stsClient == nil {
+		h.stsClient = sts.New(h.awsSession)
+	}
+	return h.stsClient
+}
+
+func (h *Handler) getIAMClient() iamiface.IAMAPI {
+	if h.iamClient == nil {
+		h.iamClient = iam.New(h.awsSession)
+	}
+	return h.iamClient
+}
+
 func randHexPostfix() string {
 	randomBytes := make([]byte, 20)
 	rand.Read(randomBytes)
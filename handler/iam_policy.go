@@ -0,0 +1,532 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// iamPolicyPhases are the phases a policy is generated for - setup, release (configure release and upload release) and deploy
+// (prepare terraform, and the terraform s3 backend that is given the same credentials).
+var iamPolicyPhases = []string{"setup", "release", "deploy"}
+
+// IAMPolicyRequest is the input to the iam-policy command.
+type IAMPolicyRequest struct {
+	CommandRequest
+	// Phase limits the output to the policy for one phase.
+	Phase string
+	// Format is json (the default) or terraform.
+	Format string
+}
+
+type iamPolicyStatement struct {
+	Sid      string   `json:"Sid"`
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+type iamPolicyDocument struct {
+	Version   string                `json:"Version"`
+	Statement []*iamPolicyStatement `json:"Statement"`
+}
+
+// iamPolicyScope holds the ARNs of the resources the policies are scoped to. Buckets that have not been created yet (i.e. before
+// setup) are matched by their prefix.
+type iamPolicyScope struct {
+	region        string
+	accountID     string
+	team          string
+	component     string
+	releaseBucket string
+	lambdaBucket  string
+	tfstateBucket string
+	stateBuckets  []string
+	stateObjects  []string
+	lockFiles     []string
+	lockTables    []string
+	secrets       []string
+	// accountRecords are the deployment records of environments deployed with credentials for other accounts, read through their
+	// state backends for config.params.promotion
+	accountRecords []string
+	backendRoles   []string
+	githubRole     string
+	// roleResources are the state resources only accessed by assuming a backend role, rather than with the caller's credentials
+	roleResources []string
+}
+
+func bucketARN(bucket string) string {
+	return "arn:aws:s3:::" + bucket
+}
+
+func objectARN(bucket, key string) string {
+	return fmt.Sprintf("arn:aws:s3:::%s/%s", bucket, key)
+}
+
+func (s *iamPolicyScope) ecrRepositoryARN() string {
+	return fmt.Sprintf("arn:aws:ecr:%s:%s:repository/%s", s.region, s.accountID, s.component)
+}
+
+// secretARN returns the ARN of a secret in a region and account, given its name or ARN.
+func secretARN(region, accountID, secretID string) string {
+	if strings.HasPrefix(secretID, "arn:") {
+		return secretID
+	}
+	// secret ARNs end with a random suffix, e.g. my-secret-AbCdEf
+	return fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s-??????", region, accountID, secretID)
+}
+
+func (s *iamPolicyScope) releaseObjects() []string {
+	if s.releaseBucket == "" {
+		return nil
+	}
+	return []string{objectARN(s.releaseBucket, fmt.Sprintf("%s/%s/*", s.team, s.component))}
+}
+
+// iamPolicyStatements are the API calls the handler makes in each phase, and the resources they are made against. Statements with
+// no resources (e.g. for the release bucket when releases are kept elsewhere) are left out.
+var iamPolicyStatements = []struct {
+	phases    []string
+	sid       string
+	actions   []string
+	resources func(s *iamPolicyScope) []string
+}{
+	{
+		[]string{"setup", "release", "deploy"}, "CallerIdentity",
+		[]string{"sts:GetCallerIdentity", "iam:ListAccountAliases"},
+		func(s *iamPolicyScope) []string { return []string{"*"} },
+	},
+	{
+		[]string{"setup", "release", "deploy"}, "FindBuckets",
+		[]string{"s3:ListAllMyBuckets"},
+		func(s *iamPolicyScope) []string { return []string{"*"} },
+	},
+	{
+		[]string{"setup", "release", "deploy"}, "DatadogAPIKey",
+		[]string{"secretsmanager:GetSecretValue"},
+		func(s *iamPolicyScope) []string {
+			return []string{secretARN(s.region, s.accountID, *datadogAPIKeyName)}
+		},
+	},
+	{
+		// the permission preflight looks up the caller's role and simulates its policies
+		[]string{"setup", "release", "deploy"}, "PermissionPreflight",
+		[]string{"iam:GetRole", "iam:SimulatePrincipalPolicy"},
+		func(s *iamPolicyScope) []string {
+			return []string{fmt.Sprintf("arn:aws:iam::%s:role/*", s.accountID), fmt.Sprintf("arn:aws:iam::%s:user/*", s.accountID)}
+		},
+	},
+	{
+		[]string{"setup"}, "CreateBuckets",
+		[]string{"s3:CreateBucket", "s3:PutBucketVersioning", "s3:ListBucket"},
+		func(s *iamPolicyScope) []string {
+			var result []string
+			if s.releaseBucket != "" {
+				result = append(result, bucketARN(s.releaseBucket))
+			}
+			for _, bucket := range s.stateBuckets {
+				result = append(result, bucketARN(bucket))
+			}
+			return append(result, bucketARN(s.lambdaBucket))
+		},
+	},
+	{
+		[]string{"setup"}, "CreateLockTables",
+		[]string{"dynamodb:DescribeTable", "dynamodb:CreateTable"},
+		func(s *iamPolicyScope) []string { return s.lockTables },
+	},
+	{
+		[]string{"setup"}, "CreateECRRepository",
+		[]string{"ecr:DescribeRepositories", "ecr:CreateRepository", "ecr:PutLifecyclePolicy"},
+		func(s *iamPolicyScope) []string { return []string{s.ecrRepositoryARN()} },
+	},
+	{
+		[]string{"setup"}, "GitHubOIDCProvider",
+		[]string{"iam:GetOpenIDConnectProvider", "iam:CreateOpenIDConnectProvider"},
+		func(s *iamPolicyScope) []string {
+			if s.githubRole == "" {
+				return nil
+			}
+			return []string{githubOIDCProviderARN(s.accountID)}
+		},
+	},
+	{
+		[]string{"setup"}, "GitHubRole",
+		[]string{"iam:GetRole", "iam:CreateRole", "iam:UpdateAssumeRolePolicy", "iam:PutRolePolicy"},
+		func(s *iamPolicyScope) []string {
+			if s.githubRole == "" {
+				return nil
+			}
+			return []string{fmt.Sprintf("arn:aws:iam::%s:role/%s", s.accountID, s.githubRole)}
+		},
+	},
+	{
+		[]string{"release"}, "DescribeLockTable",
+		[]string{"dynamodb:DescribeTable"},
+		func(s *iamPolicyScope) []string {
+			if len(s.lockTables) == 0 {
+				return nil
+			}
+			return s.lockTables[:1]
+		},
+	},
+	{
+		[]string{"release"}, "ECRAuthorization",
+		[]string{"ecr:GetAuthorizationToken"},
+		func(s *iamPolicyScope) []string { return []string{"*"} },
+	},
+	{
+		// builds with the ecr need are given the same credentials to push their images
+		[]string{"release"}, "PushImages",
+		[]string{
+			"ecr:DescribeRepositories", "ecr:BatchCheckLayerAvailability", "ecr:BatchGetImage", "ecr:GetDownloadUrlForLayer",
+			"ecr:InitiateLayerUpload", "ecr:UploadLayerPart", "ecr:CompleteLayerUpload", "ecr:PutImage",
+		},
+		func(s *iamPolicyScope) []string { return []string{s.ecrRepositoryARN()} },
+	},
+	{
+		[]string{"release"}, "UploadRelease",
+		[]string{"s3:PutObject", "s3:PutObjectTagging", "s3:AbortMultipartUpload"},
+		func(s *iamPolicyScope) []string { return s.releaseObjects() },
+	},
+	{
+		// releases are refused once the component has been migrated - listing the bucket lets a missing marker be told apart from
+		// access being denied
+		[]string{"release"}, "CheckMigrated",
+		[]string{"s3:GetObject", "s3:ListBucket"},
+		func(s *iamPolicyScope) []string {
+			return []string{bucketARN(s.tfstateBucket), objectARN(s.tfstateBucket, migrationMarkerKey(s.team, s.component))}
+		},
+	},
+	{
+		[]string{"deploy"}, "DownloadRelease",
+		[]string{"s3:GetObject"},
+		func(s *iamPolicyScope) []string { return s.releaseObjects() },
+	},
+	{
+		[]string{"deploy"}, "ListState",
+		[]string{"s3:ListBucket", "s3:ListBucketVersions"},
+		func(s *iamPolicyScope) []string {
+			var result []string
+			for _, bucket := range s.stateBuckets {
+				result = append(result, bucketARN(bucket))
+			}
+			return result
+		},
+	},
+	{
+		[]string{"deploy"}, "DeploymentRecords",
+		[]string{"s3:GetObject", "s3:PutObject"},
+		func(s *iamPolicyScope) []string {
+			return []string{objectARN(s.tfstateBucket, deploymentsComponentPrefix(s.team, s.component)+"*")}
+		},
+	},
+	{
+		[]string{"deploy"}, "OtherAccountDeploymentRecords",
+		[]string{"s3:GetObject"},
+		func(s *iamPolicyScope) []string { return s.accountRecords },
+	},
+	{
+		[]string{"deploy"}, "CheckFreezes",
+		[]string{"s3:GetObject"},
+		func(s *iamPolicyScope) []string {
+			return []string{
+				objectARN(s.tfstateBucket, freezesTeamPrefix(s.team)+"*"),
+				objectARN(s.tfstateBucket, migrationMarkerKey(s.team, s.component)),
+			}
+		},
+	},
+	{
+		[]string{"deploy"}, "State",
+		[]string{"s3:GetObject", "s3:PutObject"},
+		func(s *iamPolicyScope) []string { return s.stateObjects },
+	},
+	{
+		[]string{"deploy"}, "StateLockFile",
+		[]string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject"},
+		func(s *iamPolicyScope) []string { return s.lockFiles },
+	},
+	{
+		[]string{"deploy"}, "StateLockTable",
+		[]string{"dynamodb:DescribeTable", "dynamodb:GetItem", "dynamodb:PutItem", "dynamodb:DeleteItem"},
+		func(s *iamPolicyScope) []string { return s.lockTables },
+	},
+	{
+		[]string{"deploy"}, "EnvironmentSecrets",
+		[]string{"secretsmanager:GetSecretValue"},
+		func(s *iamPolicyScope) []string { return s.secrets },
+	},
+	{
+		[]string{"deploy"}, "AssumeBackendRole",
+		[]string{"sts:AssumeRole"},
+		func(s *iamPolicyScope) []string { return s.backendRoles },
+	},
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, item := range list {
+			if item == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// discoverBucket returns the bucket with the prefix, or a pattern matching the bucket that setup will create.
+func discoverBucket(buckets []string, prefix string) string {
+	if found := filterPrefix(buckets, prefix); len(found) == 1 {
+		return found[0]
+	}
+	return prefix + "*"
+}
+
+// getIAMPolicyScope finds the resources used by a component - the buckets, lock tables and ECR repository found in the account,
+// and the state backends and secrets in config.params.environments.
+func (h *Handler) getIAMPolicyScope(config map[string]interface{}, team, component string) (*iamPolicyScope, error) {
+	buckets, err := listBuckets(h.getS3Client())
+	if err != nil {
+		return nil, err
+	}
+	scope := iamPolicyScope{
+		region:        h.defaultRegion,
+		accountID:     h.getAccountID(),
+		team:          team,
+		component:     component,
+		lambdaBucket:  discoverBucket(buckets, "cdflow2-lambda-"),
+		tfstateBucket: discoverBucket(buckets, "cdflow2-tfstate-"),
+	}
+	githubOIDC, err := getGitHubOIDCConfig(config, component)
+	if err != nil {
+		return nil, err
+	}
+	if githubOIDC != nil {
+		scope.githubRole = githubOIDC.roleName
+	}
+	switch store := h.releaseStore.(type) {
+	case nil:
+		scope.releaseBucket = discoverBucket(buckets, "cdflow2-release-")
+	case *s3ReleaseStore:
+		if store.endpoint == "" {
+			scope.releaseBucket = store.bucket
+		}
+	}
+
+	// the backends are found with the discovered (or expected) bucket and table, leaving the handler as it was for the checks that follow
+	defer func(bucket, table string) {
+		h.tfstateBucket, h.tflocksTable = bucket, table
+	}(h.tfstateBucket, h.tflocksTable)
+	h.tfstateBucket = scope.tfstateBucket
+	if h.backendConfig.usesDynamoDBLocking() {
+		h.tflocksTable = tflocksTableName
+	}
+	envConfigs, err := getEnvironmentConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	// the default backend is used by any environment without overrides in config.params.environments
+	envs := append([]string{"*"}, sortedEnvNames(envConfigs)...)
+	// the tfstate bucket is always accessed with the caller's credentials, for the deployment records
+	var roleResources []string
+	callerResources := []string{bucketARN(scope.tfstateBucket)}
+	for _, env := range envs {
+		backend, err := h.getStateBackend(config, team, component, env)
+		if err != nil {
+			return nil, err
+		}
+		stateResources := []string{bucketARN(backend.bucket), objectARN(backend.bucket, backend.stateKey("*"))}
+		scope.stateBuckets = appendUnique(scope.stateBuckets, backend.bucket)
+		scope.stateObjects = appendUnique(scope.stateObjects, stateResources[1])
+		if h.backendConfig.usesS3Locking() {
+			lockFile := objectARN(backend.bucket, stateLockFileKey(backend, "*"))
+			scope.lockFiles = appendUnique(scope.lockFiles, lockFile)
+			stateResources = append(stateResources, lockFile)
+		}
+		if backend.lockTable != "" {
+			accountID := backend.accountID
+			if accountID == "" {
+				accountID = scope.accountID
+			}
+			lockTable := fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s", backend.region, accountID, backend.lockTable)
+			scope.lockTables = appendUnique(scope.lockTables, lockTable)
+			stateResources = append(stateResources, lockTable)
+		}
+		if envConfig, ok := envConfigs[env]; ok && envConfig.deployAccountID != "" && envConfig.deployAccountID != scope.accountID &&
+			backend.bucket != scope.tfstateBucket {
+			records := objectARN(backend.bucket, deploymentsComponentPrefix(team, component)+"*")
+			scope.accountRecords = appendUnique(scope.accountRecords, records)
+			stateResources = append(stateResources, records)
+		}
+		if backend.roleARN != "" {
+			scope.backendRoles = appendUnique(scope.backendRoles, backend.roleARN)
+			roleResources = appendUnique(roleResources, stateResources...)
+		} else {
+			callerResources = appendUnique(callerResources, stateResources...)
+		}
+		if envConfig, ok := envConfigs[env]; ok {
+			// secrets are fetched with the deploy credentials, in the environment's region
+			region, accountID := scope.region, scope.accountID
+			if envConfig.region != "" {
+				region = envConfig.region
+			}
+			if envConfig.deployAccountID != "" {
+				accountID = envConfig.deployAccountID
+			}
+			var names []string
+			for name := range envConfig.secrets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				scope.secrets = appendUnique(scope.secrets, secretARN(region, accountID, envConfig.secrets[name].secretID))
+			}
+		}
+	}
+	for _, resource := range roleResources {
+		if !containsString(callerResources, resource) {
+			scope.roleResources = append(scope.roleResources, resource)
+		}
+	}
+	return &scope, nil
+}
+
+// callerPolicyDocument returns the policy for a phase without the resources only accessed by assuming a backend role - the
+// permissions needed by the caller's own credentials.
+func (s *iamPolicyScope) callerPolicyDocument(phase string) *iamPolicyDocument {
+	document := iamPolicyDocument{Version: "2012-10-17"}
+	for _, statement := range s.iamPolicyDocument(phase).Statement {
+		var resources []string
+		for _, resource := range statement.Resource {
+			if !containsString(s.roleResources, resource) {
+				resources = append(resources, resource)
+			}
+		}
+		if len(resources) > 0 {
+			statement.Resource = resources
+			document.Statement = append(document.Statement, statement)
+		}
+	}
+	return &document
+}
+
+// iamPolicyDocument returns the policy for a phase.
+func (s *iamPolicyScope) iamPolicyDocument(phase string) *iamPolicyDocument {
+	document := iamPolicyDocument{Version: "2012-10-17"}
+	for _, statement := range iamPolicyStatements {
+		if !containsString(statement.phases, phase) {
+			continue
+		}
+		resources := statement.resources(s)
+		if len(resources) == 0 {
+			continue
+		}
+		document.Statement = append(document.Statement, &iamPolicyStatement{
+			Sid:      statement.sid,
+			Effect:   "Allow",
+			Action:   statement.actions,
+			Resource: resources,
+		})
+	}
+	return &document
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteList(values []string) string {
+	var quoted []string
+	for _, value := range values {
+		quoted = append(quoted, fmt.Sprintf("%q", value))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// writeTerraformPolicies outputs aws_iam_policy_document data sources, one per phase.
+func (h *Handler) writeTerraformPolicies(phases []string, documents map[string]*iamPolicyDocument) {
+	for i, phase := range phases {
+		if i > 0 {
+			fmt.Fprintln(h.OutputStream)
+		}
+		fmt.Fprintf(h.OutputStream, "data \"aws_iam_policy_document\" \"cdflow2_%s\" {\n", phase)
+		for j, statement := range documents[phase].Statement {
+			if j > 0 {
+				fmt.Fprintln(h.OutputStream)
+			}
+			fmt.Fprintf(h.OutputStream, "  statement {\n")
+			fmt.Fprintf(h.OutputStream, "    sid       = %q\n", statement.Sid)
+			fmt.Fprintf(h.OutputStream, "    actions   = %s\n", quoteList(statement.Action))
+			fmt.Fprintf(h.OutputStream, "    resources = %s\n", quoteList(statement.Resource))
+			fmt.Fprintf(h.OutputStream, "  }\n")
+		}
+		fmt.Fprintf(h.OutputStream, "}\n")
+	}
+}
+
+// IAMPolicy outputs least-privilege IAM policies for the credentials used in each phase, scoped to the component's resources.
+func (h *Handler) IAMPolicy(request *IAMPolicyRequest) error {
+	phases := iamPolicyPhases
+	if request.Phase != "" {
+		if !containsString(iamPolicyPhases, request.Phase) {
+			fmt.Fprintf(h.ErrorStream, "phase must be one of %s, got %q\n", strings.Join(iamPolicyPhases, ", "), request.Phase)
+			return Exit(false)
+		}
+		phases = []string{request.Phase}
+	}
+	if request.Format == "" {
+		request.Format = "json"
+	}
+	if request.Format != "json" && request.Format != "terraform" {
+		fmt.Fprintf(h.ErrorStream, "format must be json or terraform, got %q\n", request.Format)
+		return Exit(false)
+	}
+	if request.Component == "" {
+		fmt.Fprintln(h.ErrorStream, "component must be specified")
+		return Exit(false)
+	}
+	team, err := h.getTeam(request.Config["team"])
+	if err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		return Exit(false)
+	}
+	// resources are not checked, so that policies can be generated for the credentials that will run setup
+	if !h.CheckInputConfiguration(request.Config, request.Env) {
+		return Exit(false)
+	}
+	scope, err := h.getIAMPolicyScope(request.Config, team, request.Component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to find resources: %v\n", err)
+		return Exit(false)
+	}
+
+	documents := make(map[string]*iamPolicyDocument)
+	for _, phase := range phases {
+		documents[phase] = scope.iamPolicyDocument(phase)
+	}
+	if request.Format == "terraform" {
+		h.writeTerraformPolicies(phases, documents)
+		return nil
+	}
+	var output interface{} = documents
+	if request.Phase != "" {
+		output = documents[request.Phase]
+	}
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(h.OutputStream, string(data))
+	return nil
+}
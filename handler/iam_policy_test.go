@@ -0,0 +1,257 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type testPolicyDocument struct {
+	Version   string
+	Statement []struct {
+		Sid      string
+		Effect   string
+		Action   []string
+		Resource []string
+	}
+}
+
+func (d *testPolicyDocument) statement(t *testing.T, sid string) ([]string, []string) {
+	for _, statement := range d.Statement {
+		if statement.Sid == sid {
+			return statement.Action, statement.Resource
+		}
+	}
+	t.Fatalf("no %s statement in policy: %+v", sid, d.Statement)
+	return nil, nil
+}
+
+func (d *testPolicyDocument) hasStatement(sid string) bool {
+	for _, statement := range d.Statement {
+		if statement.Sid == sid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIAMPolicy(t *testing.T) {
+	setup := func(buckets ...string) (*handler.Handler, *bytes.Buffer, *bytes.Buffer) {
+		var outputBuffer, errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             newMemoryS3(buckets...),
+			DynamoDBClient:       &mockedDynamoDB{},
+			ECRClient:            &memoryECR{},
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			OutputStream:         &outputBuffer,
+			ErrorStream:          &errorBuffer,
+		}), &outputBuffer, &errorBuffer
+	}
+
+	t.Run("deploy", func(t *testing.T) {
+		// Given
+		myHandler, outputBuffer, errorBuffer := setup("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+		request := &handler.IAMPolicyRequest{CommandRequest: commandRequest(), Phase: "deploy"}
+		request.Config["environments"] = map[string]interface{}{
+			"live": map[string]interface{}{
+				"region":         "eu-west-2",
+				"tfstate_bucket": "my-live-tfstate",
+				"secrets":        map[string]interface{}{"DB_PASSWORD": "live/db#password"},
+			},
+			// deployed with credentials for another account, in the default region
+			"staging": map[string]interface{}{
+				"deploy_account_id": "210987654321",
+				"secrets":           map[string]interface{}{"API_KEY": "staging/api"},
+			},
+		}
+
+		// When
+		err := myHandler.IAMPolicy(request)
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		var document testPolicyDocument
+		if err := json.Unmarshal(outputBuffer.Bytes(), &document); err != nil {
+			t.Fatal("invalid policy:", err, outputBuffer.String())
+		}
+		for sid, expected := range map[string][]string{
+			"DownloadRelease": {"arn:aws:s3:::cdflow2-release-bucket-1/my-team/my-component/*"},
+			"State": {
+				"arn:aws:s3:::cdflow2-tfstate-bucket-1/my-team/my-component/*/terraform.tfstate",
+				"arn:aws:s3:::my-live-tfstate/my-team/my-component/*/terraform.tfstate",
+			},
+			"StateLockTable": {
+				"arn:aws:dynamodb:eu-west-1:123456789012:table/cdflow2-tflocks",
+				"arn:aws:dynamodb:eu-west-2:123456789012:table/cdflow2-tflocks",
+			},
+			"DeploymentRecords": {"arn:aws:s3:::cdflow2-tfstate-bucket-1/cdflow2-deployments/my-team/my-component/*"},
+			"EnvironmentSecrets": {
+				"arn:aws:secretsmanager:eu-west-2:123456789012:secret:live/db-??????",
+				"arn:aws:secretsmanager:eu-west-1:210987654321:secret:staging/api-??????",
+			},
+		} {
+			_, resources := document.statement(t, sid)
+			if strings.Join(resources, ",") != strings.Join(expected, ",") {
+				t.Fatalf("expected %s resources %v, got %v", sid, expected, resources)
+			}
+		}
+		for _, sid := range []string{"CreateBuckets", "UploadRelease", "StateLockFile", "AssumeBackendRole"} {
+			if document.hasStatement(sid) {
+				t.Fatalf("unexpected %s statement in deploy policy", sid)
+			}
+		}
+	})
+
+	t.Run("setup before buckets exist", func(t *testing.T) {
+		// Given
+		myHandler, outputBuffer, errorBuffer := setup()
+
+		// When
+		err := myHandler.IAMPolicy(&handler.IAMPolicyRequest{CommandRequest: commandRequest(), Phase: "setup"})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		var document testPolicyDocument
+		if err := json.Unmarshal(outputBuffer.Bytes(), &document); err != nil {
+			t.Fatal("invalid policy:", err, outputBuffer.String())
+		}
+		actions, resources := document.statement(t, "CreateBuckets")
+		if strings.Join(resources, ",") != "arn:aws:s3:::cdflow2-release-*,arn:aws:s3:::cdflow2-tfstate-*,arn:aws:s3:::cdflow2-lambda-*" {
+			t.Fatalf("unexpected bucket resources: %v", resources)
+		}
+		if strings.Join(actions, ",") != "s3:CreateBucket,s3:PutBucketVersioning,s3:ListBucket" {
+			t.Fatalf("unexpected bucket actions: %v", actions)
+		}
+		if _, resources := document.statement(t, "CreateECRRepository"); resources[0] != "arn:aws:ecr:eu-west-1:123456789012:repository/my-component" {
+			t.Fatalf("unexpected ECR resources: %v", resources)
+		}
+	})
+
+	t.Run("terraform", func(t *testing.T) {
+		// Given
+		myHandler, outputBuffer, errorBuffer := setup("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+
+		// When
+		err := myHandler.IAMPolicy(&handler.IAMPolicyRequest{CommandRequest: commandRequest(), Format: "terraform"})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		for _, expected := range []string{
+			`data "aws_iam_policy_document" "cdflow2_setup" {`,
+			`data "aws_iam_policy_document" "cdflow2_release" {`,
+			`data "aws_iam_policy_document" "cdflow2_deploy" {`,
+			`    sid       = "UploadRelease"
+    actions   = ["s3:PutObject", "s3:PutObjectTagging", "s3:AbortMultipartUpload"]
+    resources = ["arn:aws:s3:::cdflow2-release-bucket-1/my-team/my-component/*"]`,
+		} {
+			if !strings.Contains(outputBuffer.String(), expected) {
+				t.Fatalf("expected %q in output: %s", expected, outputBuffer.String())
+			}
+		}
+	})
+
+	t.Run("unknown phase", func(t *testing.T) {
+		// Given
+		myHandler, _, errorBuffer := setup()
+
+		// When
+		err := myHandler.IAMPolicy(&handler.IAMPolicyRequest{CommandRequest: commandRequest(), Phase: "destroy"})
+
+		// Then
+		if err != handler.Exit(false) || !strings.Contains(errorBuffer.String(), "phase must be one of setup, release, deploy") {
+			t.Fatalf("expected failure, got %v with output: %q", err, errorBuffer.String())
+		}
+	})
+}
+
+// allows returns whether any statement allows the action on the resource, matching * and ? in resources as IAM does.
+func (d *testPolicyDocument) allows(action, resource string) bool {
+	for _, statement := range d.Statement {
+		if statement.Effect != "Allow" || !containsString(statement.Action, action) {
+			continue
+		}
+		for _, pattern := range statement.Resource {
+			expression := strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(pattern))
+			if regexp.MustCompile("^" + expression + "$").MatchString(resource) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// policyS3 denies the object reads a policy doesn't allow. Like S3, a missing object is reported as access denied unless the policy
+// allows listing the bucket.
+type policyS3 struct {
+	*memoryS3
+	document *testPolicyDocument
+}
+
+func (m *policyS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	bucket, key := aws.StringValue(input.Bucket), aws.StringValue(input.Key)
+	if !m.document.allows("s3:GetObject", "arn:aws:s3:::"+bucket+"/"+key) {
+		return nil, awserr.New("AccessDenied", "access denied", nil)
+	}
+	output, err := m.memoryS3.GetObject(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey && !m.document.allows("s3:ListBucket", "arn:aws:s3:::"+bucket) {
+		return nil, awserr.New("AccessDenied", "access denied", nil)
+	}
+	return output, err
+}
+
+func TestReleasePolicyChecksMigration(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	var policy bytes.Buffer
+	if err := testHandler(handler.Opts{S3Client: s3Client, OutputStream: &policy}).IAMPolicy(
+		&handler.IAMPolicyRequest{CommandRequest: commandRequest(), Phase: "release"},
+	); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var document testPolicyDocument
+	if err := json.Unmarshal(policy.Bytes(), &document); err != nil {
+		t.Fatal("invalid policy:", err, policy.String())
+	}
+	var errorBuffer bytes.Buffer
+	myHandler := testHandler(handler.Opts{S3Client: &policyS3{memoryS3: s3Client, document: &document}, ErrorStream: &errorBuffer})
+	request := common.CreateConfigureReleaseRequest()
+	request.Component = "my-component"
+	request.Version = "1"
+	request.Config = commandRequest().Config
+	request.Env = commandRequest().Env
+	response := common.CreateConfigureReleaseResponse()
+
+	// When
+	err := myHandler.ConfigureRelease(request, response)
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("expected the release policy to allow configure release:", err, errorBuffer.String())
+	}
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-simple-aws/internal/ui"
+)
+
+// lockInfo is the information terraform stores with a state lock.
+type lockInfo struct {
+	ID        string    `json:"ID"`
+	Operation string    `json:"Operation"`
+	Info      string    `json:"Info"`
+	Who       string    `json:"Who"`
+	Version   string    `json:"Version"`
+	Created   time.Time `json:"Created"`
+	Path      string    `json:"Path"`
+}
+
+// stateLock is a lock held on an environment's state, either as an item in the DynamoDB lock table or a lock file in S3.
+type stateLock struct {
+	location string
+	info     *lockInfo
+	// raw is the lock info as stored, for removing the lock only if it is unchanged.
+	raw string
+	// dynamoDB is true if the lock is an item in the lock table, otherwise it is a lock file in S3.
+	dynamoDB bool
+}
+
+func stateLockFileKey(backend *stateBackend, env string) string {
+	return backend.stateKey(env) + ".tflock"
+}
+
+func parseLockInfo(raw string) *lockInfo {
+	var info lockInfo
+	if err := json.Unmarshal([]byte(raw), &info); err != nil {
+		return &lockInfo{}
+	}
+	return &info
+}
+
+// getStateLocks returns the locks currently held on the environment's state.
+func (h *Handler) getStateLocks(backend *stateBackend, env string) ([]*stateLock, error) {
+	var result []*stateLock
+	lockID := backend.bucket + "/" + backend.stateKey(env)
+	if backend.lockTable != "" {
+		output, err := h.getStateDynamoDBClient(backend).GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(backend.lockTable),
+			Key:            map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(lockID)}},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if output.Item != nil {
+			raw := ""
+			if info, ok := output.Item["Info"]; ok {
+				raw = aws.StringValue(info.S)
+			}
+			result = append(result, &stateLock{
+				location: fmt.Sprintf("dynamodb table %s, LockID %s", backend.lockTable, lockID),
+				info:     parseLockInfo(raw),
+				raw:      raw,
+				dynamoDB: true,
+			})
+		}
+	}
+	if h.backendConfig.usesS3Locking() {
+		output, err := h.getStateS3Client(backend).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(stateLockFileKey(backend, env)),
+		})
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			data, err := ioutil.ReadAll(output.Body)
+			output.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &stateLock{
+				location: fmt.Sprintf("s3://%s/%s", backend.bucket, stateLockFileKey(backend, env)),
+				info:     parseLockInfo(string(data)),
+				raw:      string(data),
+			})
+		}
+	}
+	return result, nil
+}
+
+func (h *Handler) printStateLock(lock *stateLock, indent string) {
+	who, since := lock.info.Who, "an unknown time"
+	if who == "" {
+		who = "unknown"
+	}
+	if !lock.info.Created.IsZero() {
+		since = fmt.Sprintf("%s (%s ago)", lock.info.Created.UTC().Format("2006-01-02 15:04:05 MST"), time.Since(lock.info.Created).Round(time.Second))
+	}
+	fmt.Fprintf(h.ErrorStream, "%slocked by %s since %s\n", indent, who, since)
+	for _, field := range []struct{ name, value string }{
+		{"Lock ID", lock.info.ID},
+		{"Operation", lock.info.Operation},
+		{"Terraform", lock.info.Version},
+		{"Info", lock.info.Info},
+		{"Location", lock.location},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(h.ErrorStream, "%s  %-10s %s\n", indent, field.name+":", field.value)
+		}
+	}
+}
+
+// checkStateLocks warns if the environment's state is locked, e.g. by a deploy that crashed - terraform would otherwise fail
+// to acquire the lock without saying how to remove it.
+func (h *Handler) checkStateLocks(backend *stateBackend, env string) {
+	locks, err := h.getStateLocks(backend, env)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s unable to check for a lock on the terraform state: %v\n", h.styles.warningCross, err)
+		return
+	}
+	for _, lock := range locks {
+		fmt.Fprintf(h.ErrorStream, "  %s terraform state for %s is ", h.styles.warningCross, env)
+		h.printStateLock(lock, "")
+		fmt.Fprintf(h.ErrorStream, "    If the process holding the lock is no longer running, remove it with the unlock command.\n")
+	}
+}
+
+// UnlockRequest is the input to the unlock command.
+type UnlockRequest struct {
+	CommandRequest
+	EnvName string
+	// LockID is the ID of the lock to remove, which must match the current lock if set.
+	LockID string
+}
+
+// Unlock removes the locks on an environment's terraform state after confirmation.
+func (h *Handler) Unlock(request *UnlockRequest) error {
+	if request.EnvName == "" {
+		fmt.Fprintln(h.ErrorStream, "env must be specified")
+		return Exit(false)
+	}
+	team, err := h.prepareCommand(&request.CommandRequest)
+	if err != nil {
+		return err
+	}
+	backend, err := h.getStateBackend(request.Config, team, request.Component, request.EnvName)
+	if err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		return Exit(false)
+	}
+	h.printStateBackend(request.EnvName, backend)
+
+	locks, err := h.getStateLocks(backend, request.EnvName)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to check for a lock on the terraform state: %v\n", err)
+		return Exit(false)
+	}
+	if len(locks) == 0 {
+		fmt.Fprintf(h.ErrorStream, "The terraform state for %s is not locked.\n", request.EnvName)
+		return nil
+	}
+	for _, lock := range locks {
+		fmt.Fprintf(h.ErrorStream, "Terraform state for %s is ", request.EnvName)
+		h.printStateLock(lock, "")
+		if request.LockID != "" && lock.info.ID != request.LockID {
+			fmt.Fprintf(h.ErrorStream, "The lock ID is %q, not %q - not removing the lock.\n", lock.info.ID, request.LockID)
+			return Exit(false)
+		}
+	}
+	if !ui.Confirm(
+		"Removing a lock held by a running process can corrupt the terraform state. Remove the lock? Only 'yes' will be accepted to confirm: ",
+		h.InputStream, h.ErrorStream,
+	) {
+		fmt.Fprintln(h.ErrorStream, "Unlock cancelled.")
+		return Exit(false)
+	}
+	for _, lock := range locks {
+		if err := h.removeStateLock(backend, request.EnvName, lock); err != nil {
+			fmt.Fprintf(h.ErrorStream, "Unable to remove lock (%s): %v\n", lock.location, err)
+			return Exit(false)
+		}
+		fmt.Fprintf(h.ErrorStream, "%s Removed lock (%s).\n", h.styles.tick, lock.location)
+	}
+	return nil
+}
+
+func (h *Handler) removeStateLock(backend *stateBackend, env string, lock *stateLock) error {
+	if !lock.dynamoDB {
+		_, err := h.getStateS3Client(backend).DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(stateLockFileKey(backend, env)),
+		})
+		return err
+	}
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(backend.lockTable),
+		Key:       map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(backend.bucket + "/" + backend.stateKey(env))}},
+	}
+	if lock.raw != "" {
+		// only remove the lock that was confirmed, not one acquired since
+		input.ConditionExpression = aws.String("Info = :info")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":info": {S: aws.String(lock.raw)}}
+	}
+	_, err := h.getStateDynamoDBClient(backend).DeleteItem(input)
+	return err
+}
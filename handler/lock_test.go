@@ -0,0 +1,198 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const liveLockInfo = `{"ID":"0b5c7e4e-1f1a-4b2f-9a7c-3f0e8d2f6a11","Operation":"OperationTypeApply","Info":"","Who":"runner@ci-1234",` +
+	`"Version":"1.5.0","Created":"2026-10-18T22:15:03.123456Z","Path":"cdflow2-tfstate-bucket-1/` + liveStateKey + `"}`
+
+func lockedBackend(locking string) (*memoryS3, *memoryDynamoDB) {
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	dynamoDBClient := newMemoryDynamoDB()
+	if locking != "s3" {
+		dynamoDBClient.put("cdflow2-tflocks", "cdflow2-tfstate-bucket-1/"+liveStateKey, map[string]*dynamodb.AttributeValue{
+			"Info": {S: aws.String(liveLockInfo)},
+		})
+	}
+	if locking != "dynamodb" {
+		s3Client.put("cdflow2-tfstate-bucket-1", liveStateKey+".tflock", []byte(liveLockInfo))
+	}
+	return s3Client, dynamoDBClient
+}
+
+func TestPrepareTerraformReportsLock(t *testing.T) {
+	for _, locking := range []string{"dynamodb", "s3"} {
+		t.Run(locking, func(t *testing.T) {
+			// Given
+			s3Client, dynamoDBClient := lockedBackend(locking)
+			var errorBuffer bytes.Buffer
+			myHandler := handler.New(&handler.Opts{
+				S3Client:             s3Client,
+				DynamoDBClient:       dynamoDBClient,
+				SecretsManagerClient: mockedSecretsManager{},
+				STSClient:            mockedSTS{account: "123456789012"},
+				IAMClient:            mockedIAM{},
+				OutputStream:         &bytes.Buffer{},
+				ErrorStream:          &errorBuffer,
+			})
+			request := prepareTerraformRequest("live", "")
+			request.Config["backend"] = map[string]interface{}{"locking": locking}
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil || !response.Success {
+				t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+			}
+			output := errorBuffer.String()
+			for _, expected := range []string{
+				"terraform state for live is locked by runner@ci-1234 since 2026-10-18 22:15:03 UTC",
+				"Lock ID:   0b5c7e4e-1f1a-4b2f-9a7c-3f0e8d2f6a11",
+				"Operation: OperationTypeApply",
+				"remove it with the unlock command",
+			} {
+				if !strings.Contains(output, expected) {
+					t.Fatalf("expected %q in output, got: %q", expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	setup := func(input string) (*handler.Handler, *memoryS3, *memoryDynamoDB, *bytes.Buffer) {
+		s3Client, dynamoDBClient := lockedBackend("both")
+		var errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             s3Client,
+			DynamoDBClient:       dynamoDBClient,
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			InputStream:          strings.NewReader(input),
+			OutputStream:         &bytes.Buffer{},
+			ErrorStream:          &errorBuffer,
+		}), s3Client, dynamoDBClient, &errorBuffer
+	}
+	unlockRequest := func(lockID string) *handler.UnlockRequest {
+		request := &handler.UnlockRequest{CommandRequest: commandRequest(), EnvName: "live", LockID: lockID}
+		request.Config["backend"] = map[string]interface{}{"locking": "both"}
+		return request
+	}
+	isLocked := func(s3Client *memoryS3, dynamoDBClient *memoryDynamoDB) (bool, bool) {
+		_, lockFile := s3Client.get("cdflow2-tfstate-bucket-1", liveStateKey+".tflock")
+		_, lockItem := dynamoDBClient.items["cdflow2-tflocks/cdflow2-tfstate-bucket-1/"+liveStateKey]
+		return lockItem, lockFile
+	}
+
+	t.Run("confirmed", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, dynamoDBClient, errorBuffer := setup("yes\n")
+
+		// When
+		err := myHandler.Unlock(unlockRequest("0b5c7e4e-1f1a-4b2f-9a7c-3f0e8d2f6a11"))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if lockItem, lockFile := isLocked(s3Client, dynamoDBClient); lockItem || lockFile {
+			t.Fatalf("expected locks to be removed, lock item: %v, lock file: %v", lockItem, lockFile)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, dynamoDBClient, errorBuffer := setup("no\n")
+
+		// When
+		err := myHandler.Unlock(unlockRequest(""))
+
+		// Then
+		if err != handler.Exit(false) || !strings.Contains(errorBuffer.String(), "Unlock cancelled.") {
+			t.Fatalf("unexpected result: %v, %q", err, errorBuffer.String())
+		}
+		if lockItem, lockFile := isLocked(s3Client, dynamoDBClient); !lockItem || !lockFile {
+			t.Fatal("expected locks to remain")
+		}
+	})
+
+	t.Run("different lock ID", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, dynamoDBClient, errorBuffer := setup("yes\n")
+
+		// When
+		err := myHandler.Unlock(unlockRequest("other"))
+
+		// Then
+		if err != handler.Exit(false) || !strings.Contains(errorBuffer.String(), `not "other" - not removing the lock`) {
+			t.Fatalf("unexpected result: %v, %q", err, errorBuffer.String())
+		}
+		if lockItem, lockFile := isLocked(s3Client, dynamoDBClient); !lockItem || !lockFile {
+			t.Fatal("expected locks to remain")
+		}
+	})
+
+	t.Run("not locked", func(t *testing.T) {
+		// Given
+		var errorBuffer bytes.Buffer
+		myHandler := handler.New(&handler.Opts{
+			S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+			DynamoDBClient:       newMemoryDynamoDB(),
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			OutputStream:         &bytes.Buffer{},
+			ErrorStream:          &errorBuffer,
+		})
+
+		// When
+		err := myHandler.Unlock(unlockRequest(""))
+
+		// Then
+		if err != nil || !strings.Contains(errorBuffer.String(), "The terraform state for live is not locked.") {
+			t.Fatalf("unexpected result: %v, %q", err, errorBuffer.String())
+		}
+	})
+}
+
+func TestRestoreStateWhenLocked(t *testing.T) {
+	// Given
+	s3Client, dynamoDBClient := lockedBackend("dynamodb")
+	previous := s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte("state-1"), time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC))
+	s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte("state-2"), time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC))
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             s3Client,
+		DynamoDBClient:       dynamoDBClient,
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		IAMClient:            mockedIAM{},
+		InputStream:          strings.NewReader("yes\n"),
+		OutputStream:         &bytes.Buffer{},
+		ErrorStream:          &errorBuffer,
+	})
+
+	// When
+	err := myHandler.RestoreState(&handler.RestoreStateRequest{CommandRequest: commandRequest(), EnvName: "live", VersionID: previous})
+
+	// Then
+	if err != handler.Exit(false) || !strings.Contains(errorBuffer.String(), "Not restoring, the terraform state for live is locked by runner@ci-1234") {
+		t.Fatalf("unexpected result: %v, %q", err, errorBuffer.String())
+	}
+	if data, _ := s3Client.get("cdflow2-tfstate-bucket-1", liveStateKey); string(data) != "state-2" {
+		t.Fatalf("expected state to be unchanged, got %q", data)
+	}
+}
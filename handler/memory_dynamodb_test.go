@@ -0,0 +1,50 @@
+package handler_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// memoryDynamoDB is a mock DynamoDB that keeps items in memory, keyed by table and LockID (the key of terraform's lock table).
+type memoryDynamoDB struct {
+	mockedDynamoDB
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newMemoryDynamoDB() *memoryDynamoDB {
+	return &memoryDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func (m *memoryDynamoDB) put(table, lockID string, item map[string]*dynamodb.AttributeValue) {
+	item["LockID"] = &dynamodb.AttributeValue{S: aws.String(lockID)}
+	m.items[table+"/"+lockID] = item
+}
+
+func (m *memoryDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: m.items[*input.TableName+"/"+*input.Key["LockID"].S]}, nil
+}
+
+func (m *memoryDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.items[*input.TableName+"/"+*input.Item["LockID"].S] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *memoryDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	delete(m.items, *input.TableName+"/"+*input.Key["LockID"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// dynamoDBClientFactory returns a factory for handler.Opts serving the clients keyed by "<role ARN> <region>" (with an empty role
+// when none is assumed), failing the test for any other region or role.
+func dynamoDBClientFactory(t *testing.T, clients map[string]dynamodbiface.DynamoDBAPI) func(region, roleARN string) dynamodbiface.DynamoDBAPI {
+	return func(region, roleARN string) dynamodbiface.DynamoDBAPI {
+		client, ok := clients[roleARN+" "+region]
+		if !ok {
+			t.Fatalf("unexpected dynamodb client for region %q and role %q", region, roleARN)
+		}
+		return client
+	}
+}
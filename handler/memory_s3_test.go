@@ -0,0 +1,336 @@
+package handler_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type memoryObject struct {
+	data         []byte
+	metadata     map[string]*string
+	contentType  *string
+	tagging      string
+	lastModified time.Time
+	versionID    string
+	deleteMarker bool
+}
+
+// memoryS3 is a mock S3 that keeps objects in memory, keyed by bucket and key. All buckets are versioned.
+type memoryS3 struct {
+	mockedS3
+	objects map[string]*memoryObject
+	// versions is the history of each object, oldest first, including delete markers.
+	versions    map[string][]*memoryObject
+	nextVersion int
+	// owner is the account owning the buckets, checked when a request has an expected bucket owner.
+	owner string
+}
+
+func newMemoryS3(buckets ...string) *memoryS3 {
+	return &memoryS3{
+		mockedS3: mockedS3{buckets: buckets},
+		objects:  make(map[string]*memoryObject),
+		versions: make(map[string][]*memoryObject),
+	}
+}
+
+func (m *memoryS3) addVersion(path string, object *memoryObject) *memoryObject {
+	m.nextVersion++
+	object.versionID = fmt.Sprintf("version-%d", m.nextVersion)
+	if object.lastModified.IsZero() {
+		// ensure versions are ordered by time even when created in quick succession
+		object.lastModified = time.Now().Add(time.Duration(m.nextVersion) * time.Millisecond)
+	}
+	m.versions[path] = append(m.versions[path], object)
+	if object.deleteMarker {
+		delete(m.objects, path)
+	} else {
+		m.objects[path] = object
+	}
+	return object
+}
+
+func (m *memoryS3) put(bucket, key string, data []byte) {
+	m.addVersion(bucket+"/"+key, &memoryObject{data: data})
+}
+
+// putAt adds a version of an object last modified at a given time, returning the version id.
+func (m *memoryS3) putAt(bucket, key string, data []byte, lastModified time.Time) string {
+	return m.addVersion(bucket+"/"+key, &memoryObject{data: data, lastModified: lastModified}).versionID
+}
+
+func (m *memoryS3) get(bucket, key string) ([]byte, bool) {
+	object, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+	return object.data, true
+}
+
+func (m *memoryS3) keys(bucket, prefix string) []string {
+	var result []string
+	for path := range m.objects {
+		if strings.HasPrefix(path, bucket+"/"+prefix) {
+			result = append(result, strings.TrimPrefix(path, bucket+"/"))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func etag(data []byte) *string {
+	return aws.String(fmt.Sprintf(`"%x"`, md5.Sum(data)))
+}
+
+func (m *memoryS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	object := m.addVersion(*input.Bucket+"/"+*input.Key, &memoryObject{
+		data: data, metadata: input.Metadata, contentType: input.ContentType, tagging: aws.StringValue(input.Tagging),
+	})
+	return &s3.PutObjectOutput{ETag: etag(data), VersionId: aws.String(object.versionID)}, nil
+}
+
+// PutObjectRequest returns a request that puts the object when sent, for the s3manager uploader used by the S3 release store.
+func (m *memoryS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: "PutObject"}, input, output)
+	req.Handlers.Send.PushBack(func(r *request.Request) {
+		result, err := m.PutObject(input)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		*output = *result
+	})
+	return req, output
+}
+
+// object returns the current version of an object, or a specific version if versionID is set.
+func (m *memoryS3) object(bucket, key string, versionID *string) (*memoryObject, bool) {
+	if versionID == nil {
+		object, ok := m.objects[bucket+"/"+key]
+		return object, ok
+	}
+	for _, object := range m.versions[bucket+"/"+key] {
+		if object.versionID == *versionID && !object.deleteMarker {
+			return object, true
+		}
+	}
+	return nil, false
+}
+
+func (m *memoryS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	object, ok := m.object(*input.Bucket, *input.Key, input.VersionId)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(object.data)),
+		ContentLength: aws.Int64(int64(len(object.data))),
+		ContentType:   object.contentType,
+		ETag:          etag(object.data),
+		LastModified:  aws.Time(object.lastModified),
+		Metadata:      object.metadata,
+		VersionId:     aws.String(object.versionID),
+	}, nil
+}
+
+func (m *memoryS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	object, ok := m.object(*input.Bucket, *input.Key, input.VersionId)
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.data))),
+		ContentType:   object.contentType,
+		ETag:          etag(object.data),
+		LastModified:  aws.Time(object.lastModified),
+		Metadata:      object.metadata,
+		VersionId:     aws.String(object.versionID),
+	}, nil
+}
+
+func (m *memoryS3) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	object, ok := m.object(*input.Bucket, *input.Key, input.VersionId)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	values, err := url.ParseQuery(object.tagging)
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.GetObjectTaggingOutput{TagSet: []*s3.Tag{}}
+	for key := range values {
+		output.TagSet = append(output.TagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(values.Get(key))})
+	}
+	return output, nil
+}
+
+func (m *memoryS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	source, err := url.Parse(*input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(source.Path, "/", 2)
+	var versionID *string
+	if source.Query().Get("versionId") != "" {
+		versionID = aws.String(source.Query().Get("versionId"))
+	}
+	object, ok := m.object(parts[0], parts[1], versionID)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	metadata := object.metadata
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		metadata = input.Metadata
+	}
+	copied := m.addVersion(*input.Bucket+"/"+*input.Key, &memoryObject{data: object.data, metadata: metadata})
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &s3.CopyObjectResult{ETag: etag(copied.data), LastModified: aws.Time(copied.lastModified)},
+		VersionId:        aws.String(copied.versionID),
+	}, nil
+}
+
+func (m *memoryS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	path := *input.Bucket + "/" + *input.Key
+	if input.VersionId != nil {
+		var remaining []*memoryObject
+		for _, object := range m.versions[path] {
+			if object.versionID != *input.VersionId {
+				remaining = append(remaining, object)
+			}
+		}
+		m.versions[path] = remaining
+		delete(m.objects, path)
+		if len(remaining) > 0 && !remaining[len(remaining)-1].deleteMarker {
+			m.objects[path] = remaining[len(remaining)-1]
+		}
+		return &s3.DeleteObjectOutput{}, nil
+	}
+	if _, ok := m.objects[path]; ok {
+		m.addVersion(path, &memoryObject{deleteMarker: true})
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memoryS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	output := &s3.ListObjectsV2Output{}
+	seenPrefixes := make(map[string]bool)
+	for _, key := range m.keys(*input.Bucket, aws.StringValue(input.Prefix)) {
+		rest := strings.TrimPrefix(key, aws.StringValue(input.Prefix))
+		if input.Delimiter != nil {
+			if i := strings.Index(rest, *input.Delimiter); i >= 0 {
+				commonPrefix := aws.StringValue(input.Prefix) + rest[:i+1]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(commonPrefix)})
+				}
+				continue
+			}
+		}
+		object := m.objects[*input.Bucket+"/"+key]
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			ETag:         etag(object.data),
+			Size:         aws.Int64(int64(len(object.data))),
+			LastModified: aws.Time(object.lastModified),
+		})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m *memoryS3) ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	output := &s3.ListObjectVersionsOutput{}
+	var paths []string
+	for path := range m.versions {
+		if strings.HasPrefix(path, *input.Bucket+"/"+aws.StringValue(input.Prefix)) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		key := strings.TrimPrefix(path, *input.Bucket+"/")
+		versions := m.versions[path]
+		for i := len(versions) - 1; i >= 0; i-- {
+			object := versions[i]
+			if object.deleteMarker {
+				output.DeleteMarkers = append(output.DeleteMarkers, &s3.DeleteMarkerEntry{
+					Key:          aws.String(key),
+					VersionId:    aws.String(object.versionID),
+					IsLatest:     aws.Bool(i == len(versions)-1),
+					LastModified: aws.Time(object.lastModified),
+				})
+				continue
+			}
+			output.Versions = append(output.Versions, &s3.ObjectVersion{
+				Key:          aws.String(key),
+				VersionId:    aws.String(object.versionID),
+				IsLatest:     aws.Bool(i == len(versions)-1),
+				LastModified: aws.Time(object.lastModified),
+				Size:         aws.Int64(int64(len(object.data))),
+				ETag:         etag(object.data),
+			})
+		}
+	}
+	return output, nil
+}
+
+func (m *memoryS3) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	output, err := m.ListObjectVersions(input)
+	if err != nil {
+		return err
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m *memoryS3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	if input.ExpectedBucketOwner != nil && *input.ExpectedBucketOwner != m.owner {
+		return nil, awserr.New("AccessDenied", "access denied", nil)
+	}
+	for _, bucket := range m.buckets {
+		if bucket == *input.Bucket {
+			return &s3.HeadBucketOutput{}, nil
+		}
+	}
+	return nil, awserr.New("NotFound", "not found", nil)
+}
+
+func (m *memoryS3) CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
+	m.buckets = append(m.buckets, *input.Bucket)
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (m *memoryS3) PutBucketVersioning(*s3.PutBucketVersioningInput) (*s3.PutBucketVersioningOutput, error) {
+	return &s3.PutBucketVersioningOutput{}, nil
+}
+
+// s3ClientFactory returns a factory for handler.Opts serving the clients keyed by "<role ARN> <region>" (with an empty role when
+// none is assumed), failing the test for any other region or role.
+func s3ClientFactory(t *testing.T, clients map[string]s3iface.S3API) func(region, roleARN string) s3iface.S3API {
+	return func(region, roleARN string) s3iface.S3API {
+		client, ok := clients[roleARN+" "+region]
+		if !ok {
+			t.Fatalf("unexpected s3 client for region %q and role %q", region, roleARN)
+		}
+		return client
+	}
+}
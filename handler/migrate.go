@@ -0,0 +1,472 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// migratedPrefix is the prefix in the tfstate bucket of the markers written when a component's cutover to new buckets is made.
+const migratedPrefix = "cdflow2-migrated"
+
+// sourceETagMetadataKey is the metadata added to migrated objects recording the ETag of the object they were copied from, so
+// objects that have already been copied are skipped when a migration is resumed.
+const sourceETagMetadataKey = "cdflow2-source-etag"
+
+// MigrateRequest is the input to the migrate command.
+type MigrateRequest struct {
+	CommandRequest
+	// AllComponents migrates all of the team's components rather than just the one in the request.
+	AllComponents bool
+	// ReleaseBucket and TfstateBucket are the buckets to copy releases and state to.
+	ReleaseBucket string
+	TfstateBucket string
+	// Region is the region of the destination buckets, the default region if not set.
+	Region string
+	// RoleARN is a role to assume to access the destination buckets, e.g. in another account.
+	RoleARN string
+	// Cutover stops deployments using the source buckets once the copy is complete.
+	Cutover bool
+	// AllowPartial allows the cutover when some state is not migrated, because it is in buckets from config.params.environments.
+	AllowPartial bool
+}
+
+// migrationMarker is written to the source tfstate bucket by the cutover, and stops deployments from using the source buckets.
+type migrationMarker struct {
+	Team          string    `json:"team"`
+	Component     string    `json:"component"`
+	ReleaseBucket string    `json:"release_bucket"`
+	TfstateBucket string    `json:"tfstate_bucket"`
+	Region        string    `json:"region"`
+	RoleARN       string    `json:"role_arn,omitempty"`
+	Caller        string    `json:"caller,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+func migrationMarkerKey(team, component string) string {
+	return fmt.Sprintf("%s/%s/%s.json", migratedPrefix, team, component)
+}
+
+// migrationObject is an object to be copied to the destination bucket.
+type migrationObject struct {
+	client s3iface.S3API
+	bucket string
+	key    string
+	// dest is the bucket the object is copied to.
+	dest string
+}
+
+func metadataValue(metadata map[string]*string, key string) string {
+	for name, value := range metadata {
+		if strings.EqualFold(name, key) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+func listKeys(client s3iface.S3API, bucket, prefix string) ([]string, error) {
+	var result []string
+	if err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			result = append(result, aws.StringValue(object.Key))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func listSubPrefixes(client s3iface.S3API, bucket, prefix string) ([]string, error) {
+	var result []string
+	if err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range output.CommonPrefixes {
+			result = append(result, strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), prefix), "/"))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// listTeamComponents returns the components of a team with releases or deployment records.
+func (h *Handler) listTeamComponents(releaseStore *s3ReleaseStore, team string) ([]string, error) {
+	components := make(map[string]bool)
+	released, err := listSubPrefixes(releaseStore.client, releaseStore.bucket, team+"/")
+	if err != nil {
+		return nil, err
+	}
+	deployed, err := listSubPrefixes(h.getS3Client(), h.tfstateBucket, fmt.Sprintf("%s/%s/", deploymentsPrefix, team))
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range append(released, deployed...) {
+		components[component] = true
+	}
+	var result []string
+	for component := range components {
+		result = append(result, component)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// listMigrationObjects returns a component's releases, terraform state and deployment records. State in buckets other than the
+// default tfstate bucket (from config.params.environments) is not migrated, and the cutover is refused unless AllowPartial is set.
+func (h *Handler) listMigrationObjects(
+	request *MigrateRequest, releaseStore *s3ReleaseStore, team, component string,
+) ([]*migrationObject, []*componentState, error) {
+	var result []*migrationObject
+	add := func(client s3iface.S3API, bucket, dest string, keys ...string) {
+		for _, key := range keys {
+			result = append(result, &migrationObject{client: client, bucket: bucket, key: key, dest: dest})
+		}
+	}
+	releases, err := listKeys(releaseStore.client, releaseStore.bucket, fmt.Sprintf("%s/%s/", team, component))
+	if err != nil {
+		return nil, nil, err
+	}
+	add(releaseStore.client, releaseStore.bucket, request.ReleaseBucket, releases...)
+
+	targets, err := h.listComponentTargets(request.Config, team, component)
+	if err != nil {
+		return nil, nil, err
+	}
+	var states []*componentState
+	var skipped []string
+	for _, target := range targets {
+		backend, env := target.backend, target.env
+		if backend.bucket != h.tfstateBucket {
+			style := h.styles.warningCross
+			if request.Cutover && !request.AllowPartial {
+				style = h.styles.cross
+			}
+			fmt.Fprintf(h.ErrorStream, "  %s not migrating state for %s in s3://%s (config.params.environments.%s)\n", style, target.name(), backend.bucket, env)
+			skipped = append(skipped, target.name())
+			continue
+		}
+		exists, err := h.stateExists(backend, env)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			add(h.getStateS3Client(backend), backend.bucket, request.TfstateBucket, backend.stateKey(env))
+		}
+		states = append(states, target)
+	}
+
+	if len(skipped) > 0 && request.Cutover && !request.AllowPartial {
+		return nil, nil, fmt.Errorf(
+			"the terraform state for %s is not migrated - migrate it separately, and use -allow-partial for the cutover",
+			strings.Join(skipped, ", "),
+		)
+	}
+
+	records, err := listKeys(h.getS3Client(), h.tfstateBucket, deploymentsComponentPrefix(team, component))
+	if err != nil {
+		return nil, nil, err
+	}
+	add(h.getS3Client(), h.tfstateBucket, request.TfstateBucket, records...)
+	return result, states, nil
+}
+
+// copy copies the current version of an object to the destination bucket with its metadata and tags, unless it has already been
+// copied. The content is checked against the source ETag, and sent with its MD5 so that S3 rejects a corrupted upload. Returns true
+// if the object was copied.
+func (o *migrationObject) copy(dest s3iface.S3API) (bool, error) {
+	source, err := o.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)})
+	if err != nil {
+		return false, err
+	}
+	sourceETag := strings.Trim(aws.StringValue(source.ETag), `"`)
+	existing, err := dest.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(o.dest), Key: aws.String(o.key)})
+	if err == nil && metadataValue(existing.Metadata, sourceETagMetadataKey) == sourceETag {
+		return false, nil
+	}
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+
+	input := &s3.GetObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)}
+	if source.VersionId != nil {
+		input.VersionId = source.VersionId
+	}
+	object, err := o.client.GetObject(input)
+	if err != nil {
+		return false, err
+	}
+	defer object.Body.Close()
+	file, err := ioutil.TempFile("", "cdflow2-migrate-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), object.Body)
+	if err != nil {
+		return false, err
+	}
+	digest := hash.Sum(nil)
+	if md5ETag.MatchString(sourceETag) && fmt.Sprintf("%x", digest) != sourceETag {
+		return false, fmt.Errorf("downloaded content does not match its ETag %s", sourceETag)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	metadata := make(map[string]*string)
+	for name, value := range source.Metadata {
+		if !strings.EqualFold(name, sourceETagMetadataKey) {
+			metadata[name] = value
+		}
+	}
+	metadata[sourceETagMetadataKey] = aws.String(sourceETag)
+	putInput := &s3.PutObjectInput{
+		Bucket:      aws.String(o.dest),
+		Key:         aws.String(o.key),
+		Body:        file,
+		ContentMD5:  aws.String(base64.StdEncoding.EncodeToString(digest)),
+		ContentType: source.ContentType,
+		Metadata:    metadata,
+	}
+	tagging, err := o.client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)})
+	if err != nil {
+		return false, err
+	}
+	if len(tagging.TagSet) > 0 {
+		values := url.Values{}
+		for _, tag := range tagging.TagSet {
+			values.Set(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+		}
+		putInput.Tagging = aws.String(values.Encode())
+	}
+	if _, err := dest.PutObject(putInput); err != nil {
+		return false, err
+	}
+
+	copied, err := dest.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(o.dest), Key: aws.String(o.key)})
+	if err != nil {
+		return false, fmt.Errorf("unable to verify copy: %v", err)
+	}
+	copiedETag := strings.Trim(aws.StringValue(copied.ETag), `"`)
+	if aws.Int64Value(copied.ContentLength) != size || (md5ETag.MatchString(copiedETag) && copiedETag != fmt.Sprintf("%x", digest)) {
+		return false, fmt.Errorf("copy does not match the source (%d bytes with ETag %s, expected %d bytes with MD5 %x)", aws.Int64Value(copied.ContentLength), copiedETag, size, digest)
+	}
+	return true, nil
+}
+
+// verify returns an error unless the current version of the object has been copied to the destination bucket.
+func (o *migrationObject) verify(dest s3iface.S3API) error {
+	source, err := o.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)})
+	if err != nil {
+		return err
+	}
+	copied, err := dest.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(o.dest), Key: aws.String(o.key)})
+	if err != nil {
+		return err
+	}
+	if metadataValue(copied.Metadata, sourceETagMetadataKey) != strings.Trim(aws.StringValue(source.ETag), `"`) ||
+		aws.Int64Value(copied.ContentLength) != aws.Int64Value(source.ContentLength) {
+		return fmt.Errorf("s3://%s/%s has changed since it was copied", o.bucket, o.key)
+	}
+	return nil
+}
+
+// checkMigrated returns an error if the component has been migrated to other buckets by the migrate command's cutover.
+func (h *Handler) checkMigrated(team, component string) error {
+	output, err := h.getS3Client().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(h.tfstateBucket),
+		Key:    aws.String(migrationMarkerKey(team, component)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to check whether %s has been migrated: %v", component, err)
+	}
+	defer output.Body.Close()
+	var marker migrationMarker
+	if err := json.NewDecoder(output.Body).Decode(&marker); err != nil {
+		return fmt.Errorf("invalid migration marker s3://%s/%s: %v", h.tfstateBucket, migrationMarkerKey(team, component), err)
+	}
+	fmt.Fprintf(
+		h.ErrorStream, "  %s %s was migrated to s3://%s and s3://%s (%s) at %s\n", h.styles.cross, component,
+		marker.ReleaseBucket, marker.TfstateBucket, marker.Region, marker.Time.UTC().Format("2006-01-02 15:04:05 MST"),
+	)
+	return fmt.Errorf(
+		"\nRefusing to use s3://%s for %s, which has been migrated to new buckets. Use credentials for the account the buckets were migrated to.",
+		h.tfstateBucket, component,
+	)
+}
+
+func (h *Handler) writeMigrationMarker(request *MigrateRequest, team, component string) error {
+	data, err := json.MarshalIndent(&migrationMarker{
+		Team:          team,
+		Component:     component,
+		ReleaseBucket: request.ReleaseBucket,
+		TfstateBucket: request.TfstateBucket,
+		Region:        request.Region,
+		RoleARN:       request.RoleARN,
+		Caller:        aws.StringValue(h.getCallerIdentity().Arn),
+		Time:          time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = h.getS3Client().PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(h.tfstateBucket),
+		Key:         aws.String(migrationMarkerKey(team, component)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// migrateComponent copies a component's objects, and with a cutover stops deployments using the source buckets and checks that
+// nothing changed while copying.
+func (h *Handler) migrateComponent(request *MigrateRequest, releaseStore *s3ReleaseStore, dest s3iface.S3API, team, component string) error {
+	fmt.Fprintf(h.ErrorStream, "\n%s\n\n", h.styles.au.Underline("Migrating "+component+"..."))
+	objects, states, err := h.listMigrationObjects(request, releaseStore, team, component)
+	if err != nil {
+		return fmt.Errorf("unable to migrate %s: %v", component, err)
+	}
+	checkLocks := func() error {
+		for _, state := range states {
+			locks, err := h.getStateLocks(state.backend, state.env)
+			if err != nil {
+				return fmt.Errorf("unable to check for a lock on the terraform state for %s: %v", state.name(), err)
+			}
+			for _, lock := range locks {
+				fmt.Fprintf(h.ErrorStream, "  %s terraform state for %s is ", h.styles.cross, state.name())
+				h.printStateLock(lock, "")
+				return fmt.Errorf("the terraform state for %s is locked - wait for the deployment to finish before the cutover", state.name())
+			}
+		}
+		return nil
+	}
+	if request.Cutover {
+		if err := checkLocks(); err != nil {
+			return err
+		}
+		if err := h.writeMigrationMarker(request, team, component); err != nil {
+			return fmt.Errorf("unable to stop deployments of %s from the source buckets: %v", component, err)
+		}
+		fmt.Fprintf(h.ErrorStream, "  %s stopped deployments of %s using s3://%s\n", h.styles.tick, component, h.tfstateBucket)
+		// a deployment may have started before the marker was written, so the state is checked again before it is copied
+		if err := checkLocks(); err != nil {
+			return err
+		}
+	}
+	copied := 0
+	for _, object := range objects {
+		ok, err := object.copy(dest)
+		if err != nil {
+			return fmt.Errorf("unable to copy s3://%s/%s to s3://%s: %v", object.bucket, object.key, object.dest, err)
+		}
+		if ok {
+			copied++
+			fmt.Fprintf(h.ErrorStream, "  %s copied s3://%s/%s to s3://%s\n", h.styles.tick, object.bucket, object.key, object.dest)
+		}
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s %d objects copied, %d already up to date\n", h.styles.tick, copied, len(objects)-copied)
+	if !request.Cutover {
+		return nil
+	}
+	for _, object := range objects {
+		if err := object.verify(dest); err != nil {
+			return fmt.Errorf("unable to verify s3://%s/%s was copied: %v", object.bucket, object.key, err)
+		}
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s verified %d objects in the destination buckets\n", h.styles.tick, len(objects))
+	return nil
+}
+
+// Migrate copies a component's releases, terraform state and deployment records to new buckets, e.g. in another account. The
+// source is left untouched, so it can be run repeatedly until the cutover, which stops deployments using the source buckets.
+func (h *Handler) Migrate(request *MigrateRequest) error {
+	if request.ReleaseBucket == "" || request.TfstateBucket == "" {
+		fmt.Fprintln(h.ErrorStream, "the release and tfstate buckets to migrate to must be specified")
+		return Exit(false)
+	}
+	var team string
+	var err error
+	if request.AllComponents {
+		team, err = h.prepareTeamCommand(&request.CommandRequest)
+	} else {
+		team, err = h.prepareCommand(&request.CommandRequest)
+	}
+	if err != nil {
+		return err
+	}
+	releaseStore, ok := h.releaseStore.(*s3ReleaseStore)
+	if !ok {
+		fmt.Fprintln(h.ErrorStream, "releases can only be migrated from an s3 release store")
+		return Exit(false)
+	}
+	if request.Region == "" {
+		request.Region = h.defaultRegion
+	}
+	dest := h.getStateS3Client(&stateBackend{region: request.Region, roleARN: request.RoleARN})
+	for _, bucket := range []string{request.ReleaseBucket, request.TfstateBucket} {
+		if _, err := dest.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			fmt.Fprintf(h.ErrorStream, "  %s unable to access s3://%s: %v\n", h.styles.cross, bucket, err)
+			return Exit(false)
+		}
+	}
+	// deployments find the tfstate bucket in the account by its prefix, so can't use a second one in the same account - and the
+	// marker the cutover writes to the source bucket would refuse them
+	if _, err := dest.HeadBucket(&s3.HeadBucketInput{
+		Bucket:              aws.String(request.TfstateBucket),
+		ExpectedBucketOwner: aws.String(h.getAccountID()),
+	}); err == nil {
+		fmt.Fprintf(
+			h.ErrorStream, "  %s s3://%s is in the same account (%s) as s3://%s\n\nRefusing to migrate within an account, as "+
+				"deployments use the only cdflow2-tfstate-... bucket in the account - migrate to buckets in another account.\n",
+			h.styles.cross, request.TfstateBucket, h.getAccountID(), h.tfstateBucket,
+		)
+		return Exit(false)
+	}
+
+	components := []string{request.Component}
+	if request.AllComponents {
+		if components, err = h.listTeamComponents(releaseStore, team); err != nil {
+			fmt.Fprintf(h.ErrorStream, "Unable to list components: %v\n", err)
+			return Exit(false)
+		}
+	}
+	for _, component := range components {
+		if err := h.migrateComponent(request, releaseStore, dest, team, component); err != nil {
+			fmt.Fprintf(h.ErrorStream, "\n%v\n", err)
+			return Exit(false)
+		}
+	}
+	if request.Cutover {
+		fmt.Fprintf(h.ErrorStream, "\n%s Cutover complete - deploy with credentials for the account of s3://%s.\n", h.styles.tick, request.TfstateBucket)
+	} else {
+		fmt.Fprintf(h.ErrorStream, "\n%s Copy complete - run again with -cutover to stop deployments using the source buckets.\n", h.styles.tick)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestMigrate(t *testing.T) {
+	releaseKey := "my-team/my-component/my-component-1.zip"
+	setup := func(t *testing.T) (*handler.Handler, *memoryS3, *memoryS3, *memoryDynamoDB, *bytes.Buffer) {
+		source := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+		if _, err := source.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String("cdflow2-release-bucket-1"),
+			Key:         aws.String(releaseKey),
+			Body:        strings.NewReader("release 1"),
+			ContentType: aws.String("application/zip"),
+			Metadata:    map[string]*string{"Version": aws.String("1")},
+			Tagging:     aws.String("version=1"),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		source.put("cdflow2-release-bucket-1", "my-team/other/other-1.zip", []byte("other release"))
+		source.put("cdflow2-tfstate-bucket-1", liveStateKey, []byte(emptyState))
+		putDeploymentRecord(source, "live", "1", time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC))
+		dest := newMemoryS3("new-release-bucket", "new-tfstate-bucket")
+		dest.owner = "210987654321"
+		dynamoDBClient := newMemoryDynamoDB()
+		var errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             source,
+			S3ClientFactory:      s3ClientFactory(t, map[string]s3iface.S3API{"arn:aws:iam::210987654321:role/migrate eu-west-1": dest}),
+			DynamoDBClient:       dynamoDBClient,
+			ECRClient:            &memoryECR{},
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			OutputStream:         &bytes.Buffer{},
+			ErrorStream:          &errorBuffer,
+		}), source, dest, dynamoDBClient, &errorBuffer
+	}
+	request := func(cutover bool) *handler.MigrateRequest {
+		return &handler.MigrateRequest{
+			CommandRequest: commandRequest(),
+			ReleaseBucket:  "new-release-bucket",
+			TfstateBucket:  "new-tfstate-bucket",
+			RoleARN:        "arn:aws:iam::210987654321:role/migrate",
+			Cutover:        cutover,
+		}
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		// Given
+		myHandler, source, dest, _, errorBuffer := setup(t)
+
+		// When
+		err := myHandler.Migrate(request(false))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if keys := dest.keys("new-release-bucket", ""); strings.Join(keys, ",") != releaseKey {
+			t.Fatalf("expected only the component's release to be copied, got %v", keys)
+		}
+		if keys := dest.keys("new-tfstate-bucket", ""); len(keys) != 2 || keys[1] != liveStateKey {
+			t.Fatalf("expected the state and deployment record to be copied, got %v", keys)
+		}
+		release, err := dest.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("new-release-bucket"), Key: aws.String(releaseKey)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aws.StringValue(release.ContentType) != "application/zip" || aws.StringValue(release.Metadata["Version"]) != "1" {
+			t.Fatalf("expected content type and metadata to be preserved, got %v %v", aws.StringValue(release.ContentType), release.Metadata)
+		}
+		tagging, _ := dest.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String("new-release-bucket"), Key: aws.String(releaseKey)})
+		if len(tagging.TagSet) != 1 || aws.StringValue(tagging.TagSet[0].Value) != "1" {
+			t.Fatalf("expected tags to be preserved, got %v", tagging.TagSet)
+		}
+		if data, ok := source.get("cdflow2-release-bucket-1", releaseKey); !ok || string(data) != "release 1" {
+			t.Fatal("expected the source to be untouched")
+		}
+		if keys := source.keys("cdflow2-tfstate-bucket-1", "cdflow2-migrated/"); len(keys) != 0 {
+			t.Fatalf("expected no migration marker before the cutover, got %v", keys)
+		}
+		if !strings.Contains(errorBuffer.String(), "3 objects copied, 0 already up to date") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		// Given
+		myHandler, source, dest, _, errorBuffer := setup(t)
+		if err := myHandler.Migrate(request(false)); err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		source.put("cdflow2-tfstate-bucket-1", liveStateKey, []byte(`{"version": 4, "serial": 13, "resources": []}`))
+		errorBuffer.Reset()
+
+		// When
+		err := myHandler.Migrate(request(false))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if !strings.Contains(errorBuffer.String(), "1 objects copied, 2 already up to date") {
+			t.Fatalf("expected only the changed state to be copied, got: %q", errorBuffer.String())
+		}
+		if data, _ := dest.get("new-tfstate-bucket", liveStateKey); !strings.Contains(string(data), `"serial": 13`) {
+			t.Fatalf("expected the current state to be copied, got %s", data)
+		}
+	})
+
+	t.Run("cutover", func(t *testing.T) {
+		// Given
+		myHandler, source, _, _, errorBuffer := setup(t)
+
+		// When
+		err := myHandler.Migrate(request(true))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if _, ok := source.get("cdflow2-tfstate-bucket-1", "cdflow2-migrated/my-team/my-component.json"); !ok {
+			t.Fatal("expected migration marker to be written")
+		}
+		if !strings.Contains(errorBuffer.String(), "verified 3 objects in the destination buckets") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+		response, output := prepareTerraform(t, handler.Opts{S3Client: source}, "", nil, nil)
+		if response.Success || !strings.Contains(output, "which has been migrated to new buckets") {
+			t.Fatalf("expected deployments from the source buckets to be refused, got: %q", output)
+		}
+		var releaseErrors bytes.Buffer
+		configureReleaseRequest := common.CreateConfigureReleaseRequest()
+		configureReleaseRequest.Component = "my-component"
+		configureReleaseRequest.Version = "2"
+		configureReleaseRequest.Config = commandRequest().Config
+		configureReleaseRequest.Env = commandRequest().Env
+		configureReleaseResponse := common.CreateConfigureReleaseResponse()
+		releaseHandler := testHandler(handler.Opts{S3Client: source, ErrorStream: &releaseErrors})
+		if err := releaseHandler.ConfigureRelease(configureReleaseRequest, configureReleaseResponse); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if configureReleaseResponse.Success || !strings.Contains(releaseErrors.String(), "which has been migrated to new buckets") {
+			t.Fatalf("expected releases to the source buckets to be refused, got: %q", releaseErrors.String())
+		}
+	})
+
+	t.Run("partial cutover", func(t *testing.T) {
+		for _, allowPartial := range []bool{false, true} {
+			// Given
+			myHandler, source, _, _, errorBuffer := setup(t)
+			migrateRequest := request(true)
+			migrateRequest.AllowPartial = allowPartial
+			migrateRequest.Config["environments"] = map[string]interface{}{
+				"prod": map[string]interface{}{"tfstate_bucket": "my-prod-tfstate"},
+			}
+
+			// When
+			err := myHandler.Migrate(migrateRequest)
+
+			// Then
+			_, marked := source.get("cdflow2-tfstate-bucket-1", "cdflow2-migrated/my-team/my-component.json")
+			if allowPartial {
+				if err != nil || !marked {
+					t.Fatal("expected cutover with -allow-partial, got:", err, errorBuffer.String())
+				}
+				continue
+			}
+			if err != handler.Exit(false) || marked {
+				t.Fatal("expected cutover to be refused, got:", err, errorBuffer.String())
+			}
+			if !strings.Contains(errorBuffer.String(), "the terraform state for prod is not migrated - migrate it separately, and use -allow-partial") {
+				t.Fatalf("unexpected output: %q", errorBuffer.String())
+			}
+		}
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		// Given
+		myHandler, source, _, dynamoDBClient, errorBuffer := setup(t)
+		dynamoDBClient.put("cdflow2-tflocks", "cdflow2-tfstate-bucket-1/"+liveStateKey, map[string]*dynamodb.AttributeValue{
+			"Info": {S: aws.String(liveLockInfo)},
+		})
+
+		// When
+		err := myHandler.Migrate(request(true))
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		if _, ok := source.get("cdflow2-tfstate-bucket-1", "cdflow2-migrated/my-team/my-component.json"); ok {
+			t.Fatal("expected no migration marker while the state is locked")
+		}
+		if !strings.Contains(errorBuffer.String(), "the terraform state for live is locked") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+	})
+
+	t.Run("same account", func(t *testing.T) {
+		// Given
+		myHandler, source, dest, _, errorBuffer := setup(t)
+		dest.owner = "123456789012"
+
+		// When
+		err := myHandler.Migrate(request(true))
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected failure, got:", err)
+		}
+		if !strings.Contains(errorBuffer.String(), "s3://new-tfstate-bucket is in the same account (123456789012) as s3://cdflow2-tfstate-bucket-1") ||
+			!strings.Contains(errorBuffer.String(), "Refusing to migrate within an account") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+		if _, ok := source.get("cdflow2-tfstate-bucket-1", "cdflow2-migrated/my-team/my-component.json"); ok {
+			t.Fatal("expected no migration marker")
+		}
+		if keys := dest.keys("new-tfstate-bucket", ""); len(keys) != 0 {
+			t.Fatalf("expected nothing to be copied, got %v", keys)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// permissionDecision is the result of simulating the caller's policies for an action on a resource.
+type permissionDecision struct {
+	action   string
+	resource string
+	decision string
+}
+
+func (d *permissionDecision) allowed() bool {
+	return d.decision == iam.PolicyEvaluationDecisionTypeAllowed
+}
+
+func (d *permissionDecision) String() string {
+	switch d.decision {
+	case iam.PolicyEvaluationDecisionTypeAllowed:
+		return "allowed"
+	case iam.PolicyEvaluationDecisionTypeExplicitDeny:
+		return "denied (explicit deny)"
+	default:
+		return "denied"
+	}
+}
+
+// getPreflight returns whether config.params.preflight enables the check for a phase - only setup by default, every phase when true,
+// no phase when false, or the phases in a list (e.g. [setup, release]).
+func getPreflight(config map[string]interface{}, phase string) (bool, error) {
+	switch raw := config["preflight"].(type) {
+	case nil:
+		return phase == "setup", nil
+	case bool:
+		return raw, nil
+	case []interface{}:
+		enabled := false
+		for _, item := range raw {
+			itemString, ok := item.(string)
+			if !ok || !containsString(iamPolicyPhases, itemString) {
+				return false, fmt.Errorf("config.params.preflight phases must be one of %s", strings.Join(iamPolicyPhases, ", "))
+			}
+			enabled = enabled || itemString == phase
+		}
+		return enabled, nil
+	default:
+		return false, fmt.Errorf("config.params.preflight must be true, false or a list of phases")
+	}
+}
+
+// principalARN returns the ARN of the IAM user or role the AWS credentials are for, which policies can be simulated for - or an
+// empty string for other principals (e.g. the root user or a federated user).
+func (h *Handler) principalARN() string {
+	callerARN := aws.StringValue(h.getCallerIdentity().Arn)
+	parts := strings.SplitN(callerARN, ":", 6)
+	if len(parts) != 6 {
+		return ""
+	}
+	partition, service, accountID, resource := parts[1], parts[2], parts[4], parts[5]
+	if service == "iam" && strings.HasPrefix(resource, "user/") {
+		return callerARN
+	}
+	if service != "sts" || !strings.HasPrefix(resource, "assumed-role/") {
+		return ""
+	}
+	roleName := strings.Split(resource, "/")[1]
+	// the role's path isn't part of the assumed role ARN, so the role is looked up, falling back to a role without a path
+	if output, err := h.getIAMClient().GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)}); err == nil {
+		return aws.StringValue(output.Role.Arn)
+	}
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, accountID, roleName)
+}
+
+// simulatePermissions returns the decision for each action and resource in the statements of a policy, simulated against the
+// principal's policies.
+func (h *Handler) simulatePermissions(principal string, document *iamPolicyDocument) ([]*permissionDecision, error) {
+	var result []*permissionDecision
+	for _, statement := range document.Statement {
+		input := &iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principal),
+			ActionNames:     aws.StringSlice(statement.Action),
+		}
+		if len(statement.Resource) != 1 || statement.Resource[0] != "*" {
+			input.ResourceArns = aws.StringSlice(statement.Resource)
+		}
+		if err := h.getIAMClient().SimulatePrincipalPolicyPages(input, func(output *iam.SimulatePolicyResponse, lastPage bool) bool {
+			for _, evaluation := range output.EvaluationResults {
+				if len(evaluation.ResourceSpecificResults) == 0 {
+					result = append(result, &permissionDecision{
+						action:   aws.StringValue(evaluation.EvalActionName),
+						resource: aws.StringValue(evaluation.EvalResourceName),
+						decision: aws.StringValue(evaluation.EvalDecision),
+					})
+					continue
+				}
+				for _, resourceResult := range evaluation.ResourceSpecificResults {
+					result = append(result, &permissionDecision{
+						action:   aws.StringValue(evaluation.EvalActionName),
+						resource: aws.StringValue(resourceResult.EvalResourceName),
+						decision: aws.StringValue(resourceResult.EvalResourceDecision),
+					})
+				}
+			}
+			return true
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (h *Handler) printPermissionDecisions(decisions []*permissionDecision) {
+	writer := tabwriter.NewWriter(h.ErrorStream, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "  ACTION\tRESOURCE\tDECISION")
+	for _, decision := range decisions {
+		fmt.Fprintf(writer, "  %s\t%s\t%s\n", decision.action, decision.resource, decision)
+	}
+	writer.Flush()
+}
+
+// checkPermissions simulates the caller's policies for the API calls made in a phase (those in the iam-policy command's policy, less
+// the state resources only accessed by assuming a backend role), so that missing permissions are reported before anything is created. The table of decisions is always output by setup, and otherwise
+// only when an action is denied. If the policies can't be simulated (e.g. without iam:SimulatePrincipalPolicy) a warning is output
+// and the check passes.
+func (h *Handler) checkPermissions(config map[string]interface{}, team, component, phase string) bool {
+	enabled, err := getPreflight(config, phase)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s %v\n\n", h.styles.cross, err)
+		return false
+	}
+	if !enabled {
+		return true
+	}
+	fmt.Fprintf(h.ErrorStream, "%s\n\n", h.styles.au.Underline("Checking AWS permissions..."))
+	principal := h.principalARN()
+	if principal == "" {
+		fmt.Fprintf(
+			h.ErrorStream, "  %s unable to check permissions for %s, which is not an IAM user or role\n\n",
+			h.styles.warningCross, aws.StringValue(h.getCallerIdentity().Arn),
+		)
+		return true
+	}
+	scope, err := h.getIAMPolicyScope(config, team, component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s unable to find resources to check permissions for: %v\n\n", h.styles.warningCross, err)
+		return true
+	}
+	decisions, err := h.simulatePermissions(principal, scope.callerPolicyDocument(phase))
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s unable to check permissions for %s: %v\n\n", h.styles.warningCross, principal, err)
+		return true
+	}
+	denied := 0
+	for _, decision := range decisions {
+		if !decision.allowed() {
+			denied++
+		}
+	}
+	if phase == "setup" || denied > 0 {
+		h.printPermissionDecisions(decisions)
+		fmt.Fprintln(h.ErrorStream, "")
+	}
+	if denied > 0 {
+		fmt.Fprintf(
+			h.ErrorStream, "  %s %d of %d actions needed for %s are denied for %s\n\n", h.styles.cross, denied, len(decisions), phase, principal,
+		)
+		fmt.Fprintf(
+			h.ErrorStream,
+			"Grant the denied actions (the iam-policy command outputs a policy for the %s phase), or change config.params.preflight to skip this check.\n\n",
+			phase,
+		)
+		return false
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s %d actions needed for %s are allowed for %s\n\n", h.styles.tick, len(decisions), phase, principal)
+	return true
+}
@@ -0,0 +1,198 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// accessDeniedDynamoDB denies every call.
+type accessDeniedDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (accessDeniedDynamoDB) DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "not authorized to perform: dynamodb:DescribeTable", nil)
+}
+
+// squashSpaces replaces runs of whitespace with a single space, so that table rows can be matched regardless of column widths.
+func squashSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func TestSetupPreflight(t *testing.T) {
+	t.Run("denied", func(t *testing.T) {
+		// Given
+		s3Client := newMemoryS3()
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{
+			S3Client:       s3Client,
+			DynamoDBClient: &tablesDynamoDB{tables: map[string]bool{}},
+			IAMClient:      mockedIAM{denied: []string{"dynamodb:CreateTable"}},
+			ErrorStream:    &errorBuffer,
+		})
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(setupRequest(), response)
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if response.Success {
+			t.Fatal("expected setup to fail")
+		}
+		output := squashSpaces(errorBuffer.String())
+		for _, expected := range []string{
+			"s3:CreateBucket arn:aws:s3:::cdflow2-release-*",
+			"dynamodb:CreateTable arn:aws:dynamodb:eu-west-1:123456789012:table/cdflow2-tflocks denied",
+			"1 of ",
+			" actions needed for setup are denied for arn:aws:iam::123456789012:role/ci/deploy",
+		} {
+			if !strings.Contains(output, expected) {
+				t.Fatalf("expected %q in output: %s", expected, output)
+			}
+		}
+		if buckets, _ := s3Client.ListBuckets(nil); len(buckets.Buckets) != 0 {
+			t.Fatalf("expected nothing to be created, got buckets %v", buckets.Buckets)
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		// Given
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{S3Client: newMemoryS3(), DynamoDBClient: &tablesDynamoDB{tables: map[string]bool{}}, ErrorStream: &errorBuffer})
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(setupRequest(), response)
+
+		// Then
+		if err != nil || !response.Success {
+			t.Fatal("unexpected failure:", err, errorBuffer.String())
+		}
+		if !strings.Contains(squashSpaces(errorBuffer.String()), "dynamodb:CreateTable arn:aws:dynamodb:eu-west-1:123456789012:table/cdflow2-tflocks allowed") {
+			t.Fatalf("expected table of allowed actions, got: %s", errorBuffer.String())
+		}
+	})
+
+	t.Run("unable to describe lock table", func(t *testing.T) {
+		// Given
+		var errorBuffer bytes.Buffer
+		myHandler := testHandler(handler.Opts{S3Client: newMemoryS3(), DynamoDBClient: accessDeniedDynamoDB{}, ErrorStream: &errorBuffer})
+		request := setupRequest()
+		request.Config["preflight"] = false
+		response := common.CreateSetupResponse()
+
+		// When
+		err := myHandler.Setup(request, response)
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if response.Success {
+			t.Fatal("expected setup to fail")
+		}
+		if !strings.Contains(errorBuffer.String(), "unable to describe dynamodb table cdflow2-tflocks: AccessDeniedException") {
+			t.Fatalf("unexpected output: %s", errorBuffer.String())
+		}
+		if strings.Contains(errorBuffer.String(), "Checking AWS permissions") {
+			t.Fatalf("expected no preflight when disabled, got: %s", errorBuffer.String())
+		}
+	})
+}
+
+func TestPrepareTerraformPreflight(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		preflight interface{}
+		denied    []string
+		success   bool
+		expected  string
+	}{
+		{"allowed", true, nil, true, " actions needed for deploy are allowed for arn:aws:iam::123456789012:role/ci/deploy"},
+		{
+			"denied", true, []string{"dynamodb:PutItem"}, false,
+			"dynamodb:PutItem arn:aws:dynamodb:eu-west-1:123456789012:table/cdflow2-tflocks denied",
+		},
+		{
+			"enabled for deploy", []interface{}{"setup", "deploy"}, []string{"dynamodb:PutItem"}, false,
+			"dynamodb:PutItem arn:aws:dynamodb:eu-west-1:123456789012:table/cdflow2-tflocks denied",
+		},
+		{"setup only by default", nil, []string{"dynamodb:PutItem"}, true, "terraform state"},
+		{"enabled for other phases", []interface{}{"setup", "release"}, []string{"dynamodb:PutItem"}, true, "terraform state"},
+		{"invalid phase", []interface{}{"deploy", "destroy"}, nil, false, "config.params.preflight phases must be one of setup, release, deploy"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			var errorBuffer bytes.Buffer
+			myHandler := testHandler(handler.Opts{IAMClient: mockedIAM{denied: test.denied}, ErrorStream: &errorBuffer})
+			request := prepareTerraformRequest("live", "")
+			if test.preflight != nil {
+				request.Config["preflight"] = test.preflight
+			}
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Success != test.success || !strings.Contains(squashSpaces(errorBuffer.String()), test.expected) {
+				t.Fatalf("expected success %v with %q, got %v with output: %s", test.success, test.expected, response.Success, errorBuffer.String())
+			}
+			if test.success && strings.Contains(errorBuffer.String(), "DECISION") {
+				t.Fatalf("expected no table when all actions are allowed, got: %s", errorBuffer.String())
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformPreflightBackendRole(t *testing.T) {
+	// Given
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"),
+		DynamoDBClient:       &tablesDynamoDB{tables: map[string]bool{"cdflow2-tflocks": true}},
+		ECRClient:            mockedECR{},
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		// the lock table is only accessed with the backend role, so the caller needs no access to it
+		IAMClient: mockedIAM{denied: []string{"dynamodb:GetItem", "dynamodb:PutItem", "dynamodb:DeleteItem"}},
+		S3ClientFactory: s3ClientFactory(t, map[string]s3iface.S3API{
+			"arn:aws:iam::123456789012:role/tfstate eu-west-1": newMemoryS3("cdflow2-tfstate-bucket-1"),
+		}),
+		DynamoDBClientFactory: dynamoDBClientFactory(t, map[string]dynamodbiface.DynamoDBAPI{
+			"arn:aws:iam::123456789012:role/tfstate eu-west-1": newMemoryDynamoDB(),
+		}),
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+	})
+	request := prepareTerraformRequest("live", "")
+	request.Config["preflight"] = true
+	request.Config["backend"] = map[string]interface{}{"role_arn": "arn:aws:iam::123456789012:role/tfstate"}
+	response := common.CreatePrepareTerraformResponse()
+
+	// When
+	err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+	}
+	if !strings.Contains(errorBuffer.String(), " actions needed for deploy are allowed") {
+		t.Fatalf("expected preflight to pass, got: %s", errorBuffer.String())
+	}
+}
@@ -1,10 +1,12 @@
 package handler
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sts"
 	common "github.com/mergermarket/cdflow2-config-common"
 )
@@ -19,7 +21,7 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 
 	response.Monitoring.Data["team"] = team
 
-	if !h.CheckInputConfiguration(request.Config, request.Env) {
+	if !h.checkInputConfigurationForEnv(request.Config, request.Env, request.EnvName) {
 		response.Success = false
 		return nil
 	}
@@ -31,21 +33,51 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 		response.Monitoring.Data["account_id"] = accountID
 	}
 
+	if !h.checkPermissions(request.Config, team, request.Component, "deploy") {
+		response.Success = false
+		return nil
+	}
+
 	if !h.CheckAWSResources() {
 		response.Success = false
 		return nil
 	}
 
+	if err := h.checkMigrated(team, request.Component); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	breakGlass, err := h.checkFreezes(request.Config, team, request.Component, request.EnvName, request.Env)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	backend, err := h.getStateBackend(request.Config, team, request.Component, request.EnvName)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	h.printStateBackend(request.EnvName, backend)
+	h.checkStateLocks(backend, request.EnvName)
+
 	response.TerraformBackendType = "s3"
-	response.TerraformBackendConfig["region"] = h.defaultRegion
-	response.TerraformBackendConfig["bucket"] = h.tfstateBucket
-	response.TerraformBackendConfig["access_key"] = request.Env["AWS_ACCESS_KEY_ID"]
-	response.TerraformBackendConfig["secret_key"] = request.Env["AWS_SECRET_ACCESS_KEY"]
-	response.TerraformBackendConfig["token"] = request.Env["AWS_SESSION_TOKEN"]
+	response.TerraformBackendConfig["region"] = backend.region
+	response.TerraformBackendConfig["bucket"] = backend.bucket
 	// When using a non-default workspace, the state path will be bucket/workspace_key_prefix/workspace_name/key
-	response.TerraformBackendConfig["workspace_key_prefix"] = fmt.Sprintf("%s/%s", team, request.Component)
-	response.TerraformBackendConfig["key"] = "terraform.tfstate"
-	response.TerraformBackendConfig["dynamodb_table"] = h.tflocksTable
+	response.TerraformBackendConfig["workspace_key_prefix"] = backend.workspaceKeyPrefix
+	response.TerraformBackendConfig["key"] = backend.key
+	if h.backendConfig.usesDynamoDBLocking() {
+		response.TerraformBackendConfig["dynamodb_table"] = backend.lockTable
+	}
+	if h.backendConfig.usesS3Locking() {
+		response.TerraformBackendConfig["use_lockfile"] = "true"
+	}
+	h.addBackendCredentials(response, backend, request.Env)
 
 	if err := h.AddDeployAccountCredentialsValue(request, team, response.Env); err != nil {
 		response.Success = false
@@ -53,46 +85,117 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 		return nil
 	}
 
-	AddAdditionalEnvironment(request.Env, response.Env)
+	if err := h.addEnvironmentSecrets(request.Config, request.EnvName, response.Env); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
 
-	s3Client := h.s3Client
+	terraformEnv, err := getTerraformEnv(request.Config)
+	if err == nil {
+		err = addTerraformEnv(terraformEnv, request.Env, response.Env)
+	}
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	terraformVars, err := getTerraformVars(request.Config)
+	var tags map[string]string
+	if err == nil {
+		tags, err = getTags(request.Config)
+	}
+	if err == nil {
+		var values map[string]string
+		if values, err = h.accountTerraformVars(request.Config, request.Component, request.EnvName); err == nil && request.Version == "" {
+			values["default_tags"], err = defaultTags(tags, team, request.Component, request.EnvName, "")
+		}
+		if err == nil {
+			addTerraformVars(terraformVars, values, response.Env)
+		}
+	}
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
 
-	// if request.StateShouldExist != nil {
-	// 	statePath := fmt.Sprintf("%s/%s/%s", response.TerraformBackendConfig["workspace_key_prefix"], request.EnvName, response.TerraformBackendConfig["key"])
-	// 	if *request.StateShouldExist {
-	// 		if err := h.validateStateExists(request, team, statePath, response, s3Client); err != nil {
-	// 			response.Success = false
-	// 			fmt.Fprintln(h.ErrorStream, err)
-	// 			return nil
-	// 		}
-	// 	}
-	// 	if !*request.StateShouldExist {
-	// 		if err := h.validateStateDoesNotExist(request, team, statePath, response, s3Client); err != nil {
-	// 			response.Success = false
-	// 			fmt.Fprintln(h.ErrorStream, err)
-	// 			return nil
-	// 		}
-	// 	}
-	// }
+	if request.StateShouldExist != nil {
+		validate := h.validateStateDoesNotExist
+		if *request.StateShouldExist {
+			validate = h.validateStateExists
+		}
+		if err := validate(request.EnvName, backend); err != nil {
+			response.Success = false
+			fmt.Fprintln(h.ErrorStream, err)
+			return nil
+		}
+	}
 
 	if request.Version == "" {
 		return nil
 	}
+
+	version, resolution, err := h.resolveVersion(team, request.Component, request.EnvName, request.Version)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	if resolution != "" {
+		fmt.Fprintf(h.ErrorStream, "- Resolved version %q to %s (%s)\n", request.Version, version, resolution)
+		request.Version = version
+	}
+
+	if err := h.checkPromotion(request.Config, team, request.Component, request.EnvName, request.Version); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
 	key := releaseS3Key(team, request.Component, request.Version)
-	fmt.Fprintf(h.ErrorStream, "- Downloading release from s3://%s/%s...\n", h.releaseBucket, key)
+	releaseStore, err := h.getReleaseCache(request.Env)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	// with a cache, whether the release is downloaded is only known once it has been got
+	_, caching := releaseStore.(*cachingReleaseStore)
+	if !caching {
+		fmt.Fprintf(h.ErrorStream, "- Downloading release from %s...\n", h.releaseStore.URL(key))
+	}
+	releaseReader, releaseObject, err := releaseStore.Get(key)
+	if err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+	defer releaseReader.Close()
+	if releaseObject.Cached {
+		fmt.Fprintf(h.ErrorStream, "- Using cached release of %s\n", h.releaseStore.URL(key))
+	} else if caching {
+		fmt.Fprintf(h.ErrorStream, "- Downloaded release from %s\n", h.releaseStore.URL(key))
+	}
+
+	metadata := releaseMetadataFromMap(releaseObject.Metadata)
+	metadata.print(h.ErrorStream, "    ")
 
-	getObjectOutput, err := s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(h.releaseBucket),
-		Key:    aws.String(key),
-	})
+	values, err := releaseTerraformVars(request.Version, metadata)
+	if err == nil {
+		values["default_tags"], err = defaultTags(tags, team, request.Component, request.EnvName, request.Version)
+	}
 	if err != nil {
 		response.Success = false
 		fmt.Fprintln(h.ErrorStream, err)
 		return nil
 	}
+	addTerraformVars(terraformVars, values, response.Env)
 
+	checksum := sha256.New()
 	terraformImage, err := h.ReleaseLoader.Load(
-		getObjectOutput.Body, request.Component, request.Version, releaseDir,
+		io.TeeReader(releaseReader, checksum), request.Component, request.Version, releaseDir,
 	)
 	if err != nil {
 		response.Success = false
@@ -102,6 +205,32 @@ func (h *Handler) PrepareTerraform(request *common.PrepareTerraformRequest, resp
 
 	response.TerraformImage = terraformImage
 
+	stateVersionID, err := h.stateVersionID(backend, request.EnvName)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s unable to get the current version of the terraform state: %v\n", h.styles.warningCross, err)
+	} else if stateVersionID != "" {
+		fmt.Fprintf(h.ErrorStream, "- Terraform state before deploying is version %s\n", stateVersionID)
+	}
+
+	callerIdentity := h.getCallerIdentity()
+	if err := h.recordDeployment(&deploymentRecord{
+		Team:            team,
+		Component:       request.Component,
+		Env:             request.EnvName,
+		Stack:           h.backendConfig.stack,
+		Version:         request.Version,
+		Account:         aws.StringValue(callerIdentity.Account),
+		Caller:          aws.StringValue(callerIdentity.Arn),
+		Timestamp:       time.Now().UTC(),
+		ReleaseChecksum: fmt.Sprintf("%x", checksum.Sum(nil)),
+		StateVersionID:  stateVersionID,
+		BreakGlass:      breakGlass,
+	}); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, "Unable to record deployment:", err)
+		return nil
+	}
+
 	return nil
 }
 
@@ -115,28 +244,20 @@ func (h *Handler) AddDeployAccountCredentialsValue(request *common.PrepareTerraf
 	return nil
 }
 
-func (h *Handler) getAccountID() string {
-	svc := sts.New(h.awsSession)
-
-	result, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+// getCallerIdentity returns the identity of the AWS credentials in use, or an empty identity if it can't be determined.
+func (h *Handler) getCallerIdentity() *sts.GetCallerIdentityOutput {
+	if h.callerIdentity != nil {
+		return h.callerIdentity
+	}
+	result, err := h.getSTSClient().GetCallerIdentity(&sts.GetCallerIdentityInput{})
 	if err != nil {
 		fmt.Fprintf(h.ErrorStream, "unable to get aws caller identity: %v", err)
-		return ""
-	}
-
-	if result.Account != nil {
-		return *result.Account
+		return &sts.GetCallerIdentityOutput{}
 	}
-
-	return ""
+	h.callerIdentity = result
+	return result
 }
 
-func AddAdditionalEnvironment(requestEnv map[string]string, responseEnv map[string]string) {
-	responseEnv["DD_APP_KEY"] = requestEnv["DATADOG_APP_KEY"]
-	responseEnv["DD_API_KEY"] = requestEnv["DATADOG_API_KEY"]
-	responseEnv["FASTLY_API_KEY"] = requestEnv["FASTLY_API_KEY"]
-	responseEnv["GITHUB_TOKEN"] = requestEnv["GITHUB_TOKEN"]
-	responseEnv["MONGODB_ATLAS_PUBLIC_KEY"] = requestEnv["MONGODB_ATLAS_PUBLIC_KEY"]
-	responseEnv["MONGODB_ATLAS_PRIVATE_KEY"] = requestEnv["MONGODB_ATLAS_PRIVATE_KEY"]
-	responseEnv["JUNOS_PASSWORD"] = requestEnv["JUNOS_PASSWORD"]
+func (h *Handler) getAccountID() string {
+	return aws.StringValue(h.getCallerIdentity().Account)
 }
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// getPromotionOrder returns the environments in config.params.promotion, in the order versions must be deployed to them - either
+// a string such as "dev -> staging -> prod", or a list of environment names.
+func getPromotionOrder(config map[string]interface{}) ([]string, error) {
+	raw, ok := config["promotion"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	var envs []string
+	switch value := raw.(type) {
+	case string:
+		for _, env := range strings.Split(value, "->") {
+			envs = append(envs, strings.TrimSpace(env))
+		}
+	case []interface{}:
+		for _, item := range value {
+			env, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("config.params.promotion must be a list of environment names, got %v", item)
+			}
+			envs = append(envs, strings.TrimSpace(env))
+		}
+	default:
+		return nil, fmt.Errorf("config.params.promotion must be a string (e.g. \"dev -> staging -> prod\") or a list of environment names")
+	}
+	seen := make(map[string]bool)
+	for _, env := range envs {
+		if env == "" {
+			return nil, fmt.Errorf("config.params.promotion has an empty environment name")
+		}
+		if seen[env] {
+			return nil, fmt.Errorf("config.params.promotion has %s more than once", env)
+		}
+		seen[env] = true
+	}
+	return envs, nil
+}
+
+// listAppliedDeployments returns the deployments of distinct versions to an environment that were applied, most recent first.
+// Deployments are recorded before terraform runs, so one was applied if terraform wrote a newer version of the environment's state
+// than the one recorded before the next deployment was recorded - deployments that were only planned, or failed before writing
+// state, are left out.
+func (h *Handler) listAppliedDeployments(config map[string]interface{}, team, component, env string) ([]*deploymentRecord, error) {
+	envConfig, err := getEnvironmentConfig(config, env)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := h.getStateBackend(config, team, component, env)
+	if err != nil {
+		return nil, err
+	}
+	// deployments are recorded in the tfstate bucket of the account deploying, so an environment deployed with credentials for
+	// another account has its records in that account's bucket, reached through its state backend
+	client, bucket := h.getS3Client(), h.tfstateBucket
+	if envConfig.deployAccountID != "" && envConfig.deployAccountID != h.getAccountID() {
+		client, bucket = h.getStateS3Client(backend), backend.bucket
+	}
+	records, err := h.listDeploymentRecordsFrom(client, bucket, team, component, env)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	stateVersions, err := h.listStateVersions(backend, env)
+	if err != nil {
+		return nil, err
+	}
+	return distinctVersions(appliedDeployments(records, stateVersions), 0), nil
+}
+
+// appliedDeployments returns the records (oldest first) of the deployments that terraform wrote a new version of the state for.
+func appliedDeployments(records []*deploymentRecord, stateVersions []*stateVersion) []*deploymentRecord {
+	var applied []*deploymentRecord
+	for i, record := range records {
+		var next time.Time
+		if i+1 < len(records) {
+			next = records[i+1].Timestamp
+		}
+		for _, version := range stateVersions {
+			if version.deleteMarker || version.versionID == record.StateVersionID || !version.lastModified.After(record.Timestamp) {
+				continue
+			}
+			if next.IsZero() || version.lastModified.Before(next) {
+				applied = append(applied, record)
+				break
+			}
+		}
+	}
+	return applied
+}
+
+// checkPromotion returns an error unless the version has been deployed to the environment before env in config.params.promotion,
+// or to env itself, and the deployment was applied.
+func (h *Handler) checkPromotion(config map[string]interface{}, team, component, env, version string) error {
+	order, err := getPromotionOrder(config)
+	if err != nil {
+		return err
+	}
+	var previousEnv string
+	for i, item := range order {
+		if item == env && i > 0 {
+			previousEnv = order[i-1]
+		}
+	}
+	if previousEnv == "" {
+		return nil
+	}
+	// a version that has been deployed to the environment before (e.g. when rolling back) has already been promoted
+	envHistory, err := h.listAppliedDeployments(config, team, component, env)
+	if err != nil {
+		return fmt.Errorf("unable to check config.params.promotion: %v", err)
+	}
+	for _, record := range envHistory {
+		if record.Version == version {
+			fmt.Fprintf(
+				h.ErrorStream, "  %s version %s was previously deployed to %s at %s (config.params.promotion: %s)\n",
+				h.styles.tick, version, env, record.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"), strings.Join(order, " -> "),
+			)
+			return nil
+		}
+	}
+	history, err := h.listAppliedDeployments(config, team, component, previousEnv)
+	if err != nil {
+		return fmt.Errorf("unable to check config.params.promotion: %v", err)
+	}
+	for _, record := range history {
+		if record.Version == version {
+			fmt.Fprintf(
+				h.ErrorStream, "  %s version %s was deployed to %s at %s (config.params.promotion: %s)\n",
+				h.styles.tick, version, previousEnv, record.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"), strings.Join(order, " -> "),
+			)
+			return nil
+		}
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s version %s has not been deployed to %s\n", h.styles.cross, version, previousEnv)
+	current := fmt.Sprintf("no versions of %s have been deployed to %s", component, previousEnv)
+	if len(history) > 0 {
+		current = fmt.Sprintf("%s currently has version %s", previousEnv, history[0].Version)
+	}
+	return fmt.Errorf(
+		"\nRefusing to deploy version %s to %s: config.params.promotion (%s) requires versions to be deployed to %s before %s, but "+
+			"version %s has not been (%s).\nDeploy it to %s first, e.g. cdflow2 deploy %s %s",
+		version, env, strings.Join(order, " -> "), previousEnv, env, version, current, previousEnv, previousEnv, version,
+	)
+}
@@ -0,0 +1,127 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// putAppliedDeployment records a deployment, and the state written by terraform applying it a minute later.
+func putAppliedDeployment(s3Client *memoryS3, env, version string, timestamp time.Time) {
+	putDeploymentRecord(s3Client, env, version, timestamp)
+	s3Client.putAt(
+		"cdflow2-tfstate-bucket-1", "my-team/my-component/"+env+"/terraform.tfstate", []byte(`{"resources": []}`), timestamp.Add(time.Minute),
+	)
+}
+
+func TestPrepareTerraformPromotion(t *testing.T) {
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name      string
+		promotion interface{}
+		env       string
+		version   string
+		success   bool
+		expected  string
+	}{
+		{"first environment", "dev -> staging -> live", "dev", "3", true, ""},
+		{"not in order", "dev -> staging -> live", "ci", "3", true, ""},
+		{
+			"deployed to previous environment", "dev -> staging -> prod", "prod", "1", true,
+			"version 1 was deployed to staging at 2026-10-01 10:00:00 UTC (config.params.promotion: dev -> staging -> prod)",
+		},
+		{"list", []interface{}{"dev", "staging", "live"}, "staging", "2", true, "version 2 was deployed to dev"},
+		{
+			"not deployed to previous environment", "dev -> staging -> live", "live", "2", false,
+			"Refusing to deploy version 2 to live: config.params.promotion (dev -> staging -> live) requires versions to be deployed to " +
+				"staging before live, but version 2 has not been (staging currently has version 1).\nDeploy it to staging first, e.g. cdflow2 deploy staging 2",
+		},
+		{"not deployed to first environment", "dev -> staging -> live", "staging", "3", false, "(dev currently has version 2)"},
+		{"not applied to previous environment", "dev -> staging -> live", "live", "3", false, "version 3 has not been (staging currently has version 1)"},
+		{
+			"no history", "qa -> prod", "prod", "1", false,
+			"version 1 has not been (no versions of my-component have been deployed to qa)",
+		},
+		{"rollback", "dev -> staging -> live", "live", "previous", true, "version 0 was previously deployed to live at 2026-10-01 08:00:00 UTC"},
+		{"invalid", "dev -> dev", "dev", "1", false, "config.params.promotion has dev more than once"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+			putAppliedDeployment(s3Client, "dev", "1", start)
+			putAppliedDeployment(s3Client, "staging", "1", start.Add(time.Hour))
+			putAppliedDeployment(s3Client, "dev", "2", start.Add(2*time.Hour))
+			putAppliedDeployment(s3Client, "live", "0", start.Add(-time.Hour))
+			putAppliedDeployment(s3Client, "live", "1", start.Add(3*time.Hour))
+			// only planned, so terraform didn't write the state
+			putDeploymentRecord(s3Client, "staging", "3", start.Add(4*time.Hour))
+			store := handler.NewFilesystemReleaseStore(tempDir(t))
+			for _, version := range []string{"0", "1", "2", "3"} {
+				putRelease(t, store, version)
+			}
+			var errorBuffer bytes.Buffer
+			myHandler := testHandler(handler.Opts{S3Client: s3Client, ReleaseStore: store, ErrorStream: &errorBuffer})
+			request := prepareTerraformRequest(test.env, test.version)
+			request.Config["promotion"] = test.promotion
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Success != test.success || !strings.Contains(errorBuffer.String(), test.expected) {
+				t.Fatalf("expected success %v with %q, got %v with output: %q", test.success, test.expected, response.Success, errorBuffer.String())
+			}
+		})
+	}
+}
+
+func TestPrepareTerraformPromotionFromOtherAccount(t *testing.T) {
+	// Given
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	// staging is deployed with credentials for another account, so its deployments are recorded in that account's bucket
+	stagingS3 := newMemoryS3("staging-tfstate")
+	stagingS3.put(
+		"staging-tfstate", "cdflow2-deployments/my-team/my-component/staging/"+start.Format("2006-01-02T15-04-05.000000000Z")+".json",
+		[]byte(`{"team": "my-team", "component": "my-component", "env": "staging", "version": "1", "timestamp": "`+start.Format(time.RFC3339)+`"}`),
+	)
+	stagingS3.putAt("staging-tfstate", "my-team/my-component/staging/terraform.tfstate", []byte(emptyState), start.Add(time.Minute))
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	putRelease(t, store, "1")
+	var errorBuffer bytes.Buffer
+	myHandler := testHandler(handler.Opts{
+		S3ClientFactory: s3ClientFactory(t, map[string]s3iface.S3API{"arn:aws:iam::210987654321:role/state eu-west-1": stagingS3}),
+		ReleaseStore:    store,
+		ErrorStream:     &errorBuffer,
+	})
+	request := prepareTerraformRequest("live", "1")
+	request.Config["promotion"] = "staging -> live"
+	request.Config["environments"] = map[string]interface{}{
+		"staging": map[string]interface{}{
+			"deploy_account_id": "210987654321",
+			"tfstate_bucket":    "staging-tfstate",
+			"backend_role_arn":  "arn:aws:iam::210987654321:role/state",
+		},
+	}
+	response := common.CreatePrepareTerraformResponse()
+
+	// When
+	err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !response.Success || !strings.Contains(errorBuffer.String(), "version 1 was deployed to staging at 2026-10-01 09:00:00 UTC") {
+		t.Fatalf("expected version 1 to have been promoted from staging, got %v with output: %q", response.Success, errorBuffer.String())
+	}
+}
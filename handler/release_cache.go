@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReleaseCacheMaxSize is the size the release cache is kept within when CDFLOW2_RELEASE_CACHE_MAX_MB is not set.
+const defaultReleaseCacheMaxSize = 1024 * 1024 * 1024
+
+// releaseCacheTempPrefix is the prefix of files being downloaded into the cache, which are renamed into place when complete.
+const releaseCacheTempPrefix = ".download-"
+
+// abandonedDownloadAge is how old a download must be before it is assumed its process has died and it is removed.
+const abandonedDownloadAge = time.Hour
+
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type cachingReleaseStore struct {
+	ReleaseStore
+	dir     string
+	maxSize int64
+}
+
+// NewCachingReleaseStore returns a ReleaseStore that keeps a copy of each release it gets from store in dir, keyed by the ETag of
+// the release. The ETag is checked against the store on each get, so a release that has been replaced is downloaded again. The
+// least recently used releases are removed to keep the cache within maxSize bytes. Releases are written to the cache by renaming
+// a complete download into place, so the directory can be shared by several processes.
+func NewCachingReleaseStore(store ReleaseStore, dir string, maxSize int64) ReleaseStore {
+	return &cachingReleaseStore{ReleaseStore: store, dir: dir, maxSize: maxSize}
+}
+
+func (s *cachingReleaseStore) path(etag string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%x.zip", sha256.Sum256([]byte(etag))))
+}
+
+func (s *cachingReleaseStore) Get(key string) (io.ReadCloser, *ReleaseObject, error) {
+	object, err := s.ReleaseStore.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if object.ETag != "" {
+		if file, err := os.Open(s.path(object.ETag)); err == nil {
+			now := time.Now()
+			os.Chtimes(file.Name(), now, now)
+			object.Cached = true
+			return file, object, nil
+		}
+	}
+
+	body, object, err := s.ReleaseStore.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if object.ETag == "" {
+		return body, object, nil
+	}
+	defer body.Close()
+	path, err := s.download(body, object.ETag)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	// files already opened remain readable if they are removed
+	s.evict()
+	return file, object, nil
+}
+
+// download copies a release into the cache, returning its path.
+func (s *cachingReleaseStore) download(body io.Reader, etag string) (string, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(s.dir, releaseCacheTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	// the ETag is the MD5 of the content unless the release was uploaded in parts (or is in a filesystem release store)
+	if md5ETag.MatchString(etag) && fmt.Sprintf("%x", hash.Sum(nil)) != etag {
+		return "", fmt.Errorf("downloaded release does not match its ETag %s", etag)
+	}
+	path := s.path(etag)
+	if err := os.Rename(file.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// evict removes the least recently used releases until the cache is within its maximum size.
+func (s *cachingReleaseStore) evict() {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	var releases []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), releaseCacheTempPrefix) {
+			if time.Since(entry.ModTime()) > abandonedDownloadAge {
+				os.Remove(filepath.Join(s.dir, entry.Name()))
+			}
+			continue
+		}
+		releases = append(releases, entry)
+		size += entry.Size()
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].ModTime().Before(releases[j].ModTime())
+	})
+	for _, release := range releases {
+		if size <= s.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, release.Name())); err == nil || os.IsNotExist(err) {
+			size -= release.Size()
+		}
+	}
+}
+
+// getReleaseCache returns the release store to download releases from, which caches them in CDFLOW2_RELEASE_CACHE if it is set.
+func (h *Handler) getReleaseCache(inputEnv map[string]string) (ReleaseStore, error) {
+	dir := inputEnv["CDFLOW2_RELEASE_CACHE"]
+	if dir == "" {
+		return h.releaseStore, nil
+	}
+	maxSize := int64(defaultReleaseCacheMaxSize)
+	if value := inputEnv["CDFLOW2_RELEASE_CACHE_MAX_MB"]; value != "" {
+		megabytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || megabytes < 0 {
+			return nil, fmt.Errorf("CDFLOW2_RELEASE_CACHE_MAX_MB must be a number of megabytes, got %q", value)
+		}
+		maxSize = megabytes * 1024 * 1024
+	}
+	fmt.Fprintf(h.ErrorStream, "- Using release cache in %s (up to %d MB)\n", dir, maxSize/(1024*1024))
+	return NewCachingReleaseStore(h.releaseStore, dir, maxSize), nil
+}
@@ -0,0 +1,153 @@
+package handler_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// countingReleaseStore counts the releases got from a store.
+type countingReleaseStore struct {
+	handler.ReleaseStore
+	gets int
+}
+
+func (s *countingReleaseStore) Get(key string) (io.ReadCloser, *handler.ReleaseObject, error) {
+	s.gets++
+	return s.ReleaseStore.Get(key)
+}
+
+func getRelease(t *testing.T, store handler.ReleaseStore, key string) string {
+	body, _, err := store.Get(key)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return string(data)
+}
+
+func TestCachingReleaseStore(t *testing.T) {
+	t.Run("cache hit", func(t *testing.T) {
+		// Given
+		store := &countingReleaseStore{ReleaseStore: handler.NewFilesystemReleaseStore(tempDir(t))}
+		store.Put("my-team/my-component/my-component-1.zip", strings.NewReader("release 1"), nil)
+		cache := handler.NewCachingReleaseStore(store, tempDir(t), 1024)
+
+		// When
+		first := getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+		second := getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+
+		// Then
+		if first != "release 1" || second != "release 1" {
+			t.Fatalf("unexpected releases: %q, %q", first, second)
+		}
+		if store.gets != 1 {
+			t.Fatalf("expected release to be downloaded once, got %d", store.gets)
+		}
+	})
+
+	t.Run("release replaced", func(t *testing.T) {
+		// Given
+		store := &countingReleaseStore{ReleaseStore: handler.NewFilesystemReleaseStore(tempDir(t))}
+		store.Put("my-team/my-component/my-component-1.zip", strings.NewReader("release 1"), nil)
+		cache := handler.NewCachingReleaseStore(store, tempDir(t), 1024)
+		getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+		store.Put("my-team/my-component/my-component-1.zip", strings.NewReader("release 1 rebuilt"), nil)
+
+		// When
+		release := getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+
+		// Then
+		if release != "release 1 rebuilt" || store.gets != 2 {
+			t.Fatalf("expected replaced release to be downloaded, got %q after %d downloads", release, store.gets)
+		}
+	})
+
+	t.Run("least recently used evicted", func(t *testing.T) {
+		// Given
+		store := &countingReleaseStore{ReleaseStore: handler.NewFilesystemReleaseStore(tempDir(t))}
+		for _, version := range []string{"1", "2", "3"} {
+			store.Put("my-team/my-component/my-component-"+version+".zip", strings.NewReader("release "+version), nil)
+		}
+		cacheDir := tempDir(t)
+		// room for two releases
+		cache := handler.NewCachingReleaseStore(store, cacheDir, 2*int64(len("release 1")))
+		getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+		getRelease(t, cache, "my-team/my-component/my-component-2.zip")
+		getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+
+		// When
+		getRelease(t, cache, "my-team/my-component/my-component-3.zip")
+
+		// Then
+		files, _ := ioutil.ReadDir(cacheDir)
+		if len(files) != 2 {
+			t.Fatalf("expected two cached releases, got %d", len(files))
+		}
+		gets := store.gets
+		getRelease(t, cache, "my-team/my-component/my-component-1.zip")
+		getRelease(t, cache, "my-team/my-component/my-component-3.zip")
+		if store.gets != gets {
+			t.Fatal("expected recently used releases to be cached")
+		}
+		getRelease(t, cache, "my-team/my-component/my-component-2.zip")
+		if store.gets != gets+1 {
+			t.Fatal("expected least recently used release to have been evicted")
+		}
+	})
+}
+
+func TestPrepareTerraformWithReleaseCache(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	buildDir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(buildDir, "main.tf"), []byte("# version 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var release bytes.Buffer
+	if err := common.ZipRelease(&release, buildDir, "my-component", "1", "hashicorp/terraform:1.5.0"); err != nil {
+		t.Fatal(err)
+	}
+	s3Client.put("cdflow2-release-bucket-1", "my-team/my-component/my-component-1.zip", release.Bytes())
+	store := &countingReleaseStore{ReleaseStore: handler.NewS3ReleaseStore(s3Client, "cdflow2-release-bucket-1")}
+	cacheDir := tempDir(t)
+	prepare := func() string {
+		response, output := prepareTerraform(t, handler.Opts{S3Client: s3Client, ReleaseStore: store}, "1", nil, map[string]string{
+			"CDFLOW2_RELEASE_CACHE": cacheDir,
+		})
+		if !response.Success {
+			t.Fatal("prepare terraform failed:", output)
+		}
+		if response.TerraformImage != "hashicorp/terraform:1.5.0" {
+			t.Fatalf("unexpected terraform image %q", response.TerraformImage)
+		}
+		return output
+	}
+
+	// When
+	first := prepare()
+	second := prepare()
+
+	// Then
+	if store.gets != 1 {
+		t.Fatalf("expected release to be downloaded once, got %d", store.gets)
+	}
+	if !strings.Contains(first, "Downloaded release from s3://cdflow2-release-bucket-1/my-team/my-component/my-component-1.zip") {
+		t.Fatalf("expected the release to be downloaded, got: %q", first)
+	}
+	if !strings.Contains(second, "Using cached release of s3://cdflow2-release-bucket-1/my-team/my-component/my-component-1.zip") ||
+		strings.Contains(second, "Download") {
+		t.Fatalf("expected the cached release to be used, got: %q", second)
+	}
+}
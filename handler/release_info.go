@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// ReleaseInfoRequest is the input to the release-info command.
+type ReleaseInfoRequest struct {
+	CommandRequest
+	Version string
+}
+
+// ReleaseInfo outputs the provenance stored with a release, without downloading it.
+func (h *Handler) ReleaseInfo(request *ReleaseInfoRequest) error {
+	if request.Version == "" {
+		fmt.Fprintln(h.ErrorStream, "version must be specified")
+		return Exit(false)
+	}
+	team, err := h.prepareCommand(&request.CommandRequest)
+	if err != nil {
+		return err
+	}
+
+	key := releaseS3Key(team, request.Component, request.Version)
+	releaseObject, err := h.releaseStore.Head(key)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to get release %s: %v\n", h.releaseStore.URL(key), err)
+		return Exit(false)
+	}
+
+	fmt.Fprintln(h.OutputStream, h.releaseStore.URL(key))
+	if !releaseObject.LastModified.IsZero() {
+		fmt.Fprintf(h.OutputStream, "  %-16s %s\n", "uploaded:", releaseObject.LastModified.UTC().Format("2006-01-02 15:04:05 MST"))
+	}
+	releaseMetadataFromMap(releaseObject.Metadata).print(h.OutputStream, "  ")
+
+	return nil
+}
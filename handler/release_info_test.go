@@ -0,0 +1,114 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+)
+
+type releaseInfoS3 struct {
+	mockedS3
+	metadata map[string]*string
+}
+
+func (s3Client releaseInfoS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if *input.Key != "my-team/my-component/my-component-42.zip" {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{Metadata: s3Client.metadata}, nil
+}
+
+func TestReleaseInfo(t *testing.T) {
+	request := func(version string) *handler.ReleaseInfoRequest {
+		return &handler.ReleaseInfoRequest{
+			CommandRequest: handler.CommandRequest{
+				Component: "my-component",
+				Config: map[string]interface{}{
+					"team":           "my-team",
+					"default_region": "eu-west-1",
+				},
+				Env: map[string]string{
+					"AWS_ACCESS_KEY_ID":     "test-access-key",
+					"AWS_SECRET_ACCESS_KEY": "test-secret-access-key",
+				},
+			},
+			Version: version,
+		}
+	}
+	s3Client := releaseInfoS3{
+		mockedS3: mockedS3{buckets: []string{"cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1"}},
+		// S3 returns user metadata keys with the first letter of each word capitalised
+		metadata: map[string]*string{
+			"Team":            aws.String("my-team"),
+			"Component":       aws.String("my-component"),
+			"Version":         aws.String("42"),
+			"Commit":          aws.String("abc123"),
+			"Branch":          aws.String("main"),
+			"Terraform-Image": aws.String("hashicorp/terraform@sha256:1234"),
+			"Build-Ids":       aws.String("docker"),
+			"Build-Metadata": aws.String(base64.StdEncoding.EncodeToString(
+				[]byte(`{"docker": {"image": "123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component@sha256:5678"}}`),
+			)),
+		},
+	}
+
+	t.Run("outputs provenance", func(t *testing.T) {
+		// Given
+		var outputBuffer bytes.Buffer
+		var errorBuffer bytes.Buffer
+		myHandler := handler.New(&handler.Opts{
+			S3Client:       s3Client,
+			DynamoDBClient: &mockedDynamoDB{},
+			OutputStream:   &outputBuffer,
+			ErrorStream:    &errorBuffer,
+		})
+
+		// When
+		err := myHandler.ReleaseInfo(request("42"))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		for _, expected := range []string{
+			"s3://cdflow2-release-bucket-1/my-team/my-component/my-component-42.zip",
+			"commit:          abc123",
+			"branch:          main",
+			"hashicorp/terraform@sha256:1234",
+			"build docker image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component@sha256:5678",
+		} {
+			if !strings.Contains(outputBuffer.String(), expected) {
+				t.Fatalf("expected %q in output, got: %s", expected, outputBuffer.String())
+			}
+		}
+	})
+
+	t.Run("missing release", func(t *testing.T) {
+		// Given
+		var outputBuffer bytes.Buffer
+		var errorBuffer bytes.Buffer
+		myHandler := handler.New(&handler.Opts{
+			S3Client:       s3Client,
+			DynamoDBClient: &mockedDynamoDB{},
+			OutputStream:   &outputBuffer,
+			ErrorStream:    &errorBuffer,
+		})
+
+		// When
+		err := myHandler.ReleaseInfo(request("43"))
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatal("expected Exit(false), got:", err)
+		}
+		if !strings.Contains(errorBuffer.String(), "Unable to get release") {
+			t.Fatal("expected 'Unable to get release' message, got output:", errorBuffer.String())
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// branchEnvVars are checked in order to find the branch a release was built from.
+var branchEnvVars = []string{
+	"CDFLOW2_BRANCH",
+	"GITHUB_HEAD_REF",
+	"GITHUB_REF_NAME",
+	"BRANCH_NAME",
+	"CI_COMMIT_REF_NAME",
+	"BUILDKITE_BRANCH",
+	"GIT_BRANCH",
+}
+
+var invalidTagValueChars = regexp.MustCompile(`[^a-zA-Z0-9 +\-=._:/@]+`)
+
+// releaseMetadata is the provenance stored alongside each release.
+type releaseMetadata struct {
+	Team           string
+	Component      string
+	Version        string
+	Commit         string
+	Branch         string
+	TerraformImage string
+	// Builds maps each build ID to the metadata output by that build (e.g. the image and digest pushed to ECR).
+	Builds map[string]map[string]string
+}
+
+func newReleaseMetadata(team string, request *common.UploadReleaseRequest, configureReleaseRequest *common.ConfigureReleaseRequest) *releaseMetadata {
+	builds := make(map[string]map[string]string)
+	for buildID := range configureReleaseRequest.ReleaseRequirements {
+		builds[buildID] = map[string]string{}
+	}
+	for buildID, metadata := range request.ReleaseMetadata {
+		builds[buildID] = metadata
+	}
+	return &releaseMetadata{
+		Team:           team,
+		Component:      configureReleaseRequest.Component,
+		Version:        configureReleaseRequest.Version,
+		Commit:         configureReleaseRequest.Commit,
+		Branch:         getBranch(configureReleaseRequest.Env),
+		TerraformImage: request.TerraformImage,
+		Builds:         builds,
+	}
+}
+
+func getBranch(env map[string]string) string {
+	for _, name := range branchEnvVars {
+		if branch := env[name]; branch != "" {
+			return strings.TrimPrefix(branch, "origin/")
+		}
+	}
+	return ""
+}
+
+func (m *releaseMetadata) buildIDs() []string {
+	var result []string
+	for buildID := range m.Builds {
+		result = append(result, buildID)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// buildMetadataValue encodes the metadata output by builds as base64 encoded JSON, as S3 changes the case of user metadata keys and
+// only allows ASCII values - or returns "" if no build output metadata.
+func (m *releaseMetadata) buildMetadataValue() (string, error) {
+	builds := make(map[string]map[string]string)
+	for buildID, metadata := range m.Builds {
+		if len(metadata) > 0 {
+			builds[buildID] = metadata
+		}
+	}
+	if len(builds) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(builds)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// toMap flattens the metadata into string key/values suitable for storing as S3 user metadata.
+func (m *releaseMetadata) toMap() (map[string]string, error) {
+	result := make(map[string]string)
+	add := func(key, value string) {
+		if value != "" {
+			result[key] = value
+		}
+	}
+	add("team", m.Team)
+	add("component", m.Component)
+	add("version", m.Version)
+	add("commit", m.Commit)
+	add("branch", m.Branch)
+	add("terraform-image", m.TerraformImage)
+	add("build-ids", strings.Join(m.buildIDs(), ","))
+	buildMetadata, err := m.buildMetadataValue()
+	if err != nil {
+		return nil, err
+	}
+	add("build-metadata", buildMetadata)
+	return result, nil
+}
+
+// maxS3MetadataSize is the most user metadata S3 stores with an object, counting the bytes of each key and value.
+const maxS3MetadataSize = 2048
+
+// s3Metadata returns the values encoded to be stored as S3 user metadata, which must be ASCII - other characters (e.g. a branch name
+// with accents) are encoded as RFC 2047 encoded-words, as S3 does itself. Values are dropped, largest first, until the metadata fits in
+// the 2KB S3 allows, and a message returned for each one dropped.
+func s3Metadata(values map[string]string) (map[string]string, []string) {
+	result := make(map[string]string)
+	size := 0
+	for key, value := range values {
+		result[key] = mime.QEncoding.Encode("utf-8", value)
+		size += len(key) + len(result[key])
+	}
+	var dropped []string
+	for size > maxS3MetadataSize {
+		largest := ""
+		for key, value := range result {
+			if largest == "" || len(key)+len(value) > len(largest)+len(result[largest]) ||
+				(len(key)+len(value) == len(largest)+len(result[largest]) && key < largest) {
+				largest = key
+			}
+		}
+		size -= len(largest) + len(result[largest])
+		dropped = append(dropped, fmt.Sprintf(
+			"release metadata %s (%d bytes) not stored, as S3 allows only %d bytes of metadata", largest,
+			len(largest)+len(result[largest]), maxS3MetadataSize,
+		))
+		delete(result, largest)
+	}
+	return result, dropped
+}
+
+// tagValue replaces characters that aren't allowed in AWS tag values, and truncates the value to the maximum length.
+func tagValue(value string) string {
+	value = invalidTagValueChars.ReplaceAllString(value, "_")
+	if len(value) > 256 {
+		value = value[:256]
+	}
+	return value
+}
+
+// s3Tagging returns the object tags for the release, encoded for the x-amz-tagging header.
+func (m *releaseMetadata) s3Tagging() string {
+	tags := url.Values{}
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		tags.Set(key, tagValue(value))
+	}
+	add("team", m.Team)
+	add("component", m.Component)
+	add("version", m.Version)
+	add("commit", m.Commit)
+	add("branch", m.Branch)
+	return tags.Encode()
+}
+
+// releaseMetadataFromMap is the inverse of toMap (and s3Metadata) - S3 returns user metadata keys with their case changed, so keys are
+// compared case insensitively. Build metadata that can't be decoded is left out.
+func releaseMetadataFromMap(values map[string]string) *releaseMetadata {
+	lower := make(map[string]string)
+	decoder := new(mime.WordDecoder)
+	for key, value := range values {
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		lower[strings.ToLower(key)] = value
+	}
+	result := &releaseMetadata{
+		Team:           lower["team"],
+		Component:      lower["component"],
+		Version:        lower["version"],
+		Commit:         lower["commit"],
+		Branch:         lower["branch"],
+		TerraformImage: lower["terraform-image"],
+		Builds:         make(map[string]map[string]string),
+	}
+	if lower["build-ids"] != "" {
+		for _, buildID := range strings.Split(lower["build-ids"], ",") {
+			result.Builds[buildID] = make(map[string]string)
+		}
+	}
+	var builds map[string]map[string]string
+	if data, err := base64.StdEncoding.DecodeString(lower["build-metadata"]); err == nil && json.Unmarshal(data, &builds) == nil {
+		for buildID, metadata := range builds {
+			result.Builds[buildID] = metadata
+		}
+	}
+	return result
+}
+
+func releaseMetadataFromS3(values map[string]*string) *releaseMetadata {
+	return releaseMetadataFromMap(aws.StringValueMap(values))
+}
+
+func (m *releaseMetadata) empty() bool {
+	return m.Commit == "" && m.Branch == "" && m.TerraformImage == "" && len(m.Builds) == 0
+}
+
+// print writes the provenance of the release in a human readable form.
+func (m *releaseMetadata) print(writer io.Writer, indent string) {
+	if m.empty() {
+		fmt.Fprintf(writer, "%sno provenance recorded for this release\n", indent)
+		return
+	}
+	line := func(label, value string) {
+		if value != "" {
+			fmt.Fprintf(writer, "%s%-16s %s\n", indent, label+":", value)
+		}
+	}
+	line("team", m.Team)
+	line("component", m.Component)
+	line("version", m.Version)
+	line("commit", m.Commit)
+	line("branch", m.Branch)
+	line("terraform image", m.TerraformImage)
+	for _, buildID := range m.buildIDs() {
+		metadata := m.Builds[buildID]
+		if len(metadata) == 0 {
+			line("build", buildID)
+			continue
+		}
+		var keys []string
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			line(fmt.Sprintf("build %s %s", buildID, key), metadata[key])
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ReleaseStore stores release zips along with metadata describing them.
+type ReleaseStore interface {
+	// Put stores the release read from body under key.
+	Put(key string, body io.Reader, metadata map[string]string) error
+	// Get returns a reader for the release stored under key, which the caller must close.
+	Get(key string) (io.ReadCloser, *ReleaseObject, error)
+	// Head returns the details of the release stored under key without fetching its contents.
+	Head(key string) (*ReleaseObject, error)
+	// URL returns a URL for displaying where the release under key is stored.
+	URL(key string) string
+	// List returns the releases stored under keys beginning with prefix, without their metadata.
+	List(prefix string) ([]*ReleaseObject, error)
+	// Delete removes the release stored under key.
+	Delete(key string) error
+}
+
+// ReleaseObject describes a release held in a ReleaseStore.
+type ReleaseObject struct {
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+	// Cached is set when the release is read from a release cache rather than downloaded.
+	Cached bool
+}
+
+type s3ReleaseStore struct {
+	client   s3iface.S3API
+	bucket   string
+	endpoint string
+}
+
+// NewS3ReleaseStore returns a ReleaseStore that keeps releases in an S3 bucket.
+func NewS3ReleaseStore(client s3iface.S3API, bucket string) ReleaseStore {
+	return &s3ReleaseStore{client: client, bucket: bucket}
+}
+
+func (s *s3ReleaseStore) Put(key string, body io.Reader, metadata map[string]string) error {
+	s3Uploader := s3manager.NewUploaderWithClient(s.client)
+	_, err := s3Uploader.Upload(&s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: aws.StringMap(metadata),
+		Tagging:  aws.String(releaseMetadataFromMap(metadata).s3Tagging()),
+	})
+	return err
+}
+
+func (s *s3ReleaseStore) Get(key string) (io.ReadCloser, *ReleaseObject, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return output.Body, &ReleaseObject{
+		Key:          key,
+		ETag:         strings.Trim(aws.StringValue(output.ETag), `"`),
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+		Metadata:     aws.StringValueMap(output.Metadata),
+	}, nil
+}
+
+func (s *s3ReleaseStore) Head(key string) (*ReleaseObject, error) {
+	output, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseObject{
+		Key:          key,
+		ETag:         strings.Trim(aws.StringValue(output.ETag), `"`),
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+		Metadata:     aws.StringValueMap(output.Metadata),
+	}, nil
+}
+
+func (s *s3ReleaseStore) List(prefix string) ([]*ReleaseObject, error) {
+	var result []*ReleaseObject
+	if err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			result = append(result, &ReleaseObject{
+				Key:          aws.StringValue(object.Key),
+				ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *s3ReleaseStore) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3ReleaseStore) URL(key string) string {
+	if s.endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, key)
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key)
+}
+
+// releaseStoreConfig is the config.params.release_store section of cdflow.yaml.
+type releaseStoreConfig struct {
+	storeType string
+	bucket    string
+	endpoint  string
+	region    string
+	pathStyle bool
+	path      string
+}
+
+func getReleaseStoreConfig(config map[string]interface{}) (*releaseStoreConfig, error) {
+	raw, ok := config["release_store"]
+	if !ok || raw == nil {
+		return &releaseStoreConfig{storeType: "s3"}, nil
+	}
+	params, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.release_store must be a map")
+	}
+	result := releaseStoreConfig{storeType: "s3", pathStyle: true}
+	for key, value := range params {
+		if key == "path_style" {
+			pathStyle, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("config.params.release_store.path_style must be true or false")
+			}
+			result.pathStyle = pathStyle
+			continue
+		}
+		stringValue, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("config.params.release_store.%s must be a string", key)
+		}
+		switch key {
+		case "type":
+			result.storeType = stringValue
+		case "bucket":
+			result.bucket = stringValue
+		case "endpoint":
+			result.endpoint = stringValue
+		case "region":
+			result.region = stringValue
+		case "path":
+			result.path = stringValue
+		default:
+			return nil, fmt.Errorf("config.params.release_store.%s is not a recognised option", key)
+		}
+	}
+	switch result.storeType {
+	case "s3":
+		if result.endpoint != "" {
+			return nil, fmt.Errorf("config.params.release_store.endpoint requires type s3-compatible")
+		}
+	case "s3-compatible":
+		if result.endpoint == "" || result.bucket == "" {
+			return nil, fmt.Errorf("config.params.release_store.endpoint and bucket are required for the s3-compatible release store")
+		}
+	case "filesystem":
+		if result.path == "" {
+			return nil, fmt.Errorf("config.params.release_store.path is required for the filesystem release store")
+		}
+	default:
+		return nil, fmt.Errorf("config.params.release_store.type must be one of s3, s3-compatible or filesystem, got %q", result.storeType)
+	}
+	return &result, nil
+}
+
+// handleReleaseStore sets up the release store from config - for the default s3 store this is deferred until the release bucket
+// has been found by CheckAWSResources.
+func (h *Handler) handleReleaseStore(config map[string]interface{}, inputEnv map[string]string) bool {
+	if h.releaseStore != nil {
+		return true
+	}
+	storeConfig, err := getReleaseStoreConfig(config)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s %v\n", h.styles.cross, err)
+		return false
+	}
+	switch storeConfig.storeType {
+	case "s3":
+		if storeConfig.bucket != "" {
+			if h.s3Client == nil && h.awsSession == nil {
+				// credentials problem will already have been reported
+				return true
+			}
+			h.releaseBucket = storeConfig.bucket
+			h.releaseStore = NewS3ReleaseStore(h.getS3Client(), storeConfig.bucket)
+			fmt.Fprintf(h.ErrorStream, "  %s config.params.release_store: bucket %s\n", h.styles.tick, storeConfig.bucket)
+		}
+	case "s3-compatible":
+		if h.awsSession == nil {
+			// credentials problem will already have been reported
+			return true
+		}
+		region := storeConfig.region
+		if region == "" {
+			region = h.defaultRegion
+		}
+		awsConfig := &aws.Config{
+			Endpoint:         aws.String(storeConfig.endpoint),
+			Region:           aws.String(region),
+			S3ForcePathStyle: aws.Bool(storeConfig.pathStyle),
+		}
+		if inputEnv["CDFLOW2_RELEASE_STORE_ACCESS_KEY_ID"] != "" {
+			awsConfig.Credentials = credentials.NewStaticCredentials(
+				inputEnv["CDFLOW2_RELEASE_STORE_ACCESS_KEY_ID"], inputEnv["CDFLOW2_RELEASE_STORE_SECRET_ACCESS_KEY"], "",
+			)
+		}
+		h.releaseStore = &s3ReleaseStore{
+			client:   s3.New(h.awsSession, awsConfig),
+			bucket:   storeConfig.bucket,
+			endpoint: strings.TrimSuffix(storeConfig.endpoint, "/"),
+		}
+		fmt.Fprintf(h.ErrorStream, "  %s config.params.release_store: s3-compatible bucket %s at %s\n", h.styles.tick, storeConfig.bucket, storeConfig.endpoint)
+	case "filesystem":
+		h.releaseStore = NewFilesystemReleaseStore(storeConfig.path)
+		fmt.Fprintf(h.ErrorStream, "  %s config.params.release_store: filesystem at %s\n", h.styles.tick, storeConfig.path)
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const filesystemMetadataSuffix = ".metadata.json"
+
+type filesystemReleaseStore struct {
+	dir string
+}
+
+// NewFilesystemReleaseStore returns a ReleaseStore that keeps releases in a local directory, for offline development and testing.
+func NewFilesystemReleaseStore(dir string) ReleaseStore {
+	return &filesystemReleaseStore{dir: dir}
+}
+
+type filesystemMetadata struct {
+	ETag     string
+	Metadata map[string]string
+}
+
+func (s *filesystemReleaseStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *filesystemReleaseStore) Put(key string, body io.Reader, metadata map[string]string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	metadataJSON, err := json.Marshal(&filesystemMetadata{
+		ETag:     fmt.Sprintf("%x", hash.Sum(nil)),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+filesystemMetadataSuffix, metadataJSON, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *filesystemReleaseStore) Get(key string) (io.ReadCloser, *ReleaseObject, error) {
+	object, err := s.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, object, nil
+}
+
+func (s *filesystemReleaseStore) Head(key string) (*ReleaseObject, error) {
+	path := s.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata filesystemMetadata
+	data, err := ioutil.ReadFile(path + filesystemMetadataSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("invalid release metadata in %s%s: %v", path, filesystemMetadataSuffix, err)
+		}
+	}
+	return &ReleaseObject{
+		Key:          key,
+		ETag:         metadata.ETag,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		Metadata:     metadata.Metadata,
+	}, nil
+}
+
+func (s *filesystemReleaseStore) URL(key string) string {
+	return "file://" + filepath.ToSlash(s.path(key))
+}
+
+func (s *filesystemReleaseStore) List(prefix string) ([]*ReleaseObject, error) {
+	var result []*ReleaseObject
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, filesystemMetadataSuffix) || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		relative, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		object, err := s.Head(key)
+		if err != nil {
+			return err
+		}
+		object.Metadata = nil
+		result = append(result, object)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return result, err
+}
+
+func (s *filesystemReleaseStore) Delete(key string) error {
+	path := s.path(key)
+	if err := os.Remove(path + filesystemMetadataSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
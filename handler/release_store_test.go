@@ -0,0 +1,352 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cdflow2-config-aws-simple-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestFilesystemReleaseStore(t *testing.T) {
+	// Given
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+
+	// When
+	err := store.Put("team/component/component-1.zip", strings.NewReader("release"), map[string]string{"commit": "abc123"})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	head, err := store.Head("team/component/component-1.zip")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if head.Metadata["commit"] != "abc123" || head.Size != int64(len("release")) || head.ETag == "" {
+		t.Fatalf("unexpected release object: %+v", head)
+	}
+	reader, _, err := store.Get("team/component/component-1.zip")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer reader.Close()
+	contents, _ := ioutil.ReadAll(reader)
+	if string(contents) != "release" {
+		t.Fatalf("expected %q, got %q", "release", contents)
+	}
+	if _, err := store.Head("team/component/component-2.zip"); !os.IsNotExist(err) {
+		t.Fatal("expected not exist error for missing release, got:", err)
+	}
+}
+
+func TestListAndDeleteReleases(t *testing.T) {
+	keys := []string{"team/component/component-1.zip", "team/component/component-2.zip", "team/other/other-1.zip"}
+	for name, create := range map[string]func(t *testing.T) handler.ReleaseStore{
+		"filesystem": func(t *testing.T) handler.ReleaseStore {
+			store := handler.NewFilesystemReleaseStore(tempDir(t))
+			for _, key := range keys {
+				if err := store.Put(key, strings.NewReader("release"), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return store
+		},
+		"s3": func(t *testing.T) handler.ReleaseStore {
+			s3Client := newMemoryS3("cdflow2-release-bucket-1")
+			for _, key := range keys {
+				s3Client.put("cdflow2-release-bucket-1", key, []byte("release"))
+			}
+			return handler.NewS3ReleaseStore(s3Client, "cdflow2-release-bucket-1")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Given
+			store := create(t)
+
+			// When
+			err := store.Delete("team/component/component-1.zip")
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			objects, err := store.List("team/component/")
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(objects) != 1 || objects[0].Key != "team/component/component-2.zip" || objects[0].Size != int64(len("release")) {
+				t.Fatalf("unexpected releases: %+v", objects)
+			}
+		})
+	}
+}
+
+func TestUploadThenPrepareTerraformWithFilesystemReleaseStore(t *testing.T) {
+	// Given
+	storeDir := tempDir(t)
+	buildDir := tempDir(t)
+	deployDir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(buildDir, "main.tf"), []byte("# terraform"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := map[string]interface{}{
+		"team":           "my-team",
+		"default_region": "eu-west-1",
+		"release_store": map[string]interface{}{
+			"type": "filesystem",
+			"path": storeDir,
+		},
+	}
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "test-access-key",
+		"AWS_SECRET_ACCESS_KEY": "test-secret-access-key",
+		"GITHUB_REF_NAME":       "main",
+	}
+	s3Client := newMemoryS3("cdflow2-tfstate-bucket-1")
+	newHandler := func(errorBuffer *bytes.Buffer) *handler.Handler {
+		return handler.New(&handler.Opts{
+			S3Client:             s3Client,
+			DynamoDBClient:       &mockedDynamoDB{},
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			OutputStream:         &bytes.Buffer{},
+			ErrorStream:          errorBuffer,
+		})
+	}
+
+	var releaseErrors bytes.Buffer
+	releaseHandler := newHandler(&releaseErrors)
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Component = "my-component"
+	configureReleaseRequest.Version = "1"
+	configureReleaseRequest.Commit = "abc123"
+	configureReleaseRequest.Config = config
+	configureReleaseRequest.Env = env
+	configureReleaseResponse := common.CreateConfigureReleaseResponse()
+	if err := releaseHandler.ConfigureRelease(configureReleaseRequest, configureReleaseResponse); err != nil || !configureReleaseResponse.Success {
+		t.Fatal("configure release failed:", err, releaseErrors.String())
+	}
+	uploadReleaseRequest := common.CreateUploadReleaseRequest()
+	uploadReleaseRequest.TerraformImage = "hashicorp/terraform:1.5.0"
+	uploadReleaseResponse := common.CreateUploadReleaseResponse()
+	if err := releaseHandler.UploadRelease(uploadReleaseRequest, uploadReleaseResponse, configureReleaseRequest, buildDir); err != nil || !uploadReleaseResponse.Success {
+		t.Fatal("upload release failed:", err, releaseErrors.String())
+	}
+
+	// When
+	var deployErrors bytes.Buffer
+	prepareTerraformRequest := common.CreatePrepareTerraformRequest()
+	prepareTerraformRequest.Component = "my-component"
+	prepareTerraformRequest.Version = "1"
+	prepareTerraformRequest.EnvName = "live"
+	prepareTerraformRequest.Config = config
+	prepareTerraformRequest.Env = env
+	prepareTerraformResponse := common.CreatePrepareTerraformResponse()
+	err := newHandler(&deployErrors).PrepareTerraform(prepareTerraformRequest, prepareTerraformResponse, deployDir)
+
+	// Then
+	if err != nil || !prepareTerraformResponse.Success {
+		t.Fatal("prepare terraform failed:", err, deployErrors.String())
+	}
+	if prepareTerraformResponse.TerraformImage != "hashicorp/terraform:1.5.0" {
+		t.Fatalf("unexpected terraform image: %q", prepareTerraformResponse.TerraformImage)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(deployDir, "main.tf"))
+	if err != nil || string(contents) != "# terraform" {
+		t.Fatal("expected release to be unpacked, got:", string(contents), err)
+	}
+	for _, expected := range []string{"commit:          abc123", "branch:          main"} {
+		if !strings.Contains(deployErrors.String(), expected) {
+			t.Fatalf("expected %q in output, got: %s", expected, deployErrors.String())
+		}
+	}
+	records := s3Client.keys("cdflow2-tfstate-bucket-1", "cdflow2-deployments/my-team/my-component/live/")
+	if len(records) != 1 {
+		t.Fatalf("expected one deployment record, got: %v", records)
+	}
+	var record map[string]interface{}
+	data, _ := s3Client.get("cdflow2-tfstate-bucket-1", records[0])
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["version"] != "1" || record["account"] != "123456789012" || record["release_checksum"] == "" {
+		t.Fatalf("unexpected deployment record: %s", data)
+	}
+}
+
+func TestUploadReleaseMetadataLimits(t *testing.T) {
+	notes := strings.Repeat("x", 2048)
+	for _, test := range []struct {
+		name          string
+		filesystem    bool
+		branch        string
+		metadata      map[string]map[string]string
+		warning       string
+		buildMetadata string
+	}{
+		{
+			"too large", false, "main", map[string]map[string]string{"web": {"notes": notes}},
+			"release metadata build-metadata (2774 bytes) not stored, as S3 allows only 2048 bytes of metadata", `{"web":{}}`,
+		},
+		{
+			"too large for s3 in filesystem store", true, "main",
+			map[string]map[string]string{"web": {"notes": notes}}, "", `{"web":{"notes":"` + notes + `"}}`,
+		},
+		{"not ascii", false, "feature/café", nil, "", `{}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			buildDir := tempDir(t)
+			if err := ioutil.WriteFile(filepath.Join(buildDir, "main.tf"), []byte("# terraform"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config := map[string]interface{}{}
+			if test.filesystem {
+				config["release_store"] = map[string]interface{}{"type": "filesystem", "path": tempDir(t)}
+			}
+			s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+			var errorBuffer bytes.Buffer
+			myHandler := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer})
+			configureReleaseRequest := common.CreateConfigureReleaseRequest()
+			configureReleaseRequest.Component = "my-component"
+			configureReleaseRequest.Version = "1"
+			configureReleaseRequest.Config = commandRequest().Config
+			for key, value := range config {
+				configureReleaseRequest.Config[key] = value
+			}
+			configureReleaseRequest.Env = commandRequest().Env
+			configureReleaseRequest.Env["CDFLOW2_BRANCH"] = test.branch
+			if err := myHandler.ConfigureRelease(configureReleaseRequest, common.CreateConfigureReleaseResponse()); err != nil {
+				t.Fatal("configure release failed:", err, errorBuffer.String())
+			}
+			uploadReleaseRequest := common.CreateUploadReleaseRequest()
+			uploadReleaseRequest.TerraformImage = "hashicorp/terraform:1.5.0"
+			uploadReleaseRequest.ReleaseMetadata = test.metadata
+			uploadReleaseResponse := common.CreateUploadReleaseResponse()
+
+			// When
+			err := myHandler.UploadRelease(uploadReleaseRequest, uploadReleaseResponse, configureReleaseRequest, buildDir)
+
+			// Then
+			if err != nil || !uploadReleaseResponse.Success {
+				t.Fatal("upload release failed:", err, errorBuffer.String())
+			}
+			if test.warning != "" && !strings.Contains(errorBuffer.String(), test.warning) {
+				t.Fatalf("expected warning %q, got: %s", test.warning, errorBuffer.String())
+			}
+			if test.warning == "" && strings.Contains(errorBuffer.String(), "not stored") {
+				t.Fatalf("unexpected warning: %s", errorBuffer.String())
+			}
+			if object, ok := s3Client.objects["cdflow2-release-bucket-1/my-team/my-component/my-component-1.zip"]; ok {
+				for key, value := range object.metadata {
+					for _, c := range key + aws.StringValue(value) {
+						if c < ' ' || c > '~' {
+							t.Fatalf("expected printable ASCII metadata, got %s: %q", key, aws.StringValue(value))
+						}
+					}
+				}
+			}
+			response, output := prepareTerraform(t, handler.Opts{S3Client: s3Client}, "1", config, nil)
+			if !response.Success {
+				t.Fatal("expected success:", output)
+			}
+			if !strings.Contains(output, "branch:          "+test.branch) {
+				t.Fatalf("expected branch %s in output: %s", test.branch, output)
+			}
+			if response.Env["TF_VAR_cdflow2_build_metadata"] != test.buildMetadata {
+				t.Fatalf("expected build metadata %s, got %s", test.buildMetadata, response.Env["TF_VAR_cdflow2_build_metadata"])
+			}
+		})
+	}
+}
+
+func TestUploadReleaseBuildMetadataRoundTrip(t *testing.T) {
+	// Given
+	releaseStore := map[string]interface{}{"type": "filesystem", "path": tempDir(t)}
+	buildDir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(buildDir, "main.tf"), []byte("# terraform"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	var errorBuffer bytes.Buffer
+	releaseHandler := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer})
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Component = "my-component"
+	configureReleaseRequest.Version = "1"
+	configureReleaseRequest.Config = commandRequest().Config
+	configureReleaseRequest.Config["release_store"] = releaseStore
+	configureReleaseRequest.Env = commandRequest().Env
+	if err := releaseHandler.ConfigureRelease(configureReleaseRequest, common.CreateConfigureReleaseResponse()); err != nil {
+		t.Fatal("configure release failed:", err, errorBuffer.String())
+	}
+	uploadReleaseRequest := common.CreateUploadReleaseRequest()
+	uploadReleaseRequest.TerraformImage = "hashicorp/terraform:1.5.0"
+	// keys that differ only in case or punctuation must be kept apart
+	uploadReleaseRequest.ReleaseMetadata = map[string]map[string]string{
+		"Web_App": {"image_digest": "sha256:1234", "Image_Digest": "sha256:5678"},
+		"a":       {"b-c": "1"},
+		"a-":      {"c": "2"},
+	}
+	uploadReleaseResponse := common.CreateUploadReleaseResponse()
+	if err := releaseHandler.UploadRelease(uploadReleaseRequest, uploadReleaseResponse, configureReleaseRequest, buildDir); err != nil || !uploadReleaseResponse.Success {
+		t.Fatal("upload release failed:", err, errorBuffer.String())
+	}
+
+	// When
+	response, output := prepareTerraform(t, handler.Opts{S3Client: s3Client}, "1", map[string]interface{}{"release_store": releaseStore}, nil)
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	expected := `{"Web_App":{"Image_Digest":"sha256:5678","image_digest":"sha256:1234"},"a":{"b-c":"1"},"a-":{"c":"2"}}`
+	if response.Env["TF_VAR_cdflow2_build_metadata"] != expected {
+		t.Fatalf("expected build metadata %s, got %s", expected, response.Env["TF_VAR_cdflow2_build_metadata"])
+	}
+}
+
+// putRelease stores a minimal release for my-team/my-component in the store.
+func putRelease(t *testing.T, store handler.ReleaseStore, version string) {
+	buildDir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(buildDir, "main.tf"), []byte("# version "+version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var release bytes.Buffer
+	if err := common.ZipRelease(&release, buildDir, "my-component", version, "hashicorp/terraform:1.5.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("my-team/my-component/my-component-"+version+".zip", &release, map[string]string{"version": version}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func prepareTerraformRequest(env, version string) *common.PrepareTerraformRequest {
+	request := common.CreatePrepareTerraformRequest()
+	request.Component = "my-component"
+	request.Version = version
+	request.EnvName = env
+	request.Config["team"] = "my-team"
+	request.Config["default_region"] = "eu-west-1"
+	request.Env["AWS_ACCESS_KEY_ID"] = "test-access-key"
+	request.Env["AWS_SECRET_ACCESS_KEY"] = "test-secret-access-key"
+	return request
+}
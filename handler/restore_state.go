@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-simple-aws/internal/ui"
+)
+
+// RestoreStateRequest is the input to the restore-state command.
+type RestoreStateRequest struct {
+	CommandRequest
+	EnvName string
+	// VersionID is the version of the state to restore - when empty the versions are listed.
+	VersionID string
+	// Limit is the maximum number of versions to list.
+	Limit int
+}
+
+// stateVersion is a version of the terraform state object in the versioned tfstate bucket.
+type stateVersion struct {
+	versionID    string
+	lastModified time.Time
+	size         int64
+	isLatest     bool
+	deleteMarker bool
+	// release is the version of the release whose deployment wrote the state, if known.
+	release string
+	// snapshotFor is the version of the release whose deployment recorded this as the state before deploying.
+	snapshotFor string
+}
+
+// listStateVersions returns the versions of the environment's state, most recent first.
+func (h *Handler) listStateVersions(backend *stateBackend, env string) ([]*stateVersion, error) {
+	key := backend.stateKey(env)
+	var result []*stateVersion
+	if err := h.getStateS3Client(backend).ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(backend.bucket),
+		Prefix: aws.String(key),
+	}, func(output *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range output.Versions {
+			if aws.StringValue(version.Key) != key {
+				continue
+			}
+			result = append(result, &stateVersion{
+				versionID:    aws.StringValue(version.VersionId),
+				lastModified: aws.TimeValue(version.LastModified),
+				size:         aws.Int64Value(version.Size),
+				isLatest:     aws.BoolValue(version.IsLatest),
+			})
+		}
+		for _, marker := range output.DeleteMarkers {
+			if aws.StringValue(marker.Key) != key {
+				continue
+			}
+			result = append(result, &stateVersion{
+				versionID:    aws.StringValue(marker.VersionId),
+				lastModified: aws.TimeValue(marker.LastModified),
+				isLatest:     aws.BoolValue(marker.IsLatest),
+				deleteMarker: true,
+			})
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].lastModified.After(result[j].lastModified)
+	})
+	return result, nil
+}
+
+// annotateStateVersions sets the releases each state version belongs to from the recorded deployments - the state is written by
+// terraform after the deployment is recorded, so a version belongs to the last release deployed before it was written.
+func (h *Handler) annotateStateVersions(team, component, env string, versions []*stateVersion) error {
+	keys, err := h.listDeploymentKeys(team, component, env)
+	if err != nil {
+		return err
+	}
+	var records []*deploymentRecord
+	for _, key := range keys {
+		record, err := h.getDeploymentRecord(key)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	for _, version := range versions {
+		if version.deleteMarker {
+			continue
+		}
+		for _, record := range records {
+			if record.Timestamp.Before(version.lastModified) {
+				version.release = record.Version
+			}
+			if record.StateVersionID == version.versionID {
+				version.snapshotFor = record.Version
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) printStateVersions(versions []*stateVersion) error {
+	writer := tabwriter.NewWriter(h.OutputStream, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION ID\tMODIFIED\tSIZE\tRELEASE\tNOTES")
+	for _, version := range versions {
+		release, size, notes := "-", "-", ""
+		if version.release != "" {
+			release = version.release
+		}
+		if version.deleteMarker {
+			notes = "deleted"
+		} else {
+			size = fmt.Sprintf("%d", version.size)
+		}
+		if version.snapshotFor != "" {
+			notes = "before deploying " + version.snapshotFor
+		}
+		if version.isLatest {
+			if notes != "" {
+				notes = "current, " + notes
+			} else {
+				notes = "current"
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", version.versionID, version.lastModified.UTC().Format("2006-01-02 15:04:05 MST"), size, release, notes)
+	}
+	return writer.Flush()
+}
+
+// RestoreState lists the versions of an environment's terraform state, or makes a previous version current again.
+func (h *Handler) RestoreState(request *RestoreStateRequest) error {
+	if request.EnvName == "" {
+		fmt.Fprintln(h.ErrorStream, "env must be specified")
+		return Exit(false)
+	}
+	team, err := h.prepareCommand(&request.CommandRequest)
+	if err != nil {
+		return err
+	}
+	backend, err := h.getStateBackend(request.Config, team, request.Component, request.EnvName)
+	if err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		return Exit(false)
+	}
+	h.printStateBackend(request.EnvName, backend)
+
+	versions, err := h.listStateVersions(backend, request.EnvName)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to list versions of the terraform state: %v\n", err)
+		return Exit(false)
+	}
+	if len(versions) == 0 {
+		fmt.Fprintf(h.ErrorStream, "No terraform state found for %s.\n", request.EnvName)
+		return Exit(false)
+	}
+	if err := h.annotateStateVersions(team, request.Component, request.EnvName, versions); err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to get deployments to %s: %v\n", request.EnvName, err)
+		return Exit(false)
+	}
+
+	if request.VersionID == "" {
+		if request.Limit > 0 && len(versions) > request.Limit {
+			versions = versions[:request.Limit]
+		}
+		return h.printStateVersions(versions)
+	}
+
+	var selected *stateVersion
+	for _, version := range versions {
+		if version.versionID == request.VersionID {
+			selected = version
+		}
+	}
+	if selected == nil {
+		fmt.Fprintf(h.ErrorStream, "Version %s of the terraform state for %s not found.\n", request.VersionID, request.EnvName)
+		return Exit(false)
+	}
+	if selected.deleteMarker {
+		fmt.Fprintf(h.ErrorStream, "Version %s is a delete marker, not a version of the terraform state that can be restored.\n", request.VersionID)
+		return Exit(false)
+	}
+	if selected.isLatest {
+		fmt.Fprintf(h.ErrorStream, "Version %s is already the current terraform state.\n", request.VersionID)
+		return nil
+	}
+	if err := h.printStateVersions([]*stateVersion{selected}); err != nil {
+		return err
+	}
+	locks, err := h.getStateLocks(backend, request.EnvName)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to check for a lock on the terraform state: %v\n", err)
+		return Exit(false)
+	}
+	for _, lock := range locks {
+		fmt.Fprintf(h.ErrorStream, "Not restoring, the terraform state for %s is ", request.EnvName)
+		h.printStateLock(lock, "")
+		return Exit(false)
+	}
+	if !ui.Confirm(fmt.Sprintf(
+		"Restore version %s as the current terraform state for %s? Only 'yes' will be accepted to confirm: ", request.VersionID, request.EnvName,
+	), h.InputStream, h.ErrorStream) {
+		fmt.Fprintln(h.ErrorStream, "Restore cancelled.")
+		return Exit(false)
+	}
+	if err := h.restoreStateVersion(backend, request.EnvName, request.VersionID); err != nil {
+		fmt.Fprintf(h.ErrorStream, "Unable to restore the terraform state: %v\n", err)
+		return Exit(false)
+	}
+	fmt.Fprintf(h.ErrorStream, "%s Restored version %s as the current terraform state for %s.\n", h.styles.tick, request.VersionID, request.EnvName)
+	return nil
+}
+
+// restoreStateVersion copies a version of the state back as the current version. When the state is locked with DynamoDB, terraform
+// also keeps the digest of the state in the lock table, which is updated to match.
+func (h *Handler) restoreStateVersion(backend *stateBackend, env, versionID string) error {
+	client := h.getStateS3Client(backend)
+	key := backend.stateKey(env)
+
+	object, err := client.GetObject(&s3.GetObjectInput{
+		Bucket:    aws.String(backend.bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return err
+	}
+	digest := md5.New()
+	_, err = io.Copy(digest, object.Body)
+	object.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	copySource := (&url.URL{Path: backend.bucket + "/" + key}).EscapedPath() + "?versionId=" + url.QueryEscape(versionID)
+	if _, err := client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(backend.bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(copySource),
+	}); err != nil {
+		return err
+	}
+
+	if backend.lockTable == "" {
+		return nil
+	}
+	_, err = h.getStateDynamoDBClient(backend).PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(backend.lockTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(backend.bucket + "/" + key + "-md5")},
+			"Digest": {S: aws.String(fmt.Sprintf("%x", digest.Sum(nil)))},
+		},
+	})
+	return err
+}
@@ -0,0 +1,158 @@
+package handler_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+const liveStateKey = "my-team/my-component/live/terraform.tfstate"
+
+func TestPrepareTerraformRecordsStateVersion(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-tfstate-bucket-1")
+	stateVersionID := s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte("state-1"), time.Now())
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	putRelease(t, store, "2")
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             s3Client,
+		DynamoDBClient:       &mockedDynamoDB{},
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		IAMClient:            mockedIAM{},
+		ReleaseStore:         store,
+		OutputStream:         &bytes.Buffer{},
+		ErrorStream:          &errorBuffer,
+	})
+	response := common.CreatePrepareTerraformResponse()
+
+	// When
+	err := myHandler.PrepareTerraform(prepareTerraformRequest("live", "2"), response, tempDir(t))
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+	}
+	keys := s3Client.keys("cdflow2-tfstate-bucket-1", "cdflow2-deployments/my-team/my-component/live/")
+	if len(keys) != 1 {
+		t.Fatalf("expected one deployment record, got %v", keys)
+	}
+	record, _ := s3Client.get("cdflow2-tfstate-bucket-1", keys[0])
+	if !strings.Contains(string(record), fmt.Sprintf(`"state_version_id": %q`, stateVersionID)) {
+		t.Fatalf("expected state version in deployment record, got: %s", record)
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	setup := func(t *testing.T, input string) (*handler.Handler, *memoryS3, *memoryDynamoDB, *bytes.Buffer, *bytes.Buffer, string) {
+		s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+		putDeploymentRecord(s3Client, "live", "1", start)
+		state1 := s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte("state-1"), start.Add(time.Minute))
+		s3Client.put(
+			"cdflow2-tfstate-bucket-1",
+			"cdflow2-deployments/my-team/my-component/live/"+start.Add(time.Hour).Format("2006-01-02T15-04-05.000000000Z")+".json",
+			[]byte(fmt.Sprintf(
+				`{"team": "my-team", "component": "my-component", "env": "live", "version": "2", "timestamp": %q, "state_version_id": %q}`,
+				start.Add(time.Hour).Format(time.RFC3339), state1,
+			)),
+		)
+		s3Client.putAt("cdflow2-tfstate-bucket-1", liveStateKey, []byte("state-2"), start.Add(time.Hour+time.Minute))
+		dynamoDBClient := newMemoryDynamoDB()
+		var outputBuffer, errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             s3Client,
+			DynamoDBClient:       dynamoDBClient,
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			InputStream:          strings.NewReader(input),
+			OutputStream:         &outputBuffer,
+			ErrorStream:          &errorBuffer,
+		}), s3Client, dynamoDBClient, &outputBuffer, &errorBuffer, state1
+	}
+
+	t.Run("list versions", func(t *testing.T) {
+		// Given
+		myHandler, _, _, outputBuffer, errorBuffer, state1 := setup(t, "")
+
+		// When
+		err := myHandler.RestoreState(&handler.RestoreStateRequest{CommandRequest: commandRequest(), EnvName: "live"})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		lines := strings.Split(strings.TrimSpace(outputBuffer.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("expected header and two versions, got:\n%s", outputBuffer.String())
+		}
+		if fields := strings.Fields(lines[1]); fields[len(fields)-2] != "2" || fields[len(fields)-1] != "current" {
+			t.Fatalf("expected current version written by release 2, got: %q", lines[1])
+		}
+		if fields := strings.Fields(lines[2]); fields[0] != state1 || strings.Join(fields[len(fields)-4:], " ") != "1 before deploying 2" {
+			t.Fatalf("expected previous version written by release 1, got: %q", lines[2])
+		}
+	})
+
+	t.Run("restore version", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, dynamoDBClient, _, errorBuffer, state1 := setup(t, "yes\n")
+
+		// When
+		err := myHandler.RestoreState(&handler.RestoreStateRequest{CommandRequest: commandRequest(), EnvName: "live", VersionID: state1})
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err, errorBuffer.String())
+		}
+		if data, _ := s3Client.get("cdflow2-tfstate-bucket-1", liveStateKey); string(data) != "state-1" {
+			t.Fatalf("expected state-1 to be restored, got %q", data)
+		}
+		digest := dynamoDBClient.items["cdflow2-tflocks/cdflow2-tfstate-bucket-1/"+liveStateKey+"-md5"]
+		if digest == nil || aws.StringValue(digest["Digest"].S) != fmt.Sprintf("%x", md5.Sum([]byte("state-1"))) {
+			t.Fatalf("expected state digest to be updated, got %v", digest)
+		}
+	})
+
+	t.Run("restore cancelled", func(t *testing.T) {
+		// Given
+		myHandler, s3Client, _, _, errorBuffer, state1 := setup(t, "no\n")
+
+		// When
+		err := myHandler.RestoreState(&handler.RestoreStateRequest{CommandRequest: commandRequest(), EnvName: "live", VersionID: state1})
+
+		// Then
+		if err != handler.Exit(false) {
+			t.Fatalf("expected Exit(false), got %v", err)
+		}
+		if data, _ := s3Client.get("cdflow2-tfstate-bucket-1", liveStateKey); string(data) != "state-2" {
+			t.Fatalf("expected state to be unchanged, got %q", data)
+		}
+		if !strings.Contains(errorBuffer.String(), "Restore cancelled.") {
+			t.Fatalf("unexpected output: %q", errorBuffer.String())
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		// Given
+		myHandler, _, _, _, errorBuffer, _ := setup(t, "yes\n")
+
+		// When
+		err := myHandler.RestoreState(&handler.RestoreStateRequest{CommandRequest: commandRequest(), EnvName: "live", VersionID: "unknown"})
+
+		// Then
+		if err != handler.Exit(false) || !strings.Contains(errorBuffer.String(), "Version unknown of the terraform state for live not found.") {
+			t.Fatalf("unexpected result: %v, %q", err, errorBuffer.String())
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// resolveVersion turns a symbolic version into the concrete version of a release using the recorded deployment history:
+//
+//	previous      the version deployed to env before the current one
+//	previous-N    the version deployed N versions before the current one (previous-1 is the same as previous)
+//	from:<other>  the version currently deployed to the other environment
+//
+// Any other version is returned unchanged. When the version is resolved a description of where it came from is also returned.
+func (h *Handler) resolveVersion(team, component, env, version string) (string, string, error) {
+	if strings.HasPrefix(version, "from:") {
+		sourceEnv := strings.TrimPrefix(version, "from:")
+		if sourceEnv == "" {
+			return "", "", fmt.Errorf("invalid version %q, expected from:<environment>", version)
+		}
+		history, err := h.listDeploymentHistory(team, component, sourceEnv, 1)
+		if err != nil {
+			return "", "", err
+		}
+		if len(history) == 0 {
+			return "", "", fmt.Errorf("unable to resolve version %q: no deployments of %s to %s recorded", version, component, sourceEnv)
+		}
+		return history[0].Version, fmt.Sprintf("currently deployed to %s, since %s", sourceEnv, history[0].Timestamp.UTC().Format("2006-01-02 15:04:05 MST")), nil
+	}
+
+	if version != "previous" && !strings.HasPrefix(version, "previous-") {
+		return version, "", nil
+	}
+	steps := 1
+	if version != "previous" {
+		var err error
+		steps, err = strconv.Atoi(strings.TrimPrefix(version, "previous-"))
+		if err != nil || steps < 1 {
+			return "", "", fmt.Errorf("invalid version %q, expected previous or previous-<N> where N is at least 1", version)
+		}
+	}
+	history, err := h.listDeploymentHistory(team, component, env, steps+1)
+	if err != nil {
+		return "", "", err
+	}
+	if len(history) <= steps {
+		return "", "", fmt.Errorf(
+			"unable to resolve version %q: only %d version(s) of %s recorded as deployed to %s", version, len(history), component, env,
+		)
+	}
+	record := history[steps]
+	return record.Version, fmt.Sprintf(
+		"deployed to %s at %s, %d version(s) before the current version %s", env, record.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"), steps, history[0].Version,
+	), nil
+}
@@ -0,0 +1,93 @@
+package handler_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestPrepareTerraformWithSymbolicVersion(t *testing.T) {
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	setup := func(t *testing.T) (*handler.Handler, *bytes.Buffer) {
+		s3Client := newMemoryS3("cdflow2-tfstate-bucket-1")
+		putDeploymentRecord(s3Client, "live", "1", start)
+		putDeploymentRecord(s3Client, "live", "2", start.Add(time.Hour))
+		putDeploymentRecord(s3Client, "live", "3", start.Add(2*time.Hour))
+		putDeploymentRecord(s3Client, "ci", "4", start.Add(3*time.Hour))
+		store := handler.NewFilesystemReleaseStore(tempDir(t))
+		for _, version := range []string{"1", "2", "3", "4"} {
+			putRelease(t, store, version)
+		}
+		var errorBuffer bytes.Buffer
+		return handler.New(&handler.Opts{
+			S3Client:             s3Client,
+			DynamoDBClient:       &mockedDynamoDB{},
+			SecretsManagerClient: mockedSecretsManager{},
+			STSClient:            mockedSTS{account: "123456789012"},
+			IAMClient:            mockedIAM{},
+			ReleaseStore:         store,
+			OutputStream:         &bytes.Buffer{},
+			ErrorStream:          &errorBuffer,
+		}), &errorBuffer
+	}
+
+	for _, test := range []struct {
+		version  string
+		expected string
+	}{
+		{"previous", "2"},
+		{"previous-1", "2"},
+		{"previous-2", "1"},
+		{"from:ci", "4"},
+		{"3", "3"},
+	} {
+		t.Run(test.version, func(t *testing.T) {
+			// Given
+			myHandler, errorBuffer := setup(t)
+			releaseDir := tempDir(t)
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(prepareTerraformRequest("live", test.version), response, releaseDir)
+
+			// Then
+			if err != nil || !response.Success {
+				t.Fatal("prepare terraform failed:", err, errorBuffer.String())
+			}
+			contents, _ := ioutil.ReadFile(filepath.Join(releaseDir, "main.tf"))
+			if string(contents) != "# version "+test.expected {
+				t.Fatalf("expected version %s to be unpacked, got %q", test.expected, contents)
+			}
+			if test.version != test.expected && !strings.Contains(errorBuffer.String(), `Resolved version "`+test.version+`" to `+test.expected) {
+				t.Fatal("expected resolution to be output, got:", errorBuffer.String())
+			}
+		})
+	}
+
+	t.Run("not enough history", func(t *testing.T) {
+		// Given
+		myHandler, errorBuffer := setup(t)
+		response := common.CreatePrepareTerraformResponse()
+
+		// When
+		err := myHandler.PrepareTerraform(prepareTerraformRequest("live", "previous-3"), response, tempDir(t))
+
+		// Then
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if response.Success {
+			t.Fatal("unexpected success")
+		}
+		if !strings.Contains(errorBuffer.String(), "only 3 version(s) of my-component recorded as deployed to live") {
+			t.Fatal("expected explanation, got:", errorBuffer.String())
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+var validEnvVarName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// secretReference is a value in config.params.environments.<env>.secrets - either the id (name or ARN) of a secret, or
+// <id>#<key> for a key in a secret containing a JSON object.
+type secretReference struct {
+	secretID string
+	jsonKey  string
+}
+
+func (s *secretReference) String() string {
+	if s.jsonKey == "" {
+		return s.secretID
+	}
+	return s.secretID + "#" + s.jsonKey
+}
+
+func parseSecretReferences(env string, raw interface{}) (map[string]*secretReference, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	params, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.environments.%s.secrets must be a map of environment variable to secret", env)
+	}
+	result := make(map[string]*secretReference)
+	for name, value := range params {
+		if !validEnvVarName.MatchString(name) {
+			return nil, fmt.Errorf("config.params.environments.%s.secrets.%s is not a valid environment variable name", env, name)
+		}
+		if strings.HasPrefix(name, "AWS_") {
+			return nil, fmt.Errorf("config.params.environments.%s.secrets.%s would replace the AWS credentials for the deploy", env, name)
+		}
+		stringValue, ok := value.(string)
+		if !ok || stringValue == "" {
+			return nil, fmt.Errorf("config.params.environments.%s.secrets.%s must be a secret id, or <secret id>#<json key>", env, name)
+		}
+		var reference secretReference
+		reference.secretID = stringValue
+		if index := strings.LastIndex(stringValue, "#"); index != -1 {
+			reference.secretID, reference.jsonKey = stringValue[:index], stringValue[index+1:]
+			if reference.secretID == "" || reference.jsonKey == "" {
+				return nil, fmt.Errorf("config.params.environments.%s.secrets.%s must be a secret id, or <secret id>#<json key>", env, name)
+			}
+		}
+		result[name] = &reference
+	}
+	return result, nil
+}
+
+// addEnvironmentSecrets fetches the secrets for the environment from Secrets Manager in the environment's region, using the credentials
+// for the deploy, and adds them to the environment for terraform.
+func (h *Handler) addEnvironmentSecrets(config map[string]interface{}, env string, responseEnv map[string]string) error {
+	envConfig, err := getEnvironmentConfig(config, env)
+	if err != nil {
+		return err
+	}
+	if len(envConfig.secrets) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range envConfig.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	region := envConfig.region
+	if region == "" {
+		region = h.defaultRegion
+	}
+	fmt.Fprintf(h.ErrorStream, "- Fetching secrets for %s from Secrets Manager in %s...\n", env, region)
+	client := h.getSecretsManagerClientForRegion(region)
+
+	secretStrings := make(map[string]string)
+	for _, name := range names {
+		reference := envConfig.secrets[name]
+		secretString, ok := secretStrings[reference.secretID]
+		if !ok {
+			output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+				SecretId: aws.String(reference.secretID),
+			})
+			if err != nil {
+				return fmt.Errorf("unable to fetch secret %s for %s: %v", reference.secretID, name, err)
+			}
+			secretString = aws.StringValue(output.SecretString)
+			secretStrings[reference.secretID] = secretString
+		}
+		value := secretString
+		if reference.jsonKey != "" {
+			var values map[string]interface{}
+			if err := json.Unmarshal([]byte(secretString), &values); err != nil {
+				return fmt.Errorf("unable to read key %q from secret %s for %s, the secret is not a JSON object", reference.jsonKey, reference.secretID, name)
+			}
+			keyValue, ok := values[reference.jsonKey].(string)
+			if !ok {
+				return fmt.Errorf("secret %s for %s has no string value for key %q", reference.secretID, name, reference.jsonKey)
+			}
+			value = keyValue
+		}
+		responseEnv[name] = value
+		fmt.Fprintf(h.ErrorStream, "  %s %s from secret %s\n", h.styles.tick, name, reference)
+	}
+	return nil
+}
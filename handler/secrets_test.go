@@ -0,0 +1,104 @@
+package handler_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// prepareTerraformSecrets runs prepare terraform with the config for live, with secrets in the default region and us-east-1.
+func prepareTerraformSecrets(t *testing.T, envConfig map[string]interface{}, env map[string]string) (*common.PrepareTerraformResponse, string) {
+	return prepareTerraform(t, handler.Opts{
+		SecretsManagerClient: mockedSecretsManager{secrets: map[string]string{
+			"live/github":    "live-github-token",
+			"live/providers": `{"fastly": "live-fastly-key", "port": 443}`,
+		}},
+		S3ClientFactory: s3ClientFactory(t, map[string]s3iface.S3API{
+			" us-east-1": newMemoryS3("live-tfstate"),
+		}),
+		DynamoDBClientFactory: dynamoDBClientFactory(t, map[string]dynamodbiface.DynamoDBAPI{
+			" us-east-1": &mockedDynamoDB{},
+		}),
+		SecretsManagerClientFactory: func(region string) secretsmanageriface.SecretsManagerAPI {
+			if region != "us-east-1" {
+				t.Fatalf("unexpected secrets manager client for region %q", region)
+			}
+			return mockedSecretsManager{secrets: map[string]string{"live/github": "us-east-1-github-token"}}
+		},
+	}, "", map[string]interface{}{
+		"environments": map[string]interface{}{"live": envConfig},
+	}, env)
+}
+
+func TestPrepareTerraformSecrets(t *testing.T) {
+	// When
+	response, output := prepareTerraformSecrets(t, map[string]interface{}{
+		"secrets": map[string]interface{}{
+			"GITHUB_TOKEN":   "live/github",
+			"FASTLY_API_KEY": "live/providers#fastly",
+		},
+	}, map[string]string{"GITHUB_TOKEN": "caller-github-token"})
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	if response.Env["GITHUB_TOKEN"] != "live-github-token" {
+		t.Fatalf("expected secret to take precedence over the caller's environment, got %q", response.Env["GITHUB_TOKEN"])
+	}
+	if response.Env["FASTLY_API_KEY"] != "live-fastly-key" {
+		t.Fatalf("expected json key from secret, got %q", response.Env["FASTLY_API_KEY"])
+	}
+	if strings.Contains(output, "live-github-token") || !strings.Contains(output, "FASTLY_API_KEY from secret live/providers#fastly") {
+		t.Fatalf("unexpected output: %q", output)
+	}
+}
+
+func TestPrepareTerraformSecretsRegion(t *testing.T) {
+	// When
+	response, output := prepareTerraformSecrets(t, map[string]interface{}{
+		"region":         "us-east-1",
+		"tfstate_bucket": "live-tfstate",
+		"secrets":        map[string]interface{}{"GITHUB_TOKEN": "live/github"},
+	}, nil)
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	if response.Env["GITHUB_TOKEN"] != "us-east-1-github-token" {
+		t.Fatalf("expected secret from the environment's region, got %q", response.Env["GITHUB_TOKEN"])
+	}
+	if !strings.Contains(output, "Fetching secrets for live from Secrets Manager in us-east-1") {
+		t.Fatalf("unexpected output: %q", output)
+	}
+}
+
+func TestPrepareTerraformSecretsErrors(t *testing.T) {
+	for _, test := range []struct {
+		secrets  interface{}
+		expected string
+	}{
+		{"live/github", "must be a map"},
+		{map[string]interface{}{"AWS_SECRET_ACCESS_KEY": "live/github"}, "would replace the AWS credentials"},
+		{map[string]interface{}{"NOT-VALID": "live/github"}, "not a valid environment variable name"},
+		{map[string]interface{}{"FASTLY_API_KEY": "live/providers#"}, "must be a secret id"},
+		{map[string]interface{}{"FASTLY_API_KEY": "live/providers#missing"}, `no string value for key "missing"`},
+		{map[string]interface{}{"PORT": "live/providers#port"}, `no string value for key "port"`},
+		{map[string]interface{}{"GITHUB_TOKEN": "live/github#token"}, "not a JSON object"},
+	} {
+		// When
+		response, output := prepareTerraformSecrets(t, map[string]interface{}{"secrets": test.secrets}, nil)
+
+		// Then
+		if response.Success || !strings.Contains(output, test.expected) {
+			t.Fatalf("expected failure containing %q for %v, got: %q", test.expected, test.secrets, output)
+		}
+	}
+}
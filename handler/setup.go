@@ -4,9 +4,12 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	common "github.com/mergermarket/cdflow2-config-common"
 )
 
@@ -24,20 +27,36 @@ func (h *Handler) Setup(request *common.SetupRequest, response *common.SetupResp
 		response.Monitoring.Data["team"] = team
 	}
 
+	githubOIDC, err := getGitHubOIDCConfig(request.Config, request.Component)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "  %s %v\n\n", h.styles.cross, err)
+		response.Success = false
+		return nil
+	}
+
+	if !h.checkPermissions(request.Config, team, request.Component, "setup") {
+		response.Success = false
+		return nil
+	}
+
 	fmt.Fprintf(h.ErrorStream, "%s\n\n", h.styles.au.Underline("Checking AWS resources..."))
 
 	buckets, err := listBuckets(h.getS3Client())
 	if err != nil {
 		fmt.Fprintf(h.ErrorStream, "%v\n\n", err)
+		response.Success = false
 		return nil
 	}
 
-	if err := h.checkOrCreateReleaseBucket(buckets); err != nil {
-		if success, ok := err.(Exit); ok {
-			response.Success = bool(success)
-			return nil
+	// releases are kept in config.params.release_store when it is set, rather than the account's release bucket
+	if h.releaseStore == nil {
+		if err := h.checkOrCreateReleaseBucket(buckets); err != nil {
+			if success, ok := err.(Exit); ok {
+				response.Success = bool(success)
+				return nil
+			}
+			return err
 		}
-		return err
 	}
 
 	if err := h.checkOrCreateTfstateBucket(buckets); err != nil {
@@ -48,12 +67,14 @@ func (h *Handler) Setup(request *common.SetupRequest, response *common.SetupResp
 		return err
 	}
 
-	if err := h.checkOrCreateTflocksTable(); err != nil {
-		if success, ok := err.(Exit); ok {
-			response.Success = bool(success)
-			return nil
+	if h.backendConfig.usesDynamoDBLocking() {
+		if err := h.checkOrCreateTflocksTable(); err != nil {
+			if success, ok := err.(Exit); ok {
+				response.Success = bool(success)
+				return nil
+			}
+			return err
 		}
-		return err
 	}
 
 	if h.requiresLambdaBucket(request.ReleaseRequirements) {
@@ -74,6 +95,24 @@ func (h *Handler) Setup(request *common.SetupRequest, response *common.SetupResp
 		return err
 	}
 
+	if err := h.checkOrCreateEnvironmentResources(request.Config); err != nil {
+		if success, ok := err.(Exit); ok {
+			response.Success = bool(success)
+			return nil
+		}
+		return err
+	}
+
+	if githubOIDC != nil {
+		if err := h.checkOrCreateGitHubOIDC(request.Config, team, request.Component, githubOIDC); err != nil {
+			if success, ok := err.(Exit); ok {
+				response.Success = bool(success)
+				return nil
+			}
+			return err
+		}
+	}
+
 	fmt.Fprintf(h.ErrorStream, "\n")
 
 	return nil
@@ -122,6 +161,7 @@ func (h *Handler) checkOrCreateTfstateBucket(buckets []string) error {
 			return err
 		}
 		fmt.Fprintf(h.ErrorStream, "\n  %s created tfstate bucket: %v\n", h.styles.tick, name)
+		h.tfstateBucket = name
 
 	}
 	return nil
@@ -129,11 +169,17 @@ func (h *Handler) checkOrCreateTfstateBucket(buckets []string) error {
 
 func (h *Handler) createTfstateBucket() (string, error) {
 	name := "cdflow2-tfstate-" + randHexPostfix()
-	s3Client := h.getS3Client()
+	if err := h.createNamedTfstateBucket(h.getS3Client(), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (h *Handler) createNamedTfstateBucket(s3Client s3iface.S3API, name string) error {
 	if _, err := s3Client.CreateBucket(&s3.CreateBucketInput{
 		Bucket: aws.String(name),
 	}); err != nil {
-		return "", err
+		return err
 	}
 	if _, err := s3Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
 		Bucket: aws.String(name),
@@ -141,13 +187,17 @@ func (h *Handler) createTfstateBucket() (string, error) {
 			Status: aws.String("Enabled"),
 		},
 	}); err != nil {
-		return "", err
+		return err
 	}
-	return name, nil
+	return nil
 }
 
 func (h *Handler) checkOrCreateTflocksTable() error {
-	ok := h.handleTflocksTable()
+	ok, recoverable := h.handleTflocksTable()
+	if !ok && !recoverable {
+		fmt.Fprintf(h.ErrorStream, "\nUnable to resolve automatically.\n\n")
+		return Exit(false)
+	}
 	if !ok {
 		fmt.Fprintf(h.ErrorStream, "\n")
 
@@ -161,10 +211,13 @@ func (h *Handler) checkOrCreateTflocksTable() error {
 }
 
 func (h *Handler) createTflocksTable() error {
-	dynamodbClient := h.getDynamoDBClient()
+	return h.createNamedTflocksTable(h.getDynamoDBClient(), tflocksTableName)
+}
+
+func (h *Handler) createNamedTflocksTable(dynamodbClient dynamodbiface.DynamoDBAPI, name string) error {
 	lockIDAttribute := aws.String("LockID")
 	if _, err := dynamodbClient.CreateTable(&dynamodb.CreateTableInput{
-		TableName: aws.String(tflocksTableName),
+		TableName: aws.String(name),
 		AttributeDefinitions: []*dynamodb.AttributeDefinition{
 			{
 				AttributeName: lockIDAttribute,
@@ -240,18 +293,20 @@ func (h *Handler) createECRRepository(component string) error {
 	}); err != nil {
 		return err
 	}
+	// tagged images are tagged <build id>-<version> and are deleted with their release by the gc command, which knows which
+	// versions are deployed - a count based rule here could expire the image of a version that is still deployed
 	if _, err := ecrClient.PutLifecyclePolicy(&ecr.PutLifecyclePolicyInput{
 		LifecyclePolicyText: aws.String(`
 		    {
 				"rules": [
 					{
 						"rulePriority": 1,
-						"description": "Keep most recent 100 images",
+						"description": "Expire untagged images after 14 days",
 						"selection": {
-							"tagStatus": "tagged",
-							"tagPrefixList": ["v"],
-							"countType": "imageCountMoreThan",
-							"countNumber": 100
+							"tagStatus": "untagged",
+							"countType": "sinceImagePushed",
+							"countUnit": "days",
+							"countNumber": 14
 						},
 						"action": {
 							"type": "expire"
@@ -266,3 +321,84 @@ func (h *Handler) createECRRepository(component string) error {
 	}
 	return nil
 }
+
+// checkOrCreateEnvironmentResources creates the state bucket and lock table for each environment in config.params.environments
+// that doesn't use the defaults.
+func (h *Handler) checkOrCreateEnvironmentResources(config map[string]interface{}) error {
+	envConfigs, err := getEnvironmentConfigs(config)
+	if err != nil {
+		fmt.Fprintf(h.ErrorStream, "\n%v\n\n", err)
+		return Exit(false)
+	}
+	for _, env := range sortedEnvNames(envConfigs) {
+		if !envConfigs[env].hasBackendOverrides() {
+			continue
+		}
+		backend, err := h.getStateBackend(config, "", "", env)
+		if err != nil {
+			fmt.Fprintf(h.ErrorStream, "\n%v\n\n", err)
+			return Exit(false)
+		}
+
+		fmt.Fprintf(h.ErrorStream, "\n%s\n\n", h.styles.au.Underline(fmt.Sprintf("Checking AWS resources for %s environment (%s)...", env, backend.region)))
+
+		if backend.accountID != "" {
+			if accountID := h.getAccountID(); accountID != backend.accountID {
+				fmt.Fprintf(
+					h.ErrorStream, "  %s skipping, resources are in account %s but the AWS credentials are for account %s - rerun setup with credentials for %s\n",
+					h.styles.warningCross, backend.accountID, accountID, backend.accountID,
+				)
+				continue
+			}
+		}
+
+		if err := h.checkOrCreateEnvironmentTfstateBucket(backend); err != nil {
+			return err
+		}
+		if h.backendConfig.usesDynamoDBLocking() {
+			if err := h.checkOrCreateEnvironmentTflocksTable(backend); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) checkOrCreateEnvironmentTfstateBucket(backend *stateBackend) error {
+	s3Client := h.getS3ClientForRegion(backend.region)
+	_, err := s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(backend.bucket)})
+	if err == nil {
+		fmt.Fprintf(h.ErrorStream, "  %s terraform state bucket found: %s\n", h.styles.tick, backend.bucket)
+		return nil
+	}
+	if !isNotFound(err) {
+		fmt.Fprintf(h.ErrorStream, "  %s unable to access terraform state bucket %s: %v\n\nUnable to resolve automatically.\n\n", h.styles.cross, backend.bucket, err)
+		return Exit(false)
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s terraform state bucket not found: %s\n", h.styles.cross, backend.bucket)
+	if err := h.createNamedTfstateBucket(s3Client, backend.bucket); err != nil {
+		return err
+	}
+	fmt.Fprintf(h.ErrorStream, "\n  %s created tfstate bucket: %v\n", h.styles.tick, backend.bucket)
+	return nil
+}
+
+func (h *Handler) checkOrCreateEnvironmentTflocksTable(backend *stateBackend) error {
+	dynamodbClient := h.getDynamoDBClientForRegion(backend.region)
+	_, err := dynamodbClient.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(backend.lockTable),
+	})
+	if err == nil {
+		fmt.Fprintf(h.ErrorStream, "  %s dynamodb table found: %s\n", h.styles.tick, backend.lockTable)
+		return nil
+	}
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		return err
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s dynamodb table not found: %s\n", h.styles.cross, backend.lockTable)
+	if err := h.createNamedTflocksTable(dynamodbClient, backend.lockTable); err != nil {
+		return err
+	}
+	fmt.Fprintf(h.ErrorStream, "\n  %s created %s dynamodb table\n", h.styles.tick, backend.lockTable)
+	return nil
+}
@@ -1 +1,163 @@
 package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// tablesDynamoDB is a mock DynamoDB that only has the tables it has been given or has created.
+type tablesDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	tables map[string]bool
+}
+
+func (m *tablesDynamoDB) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	if !m.tables[*input.TableName] {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found", nil)
+	}
+	return &dynamodb.DescribeTableOutput{}, nil
+}
+
+func (m *tablesDynamoDB) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (m *tablesDynamoDB) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	m.tables[*input.TableName] = true
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+type mockedECR struct {
+	ecriface.ECRAPI
+}
+
+func (mockedECR) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
+	return &ecr.DescribeRepositoriesOutput{
+		Repositories: []*ecr.Repository{
+			{RepositoryUri: aws.String("123456789012.dkr.ecr.eu-west-1.amazonaws.com/" + *input.RepositoryNames[0])},
+		},
+	}, nil
+}
+
+func setupRequest() *common.SetupRequest {
+	request := common.CreateSetupRequest()
+	request.Component = "my-component"
+	request.Config["team"] = "my-team"
+	request.Config["default_region"] = "eu-west-1"
+	request.Env["AWS_ACCESS_KEY_ID"] = "test-access-key"
+	request.Env["AWS_SECRET_ACCESS_KEY"] = "test-secret-access-key"
+	return request
+}
+
+func TestSetupEnvironmentResources(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	dynamoDBClient := &tablesDynamoDB{tables: map[string]bool{"cdflow2-tflocks": true}}
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:             s3Client,
+		DynamoDBClient:       dynamoDBClient,
+		ECRClient:            mockedECR{},
+		SecretsManagerClient: mockedSecretsManager{},
+		STSClient:            mockedSTS{account: "123456789012"},
+		IAMClient:            mockedIAM{},
+		OutputStream:         &bytes.Buffer{},
+		ErrorStream:          &errorBuffer,
+	})
+	request := setupRequest()
+	request.Config["environments"] = map[string]interface{}{
+		"live": map[string]interface{}{
+			"tfstate_bucket": "my-live-tfstate",
+			"tflocks_table":  "my-live-tflocks",
+		},
+		"prod": map[string]interface{}{
+			"tfstate_bucket": "my-prod-tfstate",
+			"account_id":     "999999999999",
+		},
+		"ci": nil,
+	}
+	response := common.CreateSetupResponse()
+
+	// When
+	err := myHandler.Setup(request, response)
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("setup failed:", err, errorBuffer.String())
+	}
+	if _, err := s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("my-live-tfstate")}); err != nil {
+		t.Fatal("expected live tfstate bucket to be created, output:", errorBuffer.String())
+	}
+	if !dynamoDBClient.tables["my-live-tflocks"] {
+		t.Fatal("expected live tflocks table to be created, output:", errorBuffer.String())
+	}
+	if _, err := s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("my-prod-tfstate")}); err == nil {
+		t.Fatal("expected prod tfstate bucket in another account to be skipped")
+	}
+	if !strings.Contains(errorBuffer.String(), "resources are in account 999999999999 but the AWS credentials are for account 123456789012") {
+		t.Fatal("expected message about skipping prod, got:", errorBuffer.String())
+	}
+}
+
+func TestSetupReleaseStore(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-tfstate-bucket-1")
+	var errorBuffer bytes.Buffer
+	myHandler := testHandler(handler.Opts{S3Client: s3Client, ErrorStream: &errorBuffer})
+	request := setupRequest()
+	request.Config["release_store"] = map[string]interface{}{"type": "filesystem", "path": tempDir(t)}
+	response := common.CreateSetupResponse()
+
+	// When
+	err := myHandler.Setup(request, response)
+
+	// Then
+	if err != nil || !response.Success {
+		t.Fatal("setup failed:", err, errorBuffer.String())
+	}
+	if buckets, _ := s3Client.ListBuckets(nil); len(buckets.Buckets) != 1 {
+		t.Fatalf("expected no release bucket to be created, got buckets %v", buckets.Buckets)
+	}
+	if strings.Contains(errorBuffer.String(), "release bucket") {
+		t.Fatalf("unexpected release bucket in output: %s", errorBuffer.String())
+	}
+}
+
+// listBucketsErrorS3 is a mock S3 whose buckets can't be listed.
+type listBucketsErrorS3 struct {
+	*memoryS3
+}
+
+func (listBucketsErrorS3) ListBuckets(*s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
+	return nil, awserr.New("AccessDenied", "access denied", nil)
+}
+
+func TestSetupListBucketsError(t *testing.T) {
+	// Given
+	var errorBuffer bytes.Buffer
+	myHandler := testHandler(handler.Opts{S3Client: listBucketsErrorS3{newMemoryS3()}, ErrorStream: &errorBuffer})
+	response := common.CreateSetupResponse()
+
+	// When
+	err := myHandler.Setup(setupRequest(), response)
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if response.Success || !strings.Contains(errorBuffer.String(), "access denied") {
+		t.Fatalf("expected failure listing buckets, got %v with output: %s", response.Success, errorBuffer.String())
+	}
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stateS3Key returns the key of the state for a workspace - terraform's s3 backend stores the state for non-default workspaces at
+// <workspace_key_prefix>/<workspace>/<key>, and cdflow2 uses a workspace per environment.
+func stateS3Key(workspaceKeyPrefix, env, key string) string {
+	return fmt.Sprintf("%s/%s/%s", workspaceKeyPrefix, env, key)
+}
+
+func isNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return true
+		}
+	}
+	return false
+}
+
+// stateExists returns true if there is a current version of the environment's state object.
+func (h *Handler) stateExists(backend *stateBackend, env string) (bool, error) {
+	_, err := h.getStateS3Client(backend).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(backend.bucket),
+		Key:    aws.String(backend.stateKey(env)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// stateVersionID returns the version id of the current version of the environment's state object, or an empty string if there is
+// no state yet.
+func (h *Handler) stateVersionID(backend *stateBackend, env string) (string, error) {
+	output, err := h.getStateS3Client(backend).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(backend.bucket),
+		Key:    aws.String(backend.stateKey(env)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return aws.StringValue(output.VersionId), nil
+}
+
+// stateWasDeleted returns true if the environment's state object has previous versions, but no current version.
+func (h *Handler) stateWasDeleted(backend *stateBackend, env string) (bool, error) {
+	key := backend.stateKey(env)
+	output, err := h.getStateS3Client(backend).ListObjectVersions(&s3.ListObjectVersionsInput{
+		Bucket:  aws.String(backend.bucket),
+		Prefix:  aws.String(key),
+		MaxKeys: aws.Int64(10),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, version := range output.Versions {
+		if aws.StringValue(version.Key) == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (h *Handler) validateStateExists(env string, backend *stateBackend) error {
+	bucket, key := backend.bucket, backend.stateKey(env)
+	exists, err := h.stateExists(backend, env)
+	if err != nil {
+		return fmt.Errorf("unable to check for terraform state at s3://%s/%s: %v", bucket, key, err)
+	}
+	if exists {
+		fmt.Fprintf(h.ErrorStream, "  %s terraform state found for %s: s3://%s/%s\n", h.styles.tick, env, bucket, key)
+		return nil
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s no terraform state found for %s at s3://%s/%s\n", h.styles.cross, env, bucket, key)
+	if deleted, err := h.stateWasDeleted(backend, env); err == nil && deleted {
+		fmt.Fprintf(h.ErrorStream, "    (previous versions of the state exist, but the current version has been deleted)\n")
+	}
+	return fmt.Errorf(
+		"\nThe %s environment is expected to exist already, but deploying would create new terraform state for it.\n"+
+			"Check that the environment name is correct.", env,
+	)
+}
+
+func (h *Handler) validateStateDoesNotExist(env string, backend *stateBackend) error {
+	bucket, key := backend.bucket, backend.stateKey(env)
+	exists, err := h.stateExists(backend, env)
+	if err != nil {
+		return fmt.Errorf("unable to check for terraform state at s3://%s/%s: %v", bucket, key, err)
+	}
+	if !exists {
+		fmt.Fprintf(h.ErrorStream, "  %s no existing terraform state for %s\n", h.styles.tick, env)
+		return nil
+	}
+	fmt.Fprintf(h.ErrorStream, "  %s terraform state already exists for %s at s3://%s/%s\n", h.styles.cross, env, bucket, key)
+	return fmt.Errorf("\nThe %s environment is expected to be new, but it already has terraform state.", env)
+}
+
+// componentState is a terraform state object of a component, for an environment and (with {stack} in the state key) a stack.
+type componentState struct {
+	env     string
+	stack   string
+	backend *stateBackend
+}
+
+// listComponentStates returns the state objects of a component for every environment and stack, found in the default tfstate bucket
+// and the buckets in config.params.environments.
+func (h *Handler) listComponentStates(config map[string]interface{}, team, component string) ([]*componentState, error) {
+	envConfigs, err := getEnvironmentConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	prefix, pattern := h.backendConfig.stateKeyPattern(team, component)
+	envIndex, stackIndex := pattern.SubexpIndex("env"), pattern.SubexpIndex("stack")
+	listed := make(map[string]bool)
+	found := make(map[string]*componentState)
+	for _, listEnv := range append([]string{"*"}, sortedEnvNames(envConfigs)...) {
+		listBackend, err := h.getStateBackend(config, team, component, listEnv)
+		if err != nil {
+			return nil, err
+		}
+		if listed[listBackend.roleARN+" "+listBackend.region+" "+listBackend.bucket] {
+			continue
+		}
+		listed[listBackend.roleARN+" "+listBackend.region+" "+listBackend.bucket] = true
+		var keys []string
+		if err := h.getStateS3Client(listBackend).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(listBackend.bucket),
+			Prefix: aws.String(prefix),
+		}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range output.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+			return true
+		}); err != nil {
+			return nil, fmt.Errorf("unable to list terraform state in s3://%s/%s: %v", listBackend.bucket, prefix, err)
+		}
+		for _, key := range keys {
+			match := pattern.FindStringSubmatch(key)
+			if match == nil {
+				continue
+			}
+			state := componentState{env: match[envIndex]}
+			if stackIndex >= 0 {
+				state.stack = match[stackIndex]
+			}
+			// the environment's own backend is used if the state is in its bucket, for its lock table
+			backend, err := h.getStateBackend(config, team, component, state.env)
+			if err != nil {
+				return nil, err
+			}
+			if backend.bucket != listBackend.bucket || backend.region != listBackend.region {
+				copied := *listBackend
+				backend = &copied
+			}
+			backend.workspaceKeyPrefix, backend.key = h.backendConfig.renderStackStateKey(team, component, state.stack)
+			if backend.stateKey(state.env) != key {
+				continue
+			}
+			state.backend = backend
+			found[backend.bucket+"/"+key] = &state
+		}
+	}
+	var result []*componentState
+	for _, state := range found {
+		result = append(result, state)
+	}
+	sortComponentStates(result)
+	return result, nil
+}
+
+func sortComponentStates(states []*componentState) {
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].env != states[j].env {
+			return states[i].env < states[j].env
+		}
+		if states[i].stack != states[j].stack {
+			return states[i].stack < states[j].stack
+		}
+		return states[i].backend.bucket < states[j].backend.bucket
+	})
+}
+
+// name returns the environment, and the stack if there is one, for output.
+func (s *componentState) name() string {
+	if s.stack == "" {
+		return s.env
+	}
+	return fmt.Sprintf("%s (stack %s)", s.env, s.stack)
+}
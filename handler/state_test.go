@@ -0,0 +1,62 @@
+package handler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestPrepareTerraformStateShouldExist(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		stateShouldExist bool
+		stateExists      bool
+		success          bool
+		message          string
+	}{
+		{"existing env with state", true, true, true, "terraform state found for live"},
+		{"existing env without state", true, false, false, "expected to exist already, but deploying would create new terraform state"},
+		{"new env without state", false, false, true, "no existing terraform state for live"},
+		{"new env with state", false, true, false, "expected to be new, but it already has terraform state"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+			if test.stateExists {
+				s3Client.put("cdflow2-tfstate-bucket-1", "my-team/my-component/live/terraform.tfstate", []byte("{}"))
+			}
+			var errorBuffer bytes.Buffer
+			myHandler := handler.New(&handler.Opts{
+				S3Client:             s3Client,
+				DynamoDBClient:       &mockedDynamoDB{},
+				SecretsManagerClient: mockedSecretsManager{},
+				STSClient:            mockedSTS{account: "123456789012"},
+				IAMClient:            mockedIAM{},
+				OutputStream:         &bytes.Buffer{},
+				ErrorStream:          &errorBuffer,
+			})
+			request := prepareTerraformRequest("live", "")
+			request.StateShouldExist = aws.Bool(test.stateShouldExist)
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			err := myHandler.PrepareTerraform(request, response, tempDir(t))
+
+			// Then
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Success != test.success {
+				t.Fatalf("expected success %v, got %v, output: %s", test.success, response.Success, errorBuffer.String())
+			}
+			if !strings.Contains(errorBuffer.String(), test.message) {
+				t.Fatalf("expected %q in output, got: %s", test.message, errorBuffer.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"fmt"
+	"text/tabwriter"
+)
+
+// StatusRequest is the input to the status command.
+type StatusRequest struct {
+	CommandRequest
+	// EnvName limits the output to a single environment.
+	EnvName string
+}
+
+// Status outputs the current and previous versions of a component deployed to each environment.
+func (h *Handler) Status(request *StatusRequest) error {
+	team, err := h.prepareCommand(&request.CommandRequest)
+	if err != nil {
+		return err
+	}
+
+	envs := []string{request.EnvName}
+	if request.EnvName == "" {
+		envs, err = h.listDeploymentEnvs(team, request.Component)
+		if err != nil {
+			fmt.Fprintf(h.ErrorStream, "Unable to list deployments: %v\n", err)
+			return Exit(false)
+		}
+	}
+	if len(envs) == 0 {
+		fmt.Fprintf(h.ErrorStream, "No deployments of %s recorded.\n", request.Component)
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(h.OutputStream, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ENVIRONMENT\tVERSION\tDEPLOYED\tBY\tPREVIOUS")
+	for _, env := range envs {
+		history, err := h.listDeploymentHistory(team, request.Component, env, 2)
+		if err != nil {
+			fmt.Fprintf(h.ErrorStream, "Unable to get deployments to %s: %v\n", env, err)
+			return Exit(false)
+		}
+		if len(history) == 0 {
+			fmt.Fprintf(writer, "%s\t-\t-\t-\t-\n", env)
+			continue
+		}
+		previous := "-"
+		if len(history) > 1 {
+			previous = history[1].Version
+		}
+		current := history[0]
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", env, current.Version, current.Timestamp.UTC().Format("2006-01-02 15:04:05 MST"), current.Caller, previous)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,71 @@
+package handler_test
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+)
+
+func putDeploymentRecord(s3Client *memoryS3, env, version string, timestamp time.Time) {
+	s3Client.put(
+		"cdflow2-tfstate-bucket-1",
+		fmt.Sprintf("cdflow2-deployments/my-team/my-component/%s/%s.json", env, timestamp.UTC().Format("2006-01-02T15-04-05.000000000Z")),
+		[]byte(fmt.Sprintf(
+			`{"team": "my-team", "component": "my-component", "env": %q, "version": %q, "caller": "arn:aws:sts::123456789012:assumed-role/deploy/ci", "timestamp": %q}`,
+			env, version, timestamp.UTC().Format(time.RFC3339),
+		)),
+	)
+}
+
+func commandRequest() handler.CommandRequest {
+	return handler.CommandRequest{
+		Component: "my-component",
+		Config: map[string]interface{}{
+			"team":           "my-team",
+			"default_region": "eu-west-1",
+		},
+		Env: map[string]string{
+			"AWS_ACCESS_KEY_ID":     "test-access-key",
+			"AWS_SECRET_ACCESS_KEY": "test-secret-access-key",
+		},
+	}
+}
+
+func TestStatus(t *testing.T) {
+	// Given
+	s3Client := newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1")
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	putDeploymentRecord(s3Client, "live", "1", start)
+	putDeploymentRecord(s3Client, "live", "2", start.Add(time.Hour))
+	putDeploymentRecord(s3Client, "live", "2", start.Add(2*time.Hour))
+	putDeploymentRecord(s3Client, "ci", "3", start.Add(3*time.Hour))
+
+	var outputBuffer bytes.Buffer
+	var errorBuffer bytes.Buffer
+	myHandler := handler.New(&handler.Opts{
+		S3Client:       s3Client,
+		DynamoDBClient: &mockedDynamoDB{},
+		OutputStream:   &outputBuffer,
+		ErrorStream:    &errorBuffer,
+	})
+
+	// When
+	err := myHandler.Status(&handler.StatusRequest{CommandRequest: commandRequest()})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err, errorBuffer.String())
+	}
+	for _, expected := range []string{
+		`(?m)^ci\s+3\s+2026-10-01 12:00:00 UTC\s+\S+\s+-$`,
+		`(?m)^live\s+2\s+2026-10-01 10:00:00 UTC\s+arn:aws:sts::123456789012:assumed-role/deploy/ci\s+1$`,
+	} {
+		if !regexp.MustCompile(expected).MatchString(outputBuffer.String()) {
+			t.Fatalf("expected output to match %q, got:\n%s", expected, outputBuffer.String())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultTerraformEnv is used when config.params.terraform_env is not set, and is the list of variables that were always passed
+// to terraform before it could be configured.
+var defaultTerraformEnv = []string{
+	"DATADOG_APP_KEY:DD_APP_KEY",
+	"DATADOG_API_KEY:DD_API_KEY",
+	"FASTLY_API_KEY",
+	"GITHUB_TOKEN",
+	"MONGODB_ATLAS_PUBLIC_KEY",
+	"MONGODB_ATLAS_PRIVATE_KEY",
+	"JUNOS_PASSWORD",
+}
+
+// terraformEnvEntry is an entry in config.params.terraform_env, which is one of:
+//
+//	NAME        pass NAME through to terraform
+//	PATTERN     pass all variables matching a glob pattern (e.g. TF_VAR_*) through to terraform
+//	FROM:TO     pass FROM through to terraform as TO
+//
+// Any of these followed by ! is required, so the deploy fails if it is not set (or a pattern matches nothing).
+type terraformEnvEntry struct {
+	from     string
+	to       string
+	pattern  bool
+	required bool
+}
+
+func parseTerraformEnvEntry(value string) (*terraformEnvEntry, error) {
+	var result terraformEnvEntry
+	if strings.HasSuffix(value, "!") {
+		result.required = true
+		value = strings.TrimSuffix(value, "!")
+	}
+	result.from = value
+	if parts := strings.SplitN(value, ":", 2); len(parts) == 2 {
+		result.from, result.to = parts[0], parts[1]
+		if result.to == "" {
+			return nil, fmt.Errorf("config.params.terraform_env entry %q has an empty name to rename to", value)
+		}
+	}
+	if result.from == "" {
+		return nil, fmt.Errorf("config.params.terraform_env contains an empty entry")
+	}
+	if strings.ContainsAny(result.from, "*?[") {
+		if _, err := path.Match(result.from, ""); err != nil {
+			return nil, fmt.Errorf("config.params.terraform_env entry %q is not a valid pattern: %v", value, err)
+		}
+		if result.to != "" {
+			return nil, fmt.Errorf("config.params.terraform_env entry %q cannot rename a pattern", value)
+		}
+		result.pattern = true
+	}
+	return &result, nil
+}
+
+// getTerraformEnv returns the entries in config.params.terraform_env, or the default entries if it is not set.
+func getTerraformEnv(config map[string]interface{}) ([]*terraformEnvEntry, error) {
+	values := defaultTerraformEnv
+	if raw, ok := config["terraform_env"]; ok && raw != nil {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config.params.terraform_env must be a list of environment variable names")
+		}
+		values = nil
+		for _, item := range list {
+			value, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("config.params.terraform_env must be a list of environment variable names")
+			}
+			values = append(values, value)
+		}
+	}
+	var result []*terraformEnvEntry
+	for _, value := range values {
+		entry, err := parseTerraformEnvEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// addTerraformEnv copies the variables selected by entries from requestEnv to responseEnv. Variables that are not set are
+// omitted, and an error is returned listing any required variables that are missing. Variables already in responseEnv (e.g. the
+// deploy account credentials) are not overwritten.
+func addTerraformEnv(entries []*terraformEnvEntry, requestEnv, responseEnv map[string]string) error {
+	var missing []string
+	for _, entry := range entries {
+		found := false
+		if entry.pattern {
+			for name, value := range requestEnv {
+				if matched, _ := path.Match(entry.from, name); !matched || value == "" {
+					continue
+				}
+				found = true
+				if _, exists := responseEnv[name]; !exists {
+					responseEnv[name] = value
+				}
+			}
+		} else if value := requestEnv[entry.from]; value != "" {
+			found = true
+			to := entry.to
+			if to == "" {
+				to = entry.from
+			}
+			if _, exists := responseEnv[to]; !exists {
+				responseEnv[to] = value
+			}
+		}
+		if entry.required && !found {
+			missing = append(missing, entry.from)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("required environment variables for terraform not set (config.params.terraform_env): %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
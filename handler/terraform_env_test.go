@@ -0,0 +1,114 @@
+package handler_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// prepareTerraformEnv runs prepare terraform with config.params.terraform_env, if set.
+func prepareTerraformEnv(t *testing.T, terraformEnv interface{}, env map[string]string) (*common.PrepareTerraformResponse, string) {
+	config := map[string]interface{}{}
+	if terraformEnv != nil {
+		config["terraform_env"] = terraformEnv
+	}
+	return prepareTerraform(t, handler.Opts{}, "", config, env)
+}
+
+func TestPrepareTerraformDefaultTerraformEnv(t *testing.T) {
+	// When
+	response, output := prepareTerraformEnv(t, nil, map[string]string{
+		"DATADOG_API_KEY": "dd-api-key",
+		"GITHUB_TOKEN":    "github-token",
+		"UNRELATED":       "value",
+	})
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	if response.Env["DD_API_KEY"] != "dd-api-key" || response.Env["GITHUB_TOKEN"] != "github-token" {
+		t.Fatalf("expected default variables to be passed, got: %v", response.Env)
+	}
+	for _, name := range []string{"DD_APP_KEY", "FASTLY_API_KEY", "JUNOS_PASSWORD", "UNRELATED"} {
+		if _, ok := response.Env[name]; ok {
+			t.Fatalf("unexpected %s in env", name)
+		}
+	}
+}
+
+func TestPrepareTerraformConfiguredTerraformEnv(t *testing.T) {
+	// When
+	response, output := prepareTerraformEnv(t, []interface{}{
+		"NEW_RELIC_API_KEY",
+		"TF_VAR_*",
+		"CI_PAGERDUTY_TOKEN:PAGERDUTY_TOKEN",
+		"NOT_SET",
+	}, map[string]string{
+		"NEW_RELIC_API_KEY":  "new-relic-key",
+		"TF_VAR_one":         "1",
+		"TF_VAR_two":         "2",
+		"CI_PAGERDUTY_TOKEN": "pagerduty-token",
+		"GITHUB_TOKEN":       "github-token",
+	})
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	expected := map[string]string{
+		"NEW_RELIC_API_KEY": "new-relic-key",
+		"TF_VAR_one":        "1",
+		"TF_VAR_two":        "2",
+		"PAGERDUTY_TOKEN":   "pagerduty-token",
+		// passed by the plugin, see terraform_vars_test.go
+		"TF_VAR_cdflow2_account_id":     "123456789012",
+		"TF_VAR_cdflow2_region":         "eu-west-1",
+		"TF_VAR_cdflow2_ecr_repository": "123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component",
+		"TF_VAR_cdflow2_default_tags":   `{"component":"my-component","env":"live","team":"my-team"}`,
+	}
+	for name := range response.Env {
+		if strings.HasPrefix(name, "AWS_") {
+			delete(response.Env, name)
+		}
+	}
+	if !reflect.DeepEqual(response.Env, expected) {
+		t.Fatalf("expected %v, got %v", expected, response.Env)
+	}
+}
+
+func TestPrepareTerraformRequiredTerraformEnv(t *testing.T) {
+	// When
+	response, output := prepareTerraformEnv(t, []interface{}{"GITHUB_TOKEN!", "TF_VAR_*!", "FASTLY_API_KEY!"}, map[string]string{
+		"FASTLY_API_KEY": "fastly-key",
+	})
+
+	// Then
+	if response.Success {
+		t.Fatal("expected failure")
+	}
+	if !strings.Contains(output, "GITHUB_TOKEN, TF_VAR_*") || strings.Contains(output, "FASTLY_API_KEY") {
+		t.Fatalf("expected missing variables in output, got: %q", output)
+	}
+}
+
+func TestPrepareTerraformInvalidTerraformEnv(t *testing.T) {
+	for _, terraformEnv := range []interface{}{
+		"GITHUB_TOKEN",
+		[]interface{}{"TF_VAR_*:OTHER"},
+		[]interface{}{"FROM:"},
+		[]interface{}{"[invalid"},
+	} {
+		// When
+		response, output := prepareTerraformEnv(t, terraformEnv, nil)
+
+		// Then
+		if response.Success || !strings.Contains(output, "config.params.terraform_env") {
+			t.Fatalf("expected failure for %v, got: %q", terraformEnv, output)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultTerraformVars are the values passed to terraform as TF_VAR_ variables, and the name of the variable for each - which can be
+// changed (or set to false to not pass the value) in config.params.terraform_vars. The names are prefixed so that they don't override
+// the defaults of variables a component already has.
+var defaultTerraformVars = map[string]string{
+	"account_id":      "cdflow2_account_id",
+	"region":          "cdflow2_region",
+	"ecr_repository":  "cdflow2_ecr_repository",
+	"lambda_bucket":   "cdflow2_lambda_bucket",
+	"release_version": "cdflow2_release_version",
+	"build_metadata":  "cdflow2_build_metadata",
+	"default_tags":    "cdflow2_default_tags",
+}
+
+var terraformVarName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+
+// standardTags are added to the tags in config.params.tags to make the default tags for terraform - the same keys as the tags on
+// releases.
+var standardTags = []string{"team", "component", "env", "version"}
+
+// getTags returns config.params.tags, the tags to add to the standard tags for the resources terraform creates.
+func getTags(config map[string]interface{}) (map[string]string, error) {
+	result := make(map[string]string)
+	raw, ok := config["tags"]
+	if !ok || raw == nil {
+		return result, nil
+	}
+	tags, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.tags must be a map of tag names to values")
+	}
+	for key, value := range tags {
+		if containsString(standardTags, key) {
+			return nil, fmt.Errorf("config.params.tags.%s is set by the plugin and cannot be overridden", key)
+		}
+		if len(key) == 0 || len(key) > 128 {
+			return nil, fmt.Errorf("config.params.tags must have tag names of 1 to 128 characters, got %q", key)
+		}
+		switch value := value.(type) {
+		case string:
+			result[key] = tagValue(value)
+		case int, float64, bool:
+			result[key] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("config.params.tags.%s must be a string", key)
+		}
+	}
+	return result, nil
+}
+
+// defaultTags returns config.params.tags with the standard tags, as a JSON object for a map(string) variable - e.g. for the
+// default_tags of the AWS provider. The version is omitted when there is no release (e.g. for destroy).
+func defaultTags(tags map[string]string, team, component, env, version string) (string, error) {
+	result := make(map[string]string)
+	for key, value := range tags {
+		result[key] = value
+	}
+	for key, value := range map[string]string{"team": team, "component": component, "env": env, "version": version} {
+		if value != "" {
+			result[key] = tagValue(value)
+		}
+	}
+	data, err := json.Marshal(result)
+	return string(data), err
+}
+
+// getTerraformVars returns the name of the terraform variable for each value passed to terraform.
+func getTerraformVars(config map[string]interface{}) (map[string]string, error) {
+	result := make(map[string]string)
+	for value, name := range defaultTerraformVars {
+		result[value] = name
+	}
+	raw, ok := config["terraform_vars"]
+	if !ok || raw == nil {
+		return result, nil
+	}
+	overrides, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config.params.terraform_vars must be a map of values to terraform variable names")
+	}
+	for value, override := range overrides {
+		if _, ok := defaultTerraformVars[value]; !ok {
+			return nil, fmt.Errorf(
+				"unknown key config.params.terraform_vars.%s, expected one of %s", value, strings.Join(sortedTerraformVarValues(), ", "),
+			)
+		}
+		switch name := override.(type) {
+		case bool:
+			if name {
+				return nil, fmt.Errorf("config.params.terraform_vars.%s must be a variable name or false", value)
+			}
+			delete(result, value)
+		case string:
+			if !terraformVarName.MatchString(name) {
+				return nil, fmt.Errorf("config.params.terraform_vars.%s must be a valid terraform variable name, got %q", value, name)
+			}
+			result[value] = name
+		default:
+			return nil, fmt.Errorf("config.params.terraform_vars.%s must be a variable name or false", value)
+		}
+	}
+	return result, nil
+}
+
+func sortedTerraformVarValues() []string {
+	var result []string
+	for value := range defaultTerraformVars {
+		result = append(result, value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// addTerraformVars sets a TF_VAR_ variable in responseEnv for each of the values that has a name. Variables already in responseEnv
+// (e.g. passed through with config.params.terraform_env) are not overwritten, and empty values are omitted.
+func addTerraformVars(names, values, responseEnv map[string]string) {
+	for value, name := range names {
+		if values[value] == "" {
+			continue
+		}
+		if _, exists := responseEnv["TF_VAR_"+name]; !exists {
+			responseEnv["TF_VAR_"+name] = values[value]
+		}
+	}
+}
+
+// accountTerraformVars returns the values that don't depend on the release - the account and region of the environment, the
+// component's ECR repository and the lambda bucket (if there is exactly one).
+func (h *Handler) accountTerraformVars(config map[string]interface{}, component, env string) (map[string]string, error) {
+	envConfig, err := getEnvironmentConfig(config, env)
+	if err != nil {
+		return nil, err
+	}
+	// the deploy account has been checked against the credentials, and setup creates the ECR repository in the default region
+	accountID := h.getAccountID()
+	result := map[string]string{
+		"account_id": accountID,
+		"region":     h.defaultRegion,
+	}
+	if envConfig.deployAccountID != "" {
+		result["account_id"] = envConfig.deployAccountID
+	}
+	if envConfig.region != "" {
+		result["region"] = envConfig.region
+	}
+	if accountID != "" {
+		result["ecr_repository"] = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s", accountID, h.defaultRegion, component)
+	}
+	buckets, err := listBuckets(h.getS3Client())
+	if err != nil {
+		return nil, err
+	}
+	if lambdaBuckets := filterPrefix(buckets, "cdflow2-lambda-"); len(lambdaBuckets) == 1 {
+		result["lambda_bucket"] = lambdaBuckets[0]
+	}
+	return result, nil
+}
+
+// releaseTerraformVars returns the values from the release being deployed - its version, and the metadata output by each build (e.g.
+// the image and digest pushed to ECR) as a JSON object of build IDs to metadata, for a map(map(string)) variable.
+func releaseTerraformVars(version string, metadata *releaseMetadata) (map[string]string, error) {
+	buildMetadata, err := json.Marshal(metadata.Builds)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"release_version": version,
+		"build_metadata":  string(buildMetadata),
+	}, nil
+}
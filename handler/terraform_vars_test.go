@@ -0,0 +1,181 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// prepareTerraformVars runs prepare terraform for version 2 of a release with build metadata.
+func prepareTerraformVars(t *testing.T, config map[string]interface{}, env map[string]string) (*common.PrepareTerraformResponse, string) {
+	store := handler.NewFilesystemReleaseStore(tempDir(t))
+	buildDir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(buildDir, "main.tf"), []byte("# version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var release bytes.Buffer
+	if err := common.ZipRelease(&release, buildDir, "my-component", "2", "hashicorp/terraform:1.5.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("my-team/my-component/my-component-2.zip", &release, map[string]string{
+		"version":   "2",
+		"build-ids": "web",
+		"build-metadata": base64.StdEncoding.EncodeToString(
+			[]byte(`{"web": {"image": "123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component:web-2", "digest": "sha256:abc123"}}`),
+		),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return prepareTerraform(t, handler.Opts{
+		S3Client: newMemoryS3("cdflow2-release-bucket-1", "cdflow2-tfstate-bucket-1", "cdflow2-lambda-bucket-1"),
+		S3ClientFactory: s3ClientFactory(t, map[string]s3iface.S3API{
+			" us-east-1": newMemoryS3("live-tfstate"),
+		}),
+		DynamoDBClientFactory: dynamoDBClientFactory(t, map[string]dynamodbiface.DynamoDBAPI{
+			" us-east-1": &mockedDynamoDB{},
+		}),
+		ReleaseStore: store,
+	}, "2", config, env)
+}
+
+func TestPrepareTerraformVars(t *testing.T) {
+	// When
+	response, output := prepareTerraformVars(t, nil, nil)
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	for name, expected := range map[string]string{
+		"TF_VAR_cdflow2_account_id":      "123456789012",
+		"TF_VAR_cdflow2_region":          "eu-west-1",
+		"TF_VAR_cdflow2_ecr_repository":  "123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component",
+		"TF_VAR_cdflow2_lambda_bucket":   "cdflow2-lambda-bucket-1",
+		"TF_VAR_cdflow2_release_version": "2",
+		"TF_VAR_cdflow2_build_metadata":  `{"web":{"digest":"sha256:abc123","image":"123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component:web-2"}}`,
+		"TF_VAR_cdflow2_default_tags":    `{"component":"my-component","env":"live","team":"my-team","version":"2"}`,
+	} {
+		if response.Env[name] != expected {
+			t.Fatalf("expected %s=%q, got %q", name, expected, response.Env[name])
+		}
+	}
+}
+
+func TestPrepareTerraformEnvironmentVars(t *testing.T) {
+	// When
+	response, output := prepareTerraformVars(t, map[string]interface{}{
+		"environments": map[string]interface{}{
+			"live": map[string]interface{}{
+				"region":            "us-east-1",
+				"tfstate_bucket":    "live-tfstate",
+				"deploy_account_id": "123456789012",
+			},
+		},
+	}, nil)
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	if response.Env["TF_VAR_cdflow2_region"] != "us-east-1" || response.Env["TF_VAR_cdflow2_account_id"] != "123456789012" {
+		t.Fatalf("expected the environment's region and account, got: %v", response.Env)
+	}
+	if response.Env["TF_VAR_cdflow2_ecr_repository"] != "123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component" {
+		t.Fatalf("expected the ECR repository in the default region, got %q", response.Env["TF_VAR_cdflow2_ecr_repository"])
+	}
+}
+
+func TestPrepareTerraformConfiguredVars(t *testing.T) {
+	// When
+	response, output := prepareTerraformVars(t, map[string]interface{}{
+		"terraform_vars": map[string]interface{}{
+			"ecr_repository": "image_repository",
+			"build_metadata": false,
+		},
+		"tags": map[string]interface{}{"cost-centre": "platform"},
+	}, nil)
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	if response.Env["TF_VAR_image_repository"] != "123456789012.dkr.ecr.eu-west-1.amazonaws.com/my-component" {
+		t.Fatalf("expected renamed variable, got: %v", response.Env)
+	}
+	for _, name := range []string{"TF_VAR_cdflow2_ecr_repository", "TF_VAR_cdflow2_build_metadata"} {
+		if _, ok := response.Env[name]; ok {
+			t.Fatalf("unexpected %s in env", name)
+		}
+	}
+	if response.Env["TF_VAR_cdflow2_default_tags"] != `{"component":"my-component","cost-centre":"platform","env":"live","team":"my-team","version":"2"}` {
+		t.Fatalf("expected config.params.tags in default tags, got %q", response.Env["TF_VAR_cdflow2_default_tags"])
+	}
+	if response.Env["TF_VAR_cdflow2_release_version"] != "2" {
+		t.Fatalf("expected other variables with their default names, got: %v", response.Env)
+	}
+}
+
+func TestPrepareTerraformVarsNotOverwritten(t *testing.T) {
+	// When
+	response, output := prepareTerraformVars(t, map[string]interface{}{"terraform_env": []interface{}{"TF_VAR_*"}}, map[string]string{"TF_VAR_cdflow2_region": "us-east-1"})
+
+	// Then
+	if !response.Success {
+		t.Fatal("expected success:", output)
+	}
+	if response.Env["TF_VAR_cdflow2_region"] != "us-east-1" {
+		t.Fatalf("expected variable passed through by config.params.terraform_env to be kept, got %q", response.Env["TF_VAR_cdflow2_region"])
+	}
+}
+
+func TestPrepareTerraformInvalidVars(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{
+			"not a map", map[string]interface{}{"terraform_vars": []interface{}{"region"}},
+			"config.params.terraform_vars must be a map of values to terraform variable names",
+		},
+		{
+			"unknown", map[string]interface{}{"terraform_vars": map[string]interface{}{"vpc_id": "vpc"}},
+			"unknown key config.params.terraform_vars.vpc_id, expected one of account_id,",
+		},
+		{
+			"invalid name", map[string]interface{}{"terraform_vars": map[string]interface{}{"region": "aws region"}},
+			`must be a valid terraform variable name, got "aws region"`,
+		},
+		{
+			"true", map[string]interface{}{"terraform_vars": map[string]interface{}{"region": true}},
+			"config.params.terraform_vars.region must be a variable name or false",
+		},
+		{
+			"standard tag", map[string]interface{}{"tags": map[string]interface{}{"team": "other-team"}},
+			"config.params.tags.team is set by the plugin and cannot be overridden",
+		},
+		{
+			"tag not a string", map[string]interface{}{"tags": map[string]interface{}{"owners": []interface{}{"a", "b"}}},
+			"config.params.tags.owners must be a string",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// When
+			response, output := prepareTerraformVars(t, test.config, nil)
+
+			// Then
+			if response.Success || !strings.Contains(output, test.expected) {
+				t.Fatalf("expected failure with %q, got %v with output: %s", test.expected, response.Success, output)
+			}
+		})
+	}
+}
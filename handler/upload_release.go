@@ -4,11 +4,10 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	common "github.com/mergermarket/cdflow2-config-common"
 )
 
+// UploadRelease uploads the release to the release bucket, along with metadata describing where it came from.
 func (h *Handler) UploadRelease(request *common.UploadReleaseRequest, response *common.UploadReleaseResponse, configureReleaseRequest *common.ConfigureReleaseRequest, releaseDir string) error {
 	log.Println("uploading...")
 	team, err := h.getTeam(configureReleaseRequest.Config["team"])
@@ -18,6 +17,25 @@ func (h *Handler) UploadRelease(request *common.UploadReleaseRequest, response *
 		return nil
 	}
 
+	// the component may have been migrated while the release was being built
+	if err := h.checkMigrated(team, configureReleaseRequest.Component); err != nil {
+		response.Success = false
+		fmt.Fprintln(h.ErrorStream, err)
+		return nil
+	}
+
+	metadata, err := newReleaseMetadata(team, request, configureReleaseRequest).toMap()
+	if err != nil {
+		return err
+	}
+	if _, ok := h.releaseStore.(*s3ReleaseStore); ok {
+		var dropped []string
+		metadata, dropped = s3Metadata(metadata)
+		for _, message := range dropped {
+			fmt.Fprintf(h.ErrorStream, "  %s %s\n", h.styles.warningCross, message)
+		}
+	}
+
 	releaseReader, err := h.ReleaseSaver.Save(
 		configureReleaseRequest.Component,
 		configureReleaseRequest.Version,
@@ -29,18 +47,13 @@ func (h *Handler) UploadRelease(request *common.UploadReleaseRequest, response *
 	defer releaseReader.Close()
 
 	releaseKey := releaseS3Key(team, configureReleaseRequest.Component, configureReleaseRequest.Version)
-	s3Uploader := s3manager.NewUploaderWithClient(h.getS3Client())
-	if _, err := s3Uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(h.releaseBucket),
-		Key:    aws.String(releaseKey),
-		Body:   releaseReader,
-	}); err != nil {
-		fmt.Fprintln(h.ErrorStream, "Unable to upload release to S3:", err)
+	if err := h.releaseStore.Put(releaseKey, releaseReader, metadata); err != nil {
+		fmt.Fprintln(h.ErrorStream, "Unable to upload release:", err)
 		response.Success = false
 		return nil
 	}
 
-	fmt.Fprintf(h.ErrorStream, "- Release uploaded to s3://%s/%s\n", h.releaseBucket, releaseKey)
+	fmt.Fprintf(h.ErrorStream, "- Release uploaded to %s\n", h.releaseStore.URL(releaseKey))
 
 	return nil
 }
@@ -0,0 +1,213 @@
+// Package cli runs commands directly against the plugin, outside of the cdflow2 request/response protocol - e.g.:
+//
+//	docker run -v $PWD:/work -w /work -e AWS_ACCESS_KEY_ID -e AWS_SECRET_ACCESS_KEY -e AWS_SESSION_TOKEN \
+//	    mergermarket/cdflow2-config-aws-simple release-info -component my-component -version 42
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+	"gopkg.in/yaml.v3"
+)
+
+// command defines the flags for a command and returns a function that runs it once the flags have been parsed.
+type command func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error
+
+var commands = map[string]command{
+	"decommission": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		return func(h *handler.Handler) error {
+			return h.Decommission(&handler.DecommissionRequest{CommandRequest: *request})
+		}
+	},
+	"freeze": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		envs := flags.String("env", "", "comma separated environments to freeze")
+		reason := flags.String("reason", "", "reason for the freeze, shown when deployments are refused")
+		duration := flags.Duration("duration", 0, "how long the freeze lasts (e.g. 4h) - until lifted if not set")
+		allComponents := flags.Bool("all-components", false, "freeze all of the team's components")
+		list := flags.Bool("list", false, "list the team's freezes")
+		lift := flags.String("lift", "", "ID of a freeze to lift")
+		return func(h *handler.Handler) error {
+			var envNames []string
+			for _, env := range strings.Split(*envs, ",") {
+				if env = strings.TrimSpace(env); env != "" {
+					envNames = append(envNames, env)
+				}
+			}
+			return h.Freeze(&handler.FreezeRequest{
+				CommandRequest: *request,
+				Envs:           envNames,
+				Reason:         *reason,
+				Duration:       *duration,
+				AllComponents:  *allComponents,
+				List:           *list,
+				Lift:           *lift,
+			})
+		}
+	},
+	"gc": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		keep := flags.Int("keep", 10, "number of most recent releases to keep")
+		days := flags.Int("days", 30, "keep releases deployed to any environment within this many days")
+		dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting anything")
+		report := flags.String("report", "", "path to write a JSON report to")
+		yes := flags.Bool("yes", false, "delete without asking for confirmation")
+		return func(h *handler.Handler) error {
+			return h.GC(&handler.GCRequest{
+				CommandRequest: *request,
+				Keep:           *keep,
+				Days:           *days,
+				DryRun:         *dryRun,
+				Report:         *report,
+				Yes:            *yes,
+			})
+		}
+	},
+	"iam-policy": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		phase := flags.String("phase", "", "only output the policy for this phase - setup, release or deploy")
+		format := flags.String("format", "json", "output format - json or terraform")
+		return func(h *handler.Handler) error {
+			return h.IAMPolicy(&handler.IAMPolicyRequest{CommandRequest: *request, Phase: *phase, Format: *format})
+		}
+	},
+	"migrate": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		allComponents := flags.Bool("all-components", false, "migrate all of the team's components")
+		releaseBucket := flags.String("to-release-bucket", "", "bucket to copy releases to")
+		tfstateBucket := flags.String("to-tfstate-bucket", "", "bucket to copy terraform state and deployment records to")
+		region := flags.String("to-region", "", "region of the destination buckets - config.params.default_region if not set")
+		roleARN := flags.String("to-role-arn", "", "role to assume to access the destination buckets, e.g. in another account")
+		cutover := flags.Bool("cutover", false, "stop deployments using the source buckets once everything has been copied")
+		allowPartial := flags.Bool("allow-partial", false, "allow the cutover when state in buckets from config.params.environments is not migrated")
+		return func(h *handler.Handler) error {
+			return h.Migrate(&handler.MigrateRequest{
+				CommandRequest: *request,
+				AllComponents:  *allComponents,
+				ReleaseBucket:  *releaseBucket,
+				TfstateBucket:  *tfstateBucket,
+				Region:         *region,
+				RoleARN:        *roleARN,
+				Cutover:        *cutover,
+				AllowPartial:   *allowPartial,
+			})
+		}
+	},
+	"release-info": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		version := flags.String("version", "", "version of the release")
+		return func(h *handler.Handler) error {
+			return h.ReleaseInfo(&handler.ReleaseInfoRequest{CommandRequest: *request, Version: *version})
+		}
+	},
+	"restore-state": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		env := flags.String("env", "", "environment whose terraform state to restore")
+		versionID := flags.String("version-id", "", "version of the state to restore - lists versions if not set")
+		limit := flags.Int("limit", 20, "maximum number of versions to list")
+		return func(h *handler.Handler) error {
+			return h.RestoreState(&handler.RestoreStateRequest{CommandRequest: *request, EnvName: *env, VersionID: *versionID, Limit: *limit})
+		}
+	},
+	"unlock": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		env := flags.String("env", "", "environment whose terraform state to unlock")
+		lockID := flags.String("lock-id", "", "only remove the lock if it has this ID")
+		return func(h *handler.Handler) error {
+			return h.Unlock(&handler.UnlockRequest{CommandRequest: *request, EnvName: *env, LockID: *lockID})
+		}
+	},
+	"status": func(flags *flag.FlagSet, request *handler.CommandRequest) func(h *handler.Handler) error {
+		env := flags.String("env", "", "only show this environment")
+		return func(h *handler.Handler) error {
+			return h.Status(&handler.StatusRequest{CommandRequest: *request, EnvName: *env})
+		}
+	},
+}
+
+// IsCommand returns true if name is a command that can be run with Run.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// CommandNames returns the names of all commands.
+func CommandNames() []string {
+	var result []string
+	for name := range commands {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Run parses the arguments for the named command and runs it, returning the exit code for the process.
+func Run(h *handler.Handler, name string, args []string) int {
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(h.ErrorStream, "unknown command %q, expected one of: %s\n", name, strings.Join(CommandNames(), ", "))
+		return 2
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(h.ErrorStream)
+	configPath := flags.String("config", "cdflow.yaml", "path to cdflow.yaml")
+	component := flags.String("component", "", "name of the component")
+
+	var request handler.CommandRequest
+	run := command(flags, &request)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(h.ErrorStream, err)
+		return 1
+	}
+	request.Component = *component
+	request.Config = config
+	request.Env = environ()
+
+	if err := run(h); err != nil {
+		if success, ok := err.(handler.Exit); ok {
+			if success {
+				return 0
+			}
+			return 1
+		}
+		fmt.Fprintln(h.ErrorStream, err)
+		return 1
+	}
+	return 0
+}
+
+// LoadConfig returns config.params from the cdflow.yaml at path - i.e. the config that cdflow2 would send with each request.
+func LoadConfig(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	var manifest struct {
+		Config struct {
+			Params map[string]interface{} `yaml:"params"`
+		} `yaml:"config"`
+	}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	if manifest.Config.Params == nil {
+		return map[string]interface{}{}, nil
+	}
+	return manifest.Config.Params, nil
+}
+
+func environ() map[string]string {
+	result := make(map[string]string)
+	for _, item := range os.Environ() {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 2 {
+			result[parts[0]] = parts[1]
+		}
+	}
+	return result
+}
@@ -0,0 +1,172 @@
+package cli_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+	"github.com/mergermarket/cdflow2-config-simple-aws/internal/cli"
+)
+
+func TestLoadConfig(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-aws-simple-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cdflow.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+version: 2
+config:
+  image: mergermarket/cdflow2-config-aws-simple
+  params:
+    team: my-team
+    default_region: eu-west-1
+    environments:
+      live:
+        region: us-east-1
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	config, err := cli.LoadConfig(path)
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if config["team"] != "my-team" || config["default_region"] != "eu-west-1" {
+		t.Fatalf("unexpected config: %v", config)
+	}
+	environments, ok := config["environments"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected nested params to be map[string]interface{} like those in cdflow2 requests, got %T", config["environments"])
+	}
+	if environments["live"].(map[string]interface{})["region"] != "us-east-1" {
+		t.Fatalf("unexpected environments: %v", environments)
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	if !cli.IsCommand("release-info") {
+		t.Fatal("expected release-info to be a command")
+	}
+	if cli.IsCommand("forward") {
+		t.Fatal("forward should not be a command")
+	}
+}
+
+type cliS3 struct {
+	s3iface.S3API
+	put map[string]string
+}
+
+func (m *cliS3) ListBuckets(*s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
+	return &s3.ListBucketsOutput{Buckets: []*s3.Bucket{
+		{Name: aws.String("cdflow2-release-bucket-1")},
+		{Name: aws.String("cdflow2-tfstate-bucket-1")},
+	}}, nil
+}
+
+func (m *cliS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	fn(&s3.ListObjectsV2Output{}, true)
+	return nil
+}
+
+func (m *cliS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.put[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = string(data)
+	return &s3.PutObjectOutput{}, nil
+}
+
+type cliDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (cliDynamoDB) DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{}, nil
+}
+
+type cliSTS struct {
+	stsiface.STSAPI
+}
+
+func (cliSTS) GetCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String("arn:aws:sts::123456789012:assumed-role/deploy/session"),
+	}, nil
+}
+
+func TestRunFreezeAllComponents(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-aws-simple-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cdflow.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+version: 2
+config:
+  image: mergermarket/cdflow2-config-aws-simple
+  params:
+    team: my-team
+    default_region: eu-west-1
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"AWS_ACCESS_KEY_ID": "foo", "AWS_SECRET_ACCESS_KEY": "bar"} {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	s3Client := &cliS3{put: make(map[string]string)}
+	var errorBuffer bytes.Buffer
+	h := handler.New(&handler.Opts{
+		S3Client:       s3Client,
+		DynamoDBClient: cliDynamoDB{},
+		STSClient:      cliSTS{},
+		OutputStream:   &bytes.Buffer{},
+		ErrorStream:    &errorBuffer,
+	})
+
+	// When
+	code := cli.Run(h, "freeze", []string{"-config", path, "-all-components", "-env", "live", "-reason", "incident"})
+
+	// Then
+	if code != 0 {
+		t.Fatalf("expected success without -component, got exit code %d: %s", code, errorBuffer.String())
+	}
+	if len(s3Client.put) != 1 {
+		t.Fatalf("expected one freeze to be saved, got %v", s3Client.put)
+	}
+	for key, data := range s3Client.put {
+		if !strings.HasPrefix(key, "cdflow2-tfstate-bucket-1/cdflow2-freezes/my-team/") || strings.Contains(data, `"component"`) {
+			t.Fatalf("expected a freeze of all of my-team's components, got %s: %s", key, data)
+		}
+	}
+	if !strings.Contains(errorBuffer.String(), "lift it with: freeze -all-components -lift ") {
+		t.Fatalf("expected lift instructions for all components, got: %s", errorBuffer.String())
+	}
+}
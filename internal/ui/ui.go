@@ -2,12 +2,12 @@ package ui
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
+	"io"
 )
 
 // Confirm Asks a question and gets a yes or no answer
-func Confirm(message string, userInput *bytes.Buffer, output *bytes.Buffer) bool {
+func Confirm(message string, userInput io.Reader, output io.Writer) bool {
 	fmt.Fprint(output, message)
 	scanner := bufio.NewScanner(userInput)
 	scanner.Scan()
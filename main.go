@@ -2,14 +2,19 @@ package main
 
 import (
 	"os"
+	// the image has no zoneinfo, which freeze windows in a time zone need
+	_ "time/tzdata"
 
 	common "github.com/mergermarket/cdflow2-config-common"
 	"github.com/mergermarket/cdflow2-config-simple-aws/handler"
+	"github.com/mergermarket/cdflow2-config-simple-aws/internal/cli"
 )
 
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "forward" {
 		common.Forward(os.Stdin, os.Stdout, "")
+	} else if len(os.Args) >= 2 && cli.IsCommand(os.Args[1]) {
+		os.Exit(cli.Run(handler.New(&handler.Opts{}), os.Args[1], os.Args[2:]))
 	} else {
 		common.Listen(handler.New(&handler.Opts{}), "", "/release", nil)
 	}